@@ -0,0 +1,290 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Operations of `/entity/_aggregate`, each takes a comma separated list of fields:
+// `?groupBy=status&sum=amount&avg=amount&min=createdAt&max=createdAt&distinct=city`.
+type AggregateOp string
+
+const (
+	SumOp      AggregateOp = "sum"
+	AvgOp      AggregateOp = "avg"
+	MinOp      AggregateOp = "min"
+	MaxOp      AggregateOp = "max"
+	DistinctOp AggregateOp = "distinct"
+)
+
+var aggregateOps = []AggregateOp{SumOp, AvgOp, MinOp, MaxOp, DistinctOp}
+
+// Types with an order, compared like `_sort` compares them
+var orderedTypes = []FieldType{NumberType, DateType, StringType, NameType, UsernameType, FullnameType, EmailType, UrlType, IpType, UuidType, IdType, PhoneType}
+
+// Types holding a single value that can be grouped by
+var groupTypes = append([]FieldType{BooleanType, RefType}, orderedTypes...)
+
+// Field types each operation accepts, fields of entities without a schema accept every operation
+var aggregateTypes = map[AggregateOp][]FieldType{
+	SumOp:      {NumberType},
+	AvgOp:      {NumberType},
+	MinOp:      orderedTypes,
+	MaxOp:      orderedTypes,
+	DistinctOp: groupTypes,
+}
+
+type Aggregation struct {
+	GroupBy []SortKey
+	Fields  map[AggregateOp][]SortKey
+
+	numbers []SortKey // fields summed for sum and avg, once even if both are requested
+	groups  map[string]*group
+}
+
+// Summary of the records sharing the same values of the groupBy fields
+type group struct {
+	key      []any
+	count    int
+	sums     map[string]float64
+	numbers  map[string]int // number of values summed, for the average
+	mins     map[string]any
+	maxs     map[string]any
+	distinct map[string]map[string]any // values by their json encoding
+}
+
+// Parses the aggregation params of a query string.
+// Operations are checked against the types of the fields in the schema.
+func ParseAggregation(query url.Values, entity Entity) (*Aggregation, error) {
+	a := &Aggregation{Fields: make(map[AggregateOp][]SortKey), groups: make(map[string]*group)}
+
+	var err error
+	a.GroupBy, err = aggregateFields(query["groupBy"], "groupBy", groupTypes, entity)
+	if err != nil {
+		return nil, err
+	}
+	for _, op := range aggregateOps {
+		keys, err := aggregateFields(query[string(op)], string(op), aggregateTypes[op], entity)
+		if err != nil {
+			return nil, err
+		}
+		if len(keys) != 0 {
+			a.Fields[op] = keys
+		}
+		if op == SumOp || op == AvgOp {
+			for _, k := range keys {
+				if !slices.ContainsFunc(a.numbers, func(n SortKey) bool { return n.Field == k.Field }) {
+					a.numbers = append(a.numbers, k)
+				}
+			}
+		}
+	}
+	return a, nil
+}
+
+func aggregateFields(params []string, param string, types []FieldType, entity Entity) ([]SortKey, error) {
+	keys := make([]SortKey, 0)
+	for _, value := range params {
+		for _, name := range strings.Split(value, ",") {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				return nil, fmt.Errorf("%s: empty field name", param)
+			}
+			key := SortKey{Field: name}
+			if len(entity.Schema) != 0 {
+				path := strings.Split(name, ".")
+				f, ok := schemaField(entity.Schema, path)
+				if !ok {
+					return nil, fmt.Errorf("%s: %s has no field %q", param, entity.Name, name)
+				}
+				many, _ := f.Options["many"].(bool)
+				many = many || inList(entity.Schema, path)
+				if many || !slices.Contains(types, f.Kind) {
+					return nil, fmt.Errorf("%s: %s can't be applied to %s, a %s field", param, param, name, describeKind(f, many))
+				}
+				key.field = &f
+			}
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+// Returns true if a field is an array or is nested in one, it holds several values per record
+func inList(fields []Field, path []string) bool {
+	for _, f := range fields {
+		if f.Name != path[0] {
+			continue
+		}
+		if f.Kind == ArrayType {
+			return true
+		}
+		return len(path) > 1 && inList(f.Schema, path[1:])
+	}
+	return false
+}
+
+func describeKind(f Field, many bool) string {
+	if many {
+		return "list of " + string(f.Kind)
+	}
+	return string(f.Kind)
+}
+
+// Returns a validator adding the records matching the filters to the aggregation without keeping them
+func (a *Aggregation) Validator(filters []Filter) *Validtor {
+	v := FilterValidator(filters)
+	v.validate = append(v.validate, func(b []byte) bool {
+		var record map[string]any
+		if err := json.Unmarshal(b, &record); err == nil {
+			a.add(record)
+		}
+		return false
+	})
+	return v
+}
+
+func (a *Aggregation) add(record map[string]any) {
+	key := make([]any, len(a.GroupBy))
+	for i, k := range a.GroupBy {
+		key[i] = sortValue(lookup(record, strings.Split(k.Field, ".")))
+	}
+	id, _ := json.Marshal(key)
+	g, ok := a.groups[string(id)]
+	if !ok {
+		g = &group{
+			key:      key,
+			sums:     make(map[string]float64),
+			numbers:  make(map[string]int),
+			mins:     make(map[string]any),
+			maxs:     make(map[string]any),
+			distinct: make(map[string]map[string]any),
+		}
+		a.groups[string(id)] = g
+	}
+	g.count++
+
+	for _, k := range a.numbers {
+		for _, v := range lookup(record, strings.Split(k.Field, ".")) {
+			if n, ok := k.normalize(v).(float64); ok {
+				g.sums[k.Field] += n
+				g.numbers[k.Field]++
+			}
+		}
+	}
+	for op, keys := range a.Fields {
+		for _, k := range keys {
+			for _, v := range lookup(record, strings.Split(k.Field, ".")) {
+				if v == nil {
+					continue
+				}
+				switch op {
+				case MinOp:
+					if m, ok := g.mins[k.Field]; !ok || compareValues(k.normalize(v), k.normalize(m)) < 0 {
+						g.mins[k.Field] = v
+					}
+				case MaxOp:
+					if m, ok := g.maxs[k.Field]; !ok || compareValues(k.normalize(v), k.normalize(m)) > 0 {
+						g.maxs[k.Field] = v
+					}
+				case DistinctOp:
+					if g.distinct[k.Field] == nil {
+						g.distinct[k.Field] = make(map[string]any)
+					}
+					b, _ := json.Marshal(v)
+					g.distinct[k.Field][string(b)] = v
+				}
+			}
+		}
+	}
+}
+
+// Returns the summary of the records, or the list of groups ordered by their values when grouping
+func (a *Aggregation) Result() any {
+	if len(a.GroupBy) == 0 {
+		g, ok := a.groups["[]"]
+		if !ok {
+			g = &group{}
+		}
+		return a.summary(g)
+	}
+
+	groups := make([]*group, 0, len(a.groups))
+	for _, g := range a.groups {
+		groups = append(groups, g)
+	}
+	slices.SortFunc(groups, func(x, y *group) int {
+		for i, k := range a.GroupBy {
+			if c := compareKeys(k, x.key[i], y.key[i]); c != 0 {
+				return c
+			}
+		}
+		return 0
+	})
+
+	result := make([]map[string]any, 0, len(groups))
+	for _, g := range groups {
+		summary := a.summary(g)
+		key := make(map[string]any, len(a.GroupBy))
+		for i, k := range a.GroupBy {
+			key[k.Field] = g.key[i]
+		}
+		summary["group"] = key
+		result = append(result, summary)
+	}
+	return result
+}
+
+func (a *Aggregation) summary(g *group) map[string]any {
+	summary := map[string]any{"count": g.count}
+	for op, keys := range a.Fields {
+		values := make(map[string]any, len(keys))
+		for _, k := range keys {
+			switch op {
+			case SumOp:
+				values[k.Field] = roundSum(g.sums[k.Field])
+			case AvgOp:
+				values[k.Field] = nil
+				if g.numbers[k.Field] != 0 {
+					values[k.Field] = roundSum(g.sums[k.Field] / float64(g.numbers[k.Field]))
+				}
+			case MinOp:
+				values[k.Field] = g.mins[k.Field]
+			case MaxOp:
+				values[k.Field] = g.maxs[k.Field]
+			case DistinctOp:
+				list := make([]any, 0, len(g.distinct[k.Field]))
+				for _, v := range g.distinct[k.Field] {
+					list = append(list, v)
+				}
+				slices.SortFunc(list, func(x, y any) int { return compareKeys(k, x, y) })
+				values[k.Field] = list
+			}
+		}
+		summary[string(op)] = values
+	}
+	return summary
+}
+
+// Drops the rounding errors accumulated by summing floats, 9490.429999999997 reads 9490.43
+func roundSum(n float64) float64 {
+	r, _ := strconv.ParseFloat(strconv.FormatFloat(n, 'g', 15, 64), 64)
+	return r
+}
+
+// Orders values like `_sort` does, nil values come last
+func compareKeys(k SortKey, a, b any) int {
+	switch {
+	case a == nil && b == nil:
+		return 0
+	case a == nil:
+		return 1
+	case b == nil:
+		return -1
+	}
+	return compareValues(k.normalize(a), k.normalize(b))
+}
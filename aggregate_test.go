@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"testing"
+)
+
+var orders = Entity{
+	Name: "orders",
+	Schema: []Field{
+		{Name: "status", Kind: StringType},
+		{Name: "amount", Kind: NumberType},
+		{Name: "paid", Kind: BooleanType},
+		{Name: "customer", Kind: RefType, Options: map[string]any{"entity": "users"}},
+		{Name: "items", Kind: RefType, Options: map[string]any{"entity": "products", "many": true}},
+		{Name: "tags", Kind: ArrayType, Items: &Field{Kind: StringType}},
+		{Name: "address", Kind: ObjectType, Schema: []Field{{Name: "city", Kind: StringType}}},
+	},
+}
+
+func TestParseAggregation(t *testing.T) {
+	for _, test := range []struct {
+		query string
+		err   string
+	}{
+		{"", ""},
+		{"groupBy=status,paid&sum=amount&avg=amount", ""},
+		{"groupBy=customer&min=amount,status&max=status", ""},
+		{"distinct=address.city&groupBy=address.city", ""},
+		{"sum=status", "sum: sum can't be applied to status, a string field"},
+		{"min=paid", "min: min can't be applied to paid, a bool field"},
+		{"groupBy=items", "groupBy: groupBy can't be applied to items, a list of ref field"},
+		{"distinct=tags", "distinct: distinct can't be applied to tags, a list of string field"},
+		{"groupBy=address", "groupBy: groupBy can't be applied to address, a object field"},
+		{"sum=price", `sum: orders has no field "price"`},
+		{"sum=amount,", "sum: empty field name"},
+	} {
+		t.Run(test.query, func(t *testing.T) {
+			values, _ := url.ParseQuery(test.query)
+			_, err := ParseAggregation(values, orders)
+			if test.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || err.Error() != test.err {
+				t.Errorf("got error %v, want %s", err, test.err)
+			}
+		})
+	}
+
+	// Without a schema every field is accepted
+	if _, err := ParseAggregation(url.Values{"sum": {"anything"}}, Entity{Name: "logs"}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAggregation(t *testing.T) {
+	db := NewMemDB()
+	for i, r := range []map[string]any{
+		{"status": "paid", "amount": 10.1, "address": map[string]any{"city": "Paris"}},
+		{"status": "paid", "amount": 20.2, "address": map[string]any{"city": "Lyon"}},
+		{"status": "draft", "amount": 5.0, "address": map[string]any{"city": "Paris"}},
+		{"status": "draft", "amount": nil},
+		{"status": nil, "amount": 1.0},
+	} {
+		r["id"] = i + 1
+		b, _ := json.Marshal(r)
+		mustSet(t, db, "orders", fmt.Sprint(i+1), b)
+	}
+
+	for _, test := range []struct {
+		query string
+		want  string
+	}{
+		{"sum=amount&avg=amount&min=amount&max=status",
+			`{"count":5,"sum":{"amount":36.3},"avg":{"amount":9.075},"min":{"amount":1},"max":{"status":"paid"}}`},
+		{"status=paid&sum=amount", `{"count":2,"sum":{"amount":30.3}}`},
+		{"status=none&sum=amount&avg=amount&min=amount", `{"count":0,"sum":{"amount":0},"avg":{"amount":null},"min":{"amount":null}}`},
+		{"groupBy=status&sum=amount&avg=amount", `[
+			{"group":{"status":"draft"},"count":2,"sum":{"amount":5},"avg":{"amount":5}},
+			{"group":{"status":"paid"},"count":2,"sum":{"amount":30.3},"avg":{"amount":15.15}},
+			{"group":{"status":null},"count":1,"sum":{"amount":1},"avg":{"amount":1}}
+		]`},
+		{"distinct=address.city", `{"count":5,"distinct":{"address.city":["Lyon","Paris"]}}`},
+		{"groupBy=address.city&distinct=status", `[
+			{"group":{"address.city":"Lyon"},"count":1,"distinct":{"status":["paid"]}},
+			{"group":{"address.city":"Paris"},"count":2,"distinct":{"status":["draft","paid"]}},
+			{"group":{"address.city":null},"count":2,"distinct":{"status":["draft"]}}
+		]`},
+	} {
+		t.Run(test.query, func(t *testing.T) {
+			values, _ := url.ParseQuery(test.query)
+			a, err := ParseAggregation(values, orders)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, op := range aggregateOps {
+				values.Del(string(op))
+			}
+			values.Del("groupBy")
+			filters, err := ParseFilters(values)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := db.GetAll("orders", a.Validator(filters)); err != nil {
+				t.Fatal(err)
+			}
+			got, _ := json.Marshal(a.Result())
+			if !jsonEqual(t, got, test.want) {
+				t.Errorf("got %s, want %s", got, test.want)
+			}
+		})
+	}
+}
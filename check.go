@@ -0,0 +1,512 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Records grouped by entity name
+type Dataset map[string][]map[string]any
+
+// A single problem found while checking a record against its entity schema
+type Violation struct {
+	Entity string `json:"entity,omitempty"`
+	ID     string `json:"id,omitempty"`
+	Path   string `json:"path"`
+	Reason string `json:"reason"`
+}
+
+func (v Violation) String() string {
+	return fmt.Sprintf("%s[%s].%s: %s", v.Entity, v.ID, v.Path, v.Reason)
+}
+
+var uuidRegex = regexp.MustCompile(`^[0-9a-fA-F]{8}-?[0-9a-fA-F]{4}-?[0-9a-fA-F]{4}-?[0-9a-fA-F]{4}-?[0-9a-fA-F]{12}$`)
+
+// Loads a data file and groups its records by entity.
+// The file can be a json object keyed by entity name (json-server style),
+// a json array of records or newline delimited records (as produced by `gen`).
+// Records without an entity name are matched to the entity whose schema fits them best.
+func LoadDataFile(path string, entities []Entity) (Dataset, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	values := make([]json.RawMessage, 0)
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	for {
+		var raw json.RawMessage
+		err := decoder.Decode(&raw)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, raw)
+	}
+
+	if len(values) == 1 {
+		raw := bytes.TrimSpace(values[0])
+		if len(raw) > 0 && raw[0] == '[' {
+			var records []map[string]any
+			if err := json.Unmarshal(raw, &records); err != nil {
+				return nil, err
+			}
+			return groupRecords(entities, records)
+		}
+
+		var data Dataset
+		if err := json.Unmarshal(raw, &data); err == nil {
+			return data, nil
+		}
+	}
+
+	records := make([]map[string]any, 0, len(values))
+	for i, raw := range values {
+		var record map[string]any
+		if err := json.Unmarshal(raw, &record); err != nil {
+			return nil, fmt.Errorf("record %d: %w", i+1, err)
+		}
+		records = append(records, record)
+	}
+	return groupRecords(entities, records)
+}
+
+func groupRecords(entities []Entity, records []map[string]any) (Dataset, error) {
+	data := make(Dataset)
+	for i, record := range records {
+		entity, err := matchEntity(entities, record)
+		if err != nil {
+			return nil, fmt.Errorf("record %d: %w", i+1, err)
+		}
+		data[entity.Name] = append(data[entity.Name], record)
+	}
+	return data, nil
+}
+
+// Finds the entity whose fields are the closest to the keys of the record
+func matchEntity(entities []Entity, record map[string]any) (Entity, error) {
+	if len(entities) == 1 {
+		return entities[0], nil
+	}
+
+	best, bestScore, tie := -1, 0, false
+	for i, entity := range entities {
+		score := 0
+		for key := range record {
+			if key == "id" || slices.ContainsFunc(entity.Schema, func(f Field) bool { return f.Name == key }) {
+				score++
+			} else {
+				score--
+			}
+		}
+		for _, field := range entity.Schema {
+			if _, ok := record[field.Name]; !ok {
+				score--
+			}
+		}
+
+		switch {
+		case best == -1 || score > bestScore:
+			best, bestScore, tie = i, score, false
+		case score == bestScore:
+			tie = true
+		}
+	}
+
+	if best == -1 || tie {
+		return Entity{}, errors.New("couldn't tell which entity it belongs to")
+	}
+	return entities[best], nil
+}
+
+// Builds schema-less entities from the entity names of a dataset
+func EntitiesFromData(data Dataset) []Entity {
+	entities := make([]Entity, 0, len(data))
+	for name, records := range data {
+		entities = append(entities, Entity{Name: name, Count: len(records)})
+	}
+	sort.Slice(entities, func(i, j int) bool {
+		return entities[i].Name < entities[j].Name
+	})
+	return entities
+}
+
+// Checks every record of the dataset against the schema
+func CheckData(entities []Entity, data Dataset) []Violation {
+	violations := make([]Violation, 0)
+
+	unknown := make([]string, 0)
+	for name := range data {
+		if !slices.ContainsFunc(entities, func(e Entity) bool { return e.Name == name }) {
+			unknown = append(unknown, name)
+		}
+	}
+	sort.Strings(unknown)
+	for _, name := range unknown {
+		violations = append(violations, Violation{
+			Entity: name,
+			ID:     "*",
+			Path:   "*",
+			Reason: "unknown entity",
+		})
+	}
+
+	ids := make(map[string]map[string]bool, len(data))
+	for name, records := range data {
+		ids[name] = make(map[string]bool, len(records))
+		for _, record := range records {
+			if record["id"] != nil {
+				ids[name][FormatID(record["id"])] = true
+			}
+		}
+	}
+
+	for _, entity := range entities {
+		for i, record := range data[entity.Name] {
+			id := fmt.Sprintf("#%d", i)
+			if record["id"] != nil {
+				id = FormatID(record["id"])
+			}
+
+			found := CheckRecord(entity.Schema, record)
+			if len(found) == 0 {
+				found = checkRefs(entity.Schema, record, ids, "")
+			}
+			for _, v := range found {
+				v.Entity = entity.Name
+				v.ID = id
+				violations = append(violations, v)
+			}
+		}
+	}
+
+	return violations
+}
+
+// Checks that the ref fields of a record point to existing records
+func checkRefs(schema []Field, record map[string]any, ids map[string]map[string]bool, prefix string) []Violation {
+	violations := make([]Violation, 0)
+	for _, field := range schema {
+		violations = append(violations, checkFieldRefs(field, record[field.Name], ids, prefix+field.Name)...)
+	}
+	return violations
+}
+
+func checkFieldRefs(field Field, value any, ids map[string]map[string]bool, path string) []Violation {
+	switch field.Kind {
+	case ObjectType:
+		if obj, ok := value.(map[string]any); ok {
+			return checkRefs(field.Schema, obj, ids, path+".")
+		}
+	case ArrayType:
+		violations := make([]Violation, 0)
+		values, _ := value.([]any)
+		for i, v := range values {
+			violations = append(violations, checkFieldRefs(*field.Items, v, ids, fmt.Sprintf("%s[%d]", path, i))...)
+		}
+		return violations
+	case RefType:
+		if value == nil {
+			return nil
+		}
+		values, ok := value.([]any)
+		if !ok {
+			values = []any{value}
+		}
+		violations := make([]Violation, 0)
+		for _, v := range values {
+			if !ids[refEntity(field)][FormatID(v)] {
+				violations = append(violations, Violation{
+					Path:   path,
+					Reason: fmt.Sprintf("no %s with id %s", refEntity(field), describe(v)),
+				})
+			}
+		}
+		return violations
+	}
+	return nil
+}
+
+// What CheckRecordWith tolerates, the zero value reports every difference with the schema
+type CheckPolicy struct {
+	AllowMissing bool // only fields with the `required` option must be present
+	AllowUnknown bool // fields that aren't in the schema are ignored
+}
+
+// Checks a single record for missing, extra and mistyped fields.
+// The `id` key is always allowed since it's added to every stored record.
+func CheckRecord(schema []Field, record map[string]any) []Violation {
+	return CheckRecordWith(schema, record, CheckPolicy{})
+}
+
+func CheckRecordWith(schema []Field, record map[string]any, policy CheckPolicy) []Violation {
+	return checkObject(schema, record, "", true, policy)
+}
+
+func checkObject(schema []Field, record map[string]any, prefix string, isRoot bool, policy CheckPolicy) []Violation {
+	violations := make([]Violation, 0)
+
+	for _, field := range schema {
+		value, ok := record[field.Name]
+		if !ok {
+			if policy.AllowMissing && !isRequired(field) {
+				continue
+			}
+			violations = append(violations, Violation{Path: prefix + field.Name, Reason: "missing field"})
+			continue
+		}
+		violations = append(violations, checkField(field, value, prefix+field.Name, policy)...)
+	}
+	if policy.AllowUnknown {
+		return violations
+	}
+
+	extra := make([]string, 0)
+	for key := range record {
+		if key == "id" && isRoot {
+			continue
+		}
+		if !slices.ContainsFunc(schema, func(f Field) bool { return f.Name == key }) {
+			extra = append(extra, key)
+		}
+	}
+	sort.Strings(extra)
+	for _, key := range extra {
+		violations = append(violations, Violation{Path: prefix + key, Reason: "unexpected field"})
+	}
+
+	return violations
+}
+
+// Checks a value against its field, going through the fields of objects and the items of arrays
+func checkField(field Field, value any, path string, policy CheckPolicy) []Violation {
+	if value == nil && isNullable(field) {
+		return nil
+	}
+
+	switch field.Kind {
+	case ObjectType:
+		obj, ok := value.(map[string]any)
+		if !ok {
+			return []Violation{{Path: path, Reason: fmt.Sprintf("expected object, got %s", describe(value))}}
+		}
+		return checkObject(field.Schema, obj, path+".", false, policy)
+	case ArrayType:
+		values, ok := value.([]any)
+		if !ok {
+			return []Violation{{Path: path, Reason: fmt.Sprintf("expected array, got %s", describe(value))}}
+		}
+		if min := optionInt(field, "minItems", 0); len(values) < min {
+			return []Violation{{Path: path, Reason: fmt.Sprintf("expected at least %d items, got %d", min, len(values))}}
+		}
+		if max, ok := field.Options["maxItems"].(float64); ok && len(values) > int(max) {
+			return []Violation{{Path: path, Reason: fmt.Sprintf("expected at most %d items, got %d", int(max), len(values))}}
+		}
+		violations := make([]Violation, 0)
+		for i, v := range values {
+			violations = append(violations, checkField(*field.Items, v, fmt.Sprintf("%s[%d]", path, i), policy)...)
+		}
+		return violations
+	}
+
+	if reason := checkValue(field, value); reason != "" {
+		return []Violation{{Path: path, Reason: reason}}
+	}
+	return nil
+}
+
+// Returns the reason a value doesn't match the field type and options, or an empty string if it does
+func checkValue(field Field, value any) string {
+	kind := field.Kind
+	mismatch := fmt.Sprintf("expected %s, got %s", kind, describe(value))
+
+	if value == nil && isNullable(field) {
+		return ""
+	}
+
+	if enum, ok := field.Options["enum"].([]any); ok {
+		if !slices.ContainsFunc(enum, func(v any) bool { return reflect.DeepEqual(v, value) }) {
+			values := make([]string, 0, len(enum))
+			for _, v := range enum {
+				values = append(values, describe(v))
+			}
+			return fmt.Sprintf("expected one of %s, got %s", strings.Join(values, ", "), describe(value))
+		}
+		return ""
+	}
+
+	switch kind {
+	case RefType:
+		if many, _ := field.Options["many"].(bool); many {
+			values, ok := value.([]any)
+			if !ok {
+				return fmt.Sprintf("expected a list of %s ids, got %s", refEntity(field), describe(value))
+			}
+			for _, v := range values {
+				if !isID(v) {
+					return fmt.Sprintf("expected a list of %s ids, got %s in the list", refEntity(field), describe(v))
+				}
+			}
+			return ""
+		}
+		if !isID(value) {
+			return fmt.Sprintf("expected a %s id, got %s", refEntity(field), describe(value))
+		}
+		return ""
+	case NumberType:
+		n, ok := value.(float64)
+		if !ok {
+			return mismatch
+		}
+		if min, ok := field.Options["min"].(float64); ok && n < min {
+			return fmt.Sprintf("expected a number >= %v, got %v", min, n)
+		}
+		if max, ok := field.Options["max"].(float64); ok && n > max {
+			return fmt.Sprintf("expected a number <= %v, got %v", max, n)
+		}
+		if _, ok := field.Options["precision"]; ok {
+			scale := math.Pow(10, optionFloat(field, "precision", 0))
+			if math.Round(n*scale)/scale != n {
+				return fmt.Sprintf("expected at most %d decimals, got %v", optionInt(field, "precision", 0), n)
+			}
+		}
+		return ""
+	case BooleanType:
+		if _, ok := value.(bool); !ok {
+			return mismatch
+		}
+		return ""
+	case AddressType:
+		if _, ok := value.(map[string]any); !ok {
+			return mismatch
+		}
+		return ""
+	case DateType:
+		return checkDate(field, value)
+	}
+
+	s, ok := value.(string)
+	if !ok {
+		return mismatch
+	}
+
+	switch kind {
+	case EmailType:
+		if !strings.Contains(s, "@") {
+			return mismatch
+		}
+	case UrlType:
+		if _, err := url.ParseRequestURI(s); err != nil {
+			return mismatch
+		}
+	case IpType:
+		if net.ParseIP(s) == nil {
+			return mismatch
+		}
+	case UuidType:
+		if !uuidRegex.MatchString(s) {
+			return mismatch
+		}
+	}
+
+	if min := optionInt(field, "minLength", 0); len(s) < min {
+		return fmt.Sprintf("expected at least %d characters, got %d", min, len(s))
+	}
+	if max, ok := field.Options["maxLength"].(float64); ok && len(s) > int(max) {
+		return fmt.Sprintf("expected at most %d characters, got %d", int(max), len(s))
+	}
+	if pattern, ok := field.Options["regex"].(string); ok && !matchRegex(pattern, s) {
+		return fmt.Sprintf("expected a match of /%s/, got %q", pattern, s)
+	}
+	return ""
+}
+
+// Checks a date against the `format` option and the `from`/`to` bounds.
+// Without a format, both 2006-01-02 and RFC 3339 dates are accepted.
+func checkDate(field Field, value any) string {
+	mismatch := fmt.Sprintf("expected %s, got %s", field.Kind, describe(value))
+
+	var t time.Time
+	var err error
+	layout := dateLayout(field)
+	switch v := value.(type) {
+	case float64:
+		if layout != "" {
+			return mismatch
+		}
+		t = time.Unix(int64(v), 0).UTC()
+	case string:
+		if layout == "" {
+			return mismatch
+		}
+		if field.Options["format"] == nil {
+			t, err = parseDate(v)
+		} else {
+			t, err = time.Parse(layout, v)
+		}
+		if err != nil {
+			return fmt.Sprintf("expected a date formatted as %q, got %q", layout, v)
+		}
+	default:
+		return mismatch
+	}
+
+	from, to, _ := dateRange(field)
+	if field.Options["from"] != nil && t.Before(from) || field.Options["to"] != nil && t.After(to) {
+		return fmt.Sprintf("expected a date between %s and %s, got %s", from.Format(time.DateOnly), to.Format(time.DateOnly), describe(value))
+	}
+	return ""
+}
+
+// Compiled `regex` options, patterns are matched against the whole value
+var regexCache sync.Map
+
+func matchRegex(pattern string, s string) bool {
+	re, ok := regexCache.Load(pattern)
+	if !ok {
+		re, _ = regexCache.LoadOrStore(pattern, regexp.MustCompile("^(?:"+pattern+")$"))
+	}
+	return re.(*regexp.Regexp).MatchString(s)
+}
+
+func isID(value any) bool {
+	switch value.(type) {
+	case string, float64:
+		return true
+	}
+	return false
+}
+
+// Short human readable description of a json value
+func describe(value any) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case string:
+		return fmt.Sprintf("%q", v)
+	case float64, bool:
+		return fmt.Sprint(v)
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	default:
+		return fmt.Sprintf("%T", v)
+	}
+}
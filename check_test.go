@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var checkEntities = []Entity{
+	{Name: "users", Schema: []Field{
+		{Name: "name", Kind: StringType},
+		{Name: "age", Kind: NumberType, Options: map[string]any{"nullable": true}},
+	}},
+	{Name: "posts", Schema: []Field{
+		{Name: "title", Kind: StringType},
+		{Name: "author", Kind: RefType, Options: map[string]any{"entity": "users"}},
+		{Name: "tags", Kind: ArrayType, Items: &Field{Kind: StringType}},
+	}},
+}
+
+func writeTemp(t *testing.T, name string, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadDataFile(t *testing.T) {
+	ada := map[string]any{"id": 1.0, "name": "ada", "age": 36.0}
+	post := map[string]any{"id": 1.0, "title": "hello", "author": 1.0, "tags": []any{}}
+
+	for _, test := range []struct {
+		name    string
+		content string
+		want    Dataset
+		err     string
+	}{
+		{"json-server object", `{"users": [{"id": 1, "name": "ada", "age": 36}], "posts": []}`,
+			Dataset{"users": {ada}, "posts": {}}, ""},
+		{"array matched to the entities", `[{"id": 1, "name": "ada", "age": 36}, {"id": 1, "title": "hello", "author": 1, "tags": []}]`,
+			Dataset{"users": {ada}, "posts": {post}}, ""},
+		{"newline delimited", "{\"id\": 1, \"name\": \"ada\", \"age\": 36}\n{\"id\": 1, \"title\": \"hello\", \"author\": 1, \"tags\": []}\n",
+			Dataset{"users": {ada}, "posts": {post}}, ""},
+		{"invalid json", `{"users": [`, nil, "unexpected EOF"},
+		{"invalid record", "{\"id\": 1}\n[1]\n", nil, "record 2: json: cannot unmarshal array into Go value of type map[string]interface {}"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			data, err := LoadDataFile(writeTemp(t, "db.json", test.content), checkEntities)
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Fatalf("got error %v, want %s", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(data, test.want) {
+				t.Errorf("got %v, want %v", data, test.want)
+			}
+		})
+	}
+
+	// Without a schema the records of a list can't be told apart
+	_, err := LoadDataFile(writeTemp(t, "db.json", `[{"id": 1, "name": "ada"}]`), nil)
+	if want := "record 1: couldn't tell which entity it belongs to"; err == nil || err.Error() != want {
+		t.Errorf("list without a schema: got error %v, want %s", err, want)
+	}
+	if _, err := LoadDataFile(filepath.Join(t.TempDir(), "missing.json"), checkEntities); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("missing file: got %v, want ErrNotExist", err)
+	}
+}
+
+func TestCheckData(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		content string
+		want    []string
+	}{
+		{"valid", `{"users": [{"id": 1, "name": "ada", "age": null}], "posts": [{"id": 1, "title": "hello", "author": 1, "tags": ["a"]}]}`, []string{}},
+		{"missing field", `{"users": [{"id": 1, "age": 36}]}`, []string{"users[1].name: missing field"}},
+		{"wrong type", `{"users": [{"id": 1, "name": "ada", "age": "36"}], "posts": [{"id": 1, "title": "hello", "author": 1, "tags": [1]}]}`,
+			[]string{`users[1].age: expected number, got "36"`, "posts[1].tags[0]: expected string, got 1"}},
+		{"unexpected field", `{"users": [{"id": 1, "name": "ada", "age": 36, "admin": true}]}`, []string{"users[1].admin: unexpected field"}},
+		{"dangling ref", `{"users": [{"id": 1, "name": "ada", "age": 36}], "posts": [{"id": 1, "title": "hello", "author": 2, "tags": []}]}`,
+			[]string{"posts[1].author: no users with id 2"}},
+		{"unknown entity", `{"users": [], "tags": [{"id": 1}], "comments": []}`, []string{"comments[*].*: unknown entity", "tags[*].*: unknown entity"}},
+		{"record without an id", `{"users": [{"name": "ada", "age": 36}, {"name": 1, "age": 36}]}`, []string{"users[#1].name: expected string, got 1"}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			data, err := LoadDataFile(writeTemp(t, "db.json", test.content), checkEntities)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make([]string, 0)
+			for _, v := range CheckData(checkEntities, data) {
+				got = append(got, v.String())
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+// `serveur check` exits with 1 when the data file has problems, it's run in a child process since it exits
+func TestCheckCommand(t *testing.T) {
+	if args := os.Getenv("SERVEUR_CHECK_ARGS"); args != "" {
+		checkCmd.Run(checkCmd, strings.Split(args, " "))
+		os.Exit(0)
+	}
+
+	schema := writeTemp(t, "schema.json", `{"entities": [{"name": "users", "count": 1, "schema": [{"name": "name", "type": "string"}]}]}`)
+	for _, test := range []struct {
+		name    string
+		content string
+		status  int
+		output  string
+	}{
+		{"valid", `{"users": [{"id": 1, "name": "ada"}]}`, 0, "is valid"},
+		{"problems", `{"users": [{"id": 1, "name": 1}, {"id": 2}]}`, 1, "Found 2 problem(s) in"},
+		{"invalid json", `{"users": `, 1, "Couldn't load the data file"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			data := writeTemp(t, "db.json", test.content)
+			cmd := exec.Command(os.Args[0], "-test.run=^TestCheckCommand$")
+			cmd.Env = append(os.Environ(), "SERVEUR_CHECK_ARGS="+schema+" "+data)
+			output, err := cmd.CombinedOutput()
+			status := 0
+			var exit *exec.ExitError
+			if errors.As(err, &exit) {
+				status = exit.ExitCode()
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if status != test.status || !strings.Contains(string(output), test.output) {
+				t.Errorf("got status %d and output %s, want %d and %q", status, output, test.status, test.output)
+			}
+		})
+	}
+}
@@ -2,13 +2,18 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"slices"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -29,7 +34,7 @@ var genCmd = &cobra.Command{
 		downloadFile(schemaPath)
 
 		dataPath := "./db.json"
-		if len(args) != 0 && args[1] != "" {
+		if len(args) > 1 && args[1] != "" {
 			dataPath = args[1]
 		}
 
@@ -44,25 +49,41 @@ var genCmd = &cobra.Command{
 			ErrExit("Couldn't parse the schema file", err)
 		}
 
+		seed, err := cmd.Flags().GetInt64("seed")
+		if err != nil {
+			ErrExit("Couldn't get the seed flag", err)
+		}
+		if seed != 0 {
+			SetSeed(entities, seed)
+		}
+
+		counts := make(map[string]int, len(entities))
+		for _, entity := range entities {
+			counts[entity.Name] = entity.Count
+		}
+
+		// Entities are generated concurrently, records are written in schema order once they are all generated
+		var mu sync.Mutex
+		records := make(map[string][]map[string]any, len(entities))
+		err = GenerateEntities(entities, counts, make(References), func(e Entity, _ string, data map[string]any) error {
+			mu.Lock()
+			defer mu.Unlock()
+			records[e.Name] = append(records[e.Name], data)
+			return nil
+		})
+		if err != nil {
+			ErrExit("Couldn't generate fake data", err)
+		}
+
 		encoder := json.NewEncoder(file)
-		var wg *sync.WaitGroup
 		for _, entity := range entities {
-			wg.Add(1)
-			go func(entity Entity, wg *sync.WaitGroup) {
-				for i := 0; i < entity.Count; i++ {
-					data, err := GenerateFakeData(entity.Schema)
-					if err != nil {
-						ErrExit("Couldn't generate fake data", err)
-					}
-					err = encoder.Encode(data)
-					if err != nil {
-						ErrExit("Couldn't write to the output file", err)
-					}
+			for _, data := range records[entity.Name] {
+				err = encoder.Encode(data)
+				if err != nil {
+					ErrExit("Couldn't write to the output file", err)
 				}
-				wg.Done()
-			}(entity, wg)
+			}
 		}
-		wg.Wait()
 	},
 }
 
@@ -70,7 +91,38 @@ var checkCmd = &cobra.Command{
 	Use:     "check",
 	Short:   "Validate a data file against a schema file",
 	Example: "check ./schema.json ./db.json",
-	Run:     func(cmd *cobra.Command, args []string) {},
+	Args:    cobra.MaximumNArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		schemaPath := "./schema.json"
+		if len(args) > 0 && args[0] != "" {
+			schemaPath = args[0]
+		}
+		downloadFile(schemaPath)
+
+		dataPath := "./db.json"
+		if len(args) > 1 && args[1] != "" {
+			dataPath = args[1]
+		}
+
+		entities, err := ParseFile(schemaPath)
+		if err != nil {
+			ErrExit("Couldn't parse the schema file", err)
+		}
+
+		data, err := LoadDataFile(dataPath, entities)
+		if err != nil {
+			ErrExit("Couldn't load the data file", err)
+		}
+
+		violations := CheckData(entities, data)
+		if len(violations) == 0 {
+			cyan.Println(dataPath, "is valid")
+			return
+		}
+
+		reportViolations(violations)
+		ErrExit(fmt.Sprintf("Found %d problem(s) in", len(violations)), errors.New(dataPath))
+	},
 }
 
 var initCmd = &cobra.Command{
@@ -173,7 +225,18 @@ A field can be one of these types:
 			ErrExit("Couldn't get the port flag", err)
 		}
 
-		db := NewDB(isInMemory, dbPath)
+		storeKind, err := cmd.Flags().GetString("store")
+		if err != nil {
+			ErrExit("Couldn't get the store flag", err)
+		}
+		if !slices.Contains(storeKinds, StoreKind(storeKind)) {
+			ErrExit("Invalid store", errors.New(storeKind))
+		}
+
+		db, err := NewStore(StoreKind(storeKind), isInMemory, dbPath)
+		if err != nil {
+			ErrExit("Couldn't open the database", err)
+		}
 		defer db.Close()
 
 		staticPath, err := cmd.Flags().GetString("static")
@@ -191,11 +254,62 @@ A field can be one of these types:
 		path, watcher := initFile(schemaPath)
 		defer watcher.Close()
 
-		entities, err := ParseFile(path)
+		ingestPath, err := cmd.Flags().GetString("ingest")
+		if err != nil {
+			ErrExit("Couldn't get the ingest flag", err)
+		}
+
+		// The records of a json file store are checked against the schema like an ingested file,
+		// and it's watched for edits
+		file, isJSONFile := db.(*JSONFileDB)
+		isStoreFile := false
+		if isJSONFile && ingestPath == "" {
+			if _, err := os.Stat(file.Path()); err == nil {
+				ingestPath, isStoreFile = file.Path(), true
+			}
+		}
+
+		isTopUp, err := cmd.Flags().GetBool("top-up")
+		if err != nil {
+			ErrExit("Couldn't get the top-up flag", err)
+		}
+
+		dumpPath, err := cmd.Flags().GetString("out-dump")
 		if err != nil {
+			ErrExit("Couldn't get the out-dump flag", err)
+		}
+
+		validation, err := cmd.Flags().GetString("validation")
+		if err != nil {
+			ErrExit("Couldn't get the validation flag", err)
+		}
+		if !slices.Contains(validationModes, ValidationMode(validation)) {
+			ErrExit("Invalid validation mode", errors.New(validation))
+		}
+
+		// The schema is optional when ingesting a data file
+		entities, err := ParseFile(path)
+		if err != nil && !(ingestPath != "" && errors.Is(err, os.ErrNotExist)) {
 			ErrExit("Couldn't parse the schema file", err)
 		}
 
+		var ingested Dataset
+		var ingestedSum string // the ingest file is ingested again on reload only if it changed
+		if ingestPath != "" {
+			ingested, entities = loadIngestFile(ingestPath, entities)
+			if ingestedSum, err = fileSum(ingestPath); err != nil {
+				ErrExit("Couldn't read the ingest file", err)
+			}
+		}
+
+		seed, err := cmd.Flags().GetInt64("seed")
+		if err != nil {
+			ErrExit("Couldn't get the seed flag", err)
+		}
+		if seed != 0 {
+			SetSeed(entities, seed)
+		}
+
 		log.Println(entities)
 
 		isForceRefresh, err := cmd.Flags().GetBool("refresh")
@@ -203,37 +317,141 @@ A field can be one of these types:
 			ErrExit("Couldn't get the refresh flag", err)
 		}
 
-		prevSchema := db.getSchema()
-		isPrevSchemaValid := ValidateSchema(entities, prevSchema)
-		if !isPrevSchemaValid || isForceRefresh {
-			db.Clear()
-			db.storeSchema(entities)
-			FillDatabase(entities, db)
+		if err := syncDatabase(entities, ingested, db, isTopUp, isForceRefresh); err != nil {
+			ErrExit("Couldn't prepare the database", err)
+		}
+		if err := db.SetIndexes(entities); err != nil {
+			ErrExit("Couldn't index the database", err)
+		}
+		if isJSONFile {
+			if err := file.Save(); err != nil {
+				ErrExit("Couldn't write the database file", err)
+			}
+			watcher.Add(file.Path())
+		}
+
+		if dumpPath != "" {
+			err := WriteDump(dumpPath, db, entities)
+			if err != nil {
+				ErrExit("Couldn't write the dump file", err)
+			}
 		}
 
 		// Initialize the server
-		server := NewRestServer(
-			db,
-			entities,
-			AddLogger(),
-			AddHomePage(schemaPath),
-			AddStaticFiles(staticPath),
-		)
-		server.InitRouter()
+		newServer := func(entities []Entity) *RestSever {
+			server := NewRestServer(
+				db,
+				entities,
+				AddLogger(),
+				AddHomePage(schemaPath),
+				AddDumpRoute(dumpPath),
+				AddValidation(ValidationMode(validation)),
+				AddStaticFiles(staticPath),
+			)
+			server.InitRouter()
+			return server
+		}
+		// The router is swapped when the schema changes, the server keeps running
+		var current atomic.Pointer[RestSever]
+		current.Store(newServer(entities))
+		handler := NewSwappableHandler(current.Load().mux)
 		srv := &http.Server{
 			Addr:    fmt.Sprintf(":%d", port),
-			Handler: server.mux,
+			Handler: handler,
 		}
 
 		// Start the server
 		go func() {
-			log.Fatal(srv.ListenAndServe())
+			err := srv.ListenAndServe()
+			if !errors.Is(err, http.ErrServerClosed) {
+				log.Fatal(err)
+			}
 		}()
 
+		// Loads a changed schema, the current router keeps serving until the new one is ready.
+		// Requests are held while the records are migrated, so they neither see nor write records halfway,
+		// except the reads still running after drainTimeout (see SwappableHandler.Pause).
+		reload := func(name string) error {
+			entities, err := ParseFile(name)
+			if err != nil {
+				return err
+			}
+			// The records of the json file store are already loaded, they're migrated like the other stores.
+			// So are the records of an ingest file that didn't change, the records created since are kept.
+			var ingested Dataset
+			var sum string
+			if ingestPath != "" && !isStoreFile {
+				if sum, err = fileSum(ingestPath); err != nil {
+					return fmt.Errorf("couldn't read the ingest file: %w", err)
+				}
+				if sum != ingestedSum || isForceRefresh {
+					if ingested, entities, err = readIngestFile(ingestPath, entities); err != nil {
+						return err
+					}
+				}
+			}
+			if seed != 0 {
+				SetSeed(entities, seed)
+			}
+
+			resume := handler.Pause(drainTimeout)
+			defer resume()
+			if ingested != nil || !ValidateSchema(entities, storedSchema(db)) || isForceRefresh {
+				if err := syncDatabase(entities, ingested, db, isTopUp, isForceRefresh); err != nil {
+					return err
+				}
+				if ingested != nil {
+					ingestedSum = sum
+				}
+			}
+			if err := db.SetIndexes(entities); err != nil {
+				// The indexes of the current schema are kept
+				if err := db.SetIndexes(current.Load().entities); err != nil {
+					log.Println("Couldn't restore the indexes:", err)
+				}
+				return fmt.Errorf("couldn't index the database: %w", err)
+			}
+
+			server := newServer(entities)
+			current.Store(server)
+			drained := handler.Swap(server.mux)
+			log.Println("Reloaded the schema:", name)
+			// File events keep being handled while the requests of the previous router finish
+			go func() {
+				select {
+				case <-drained:
+				case <-time.After(drainTimeout):
+					log.Println("Requests of the previous schema are still running after", drainTimeout)
+				}
+			}()
+			return nil
+		}
+
 		go func() {
 			for {
 				event := <-watcher.Events
 
+				// Edits of the json file store are loaded right away
+				if isJSONFile && event.Name == file.Path() {
+					if event.Has(fsnotify.Rename) || event.Has(fsnotify.Remove) {
+						// Saves replace the file, the new one is watched
+						watcher.Remove(event.Name)
+						watcher.Add(event.Name)
+					}
+					changes, err := file.Reload()
+					if err != nil {
+						log.Println("Couldn't reload", event.Name, err)
+						continue
+					}
+					for _, c := range changes {
+						current.Load().recordChanged(c.entity, c.id, c.value)
+					}
+					if len(changes) != 0 {
+						log.Printf("Reloaded %s, %d record(s) changed", event.Name, len(changes))
+					}
+					continue
+				}
+
 				if event.Has(fsnotify.Rename) {
 					// HACK: The only way I found to makr sure I keep watching the file :(
 					watcher.Remove(event.Name)
@@ -245,47 +463,136 @@ A field can be one of these types:
 
 				// If the file is written to or renamed (which is the case when the file is saved in an editor)
 				if event.Has(fsnotify.Write) || event.Has(fsnotify.Rename) {
-					entities, err := ParseFile(event.Name)
-					if err != nil {
-						ErrExit("Couldn't parse the schema file", err)
-					}
-
-					prevSchema := db.getSchema()
-					isPrevSchemaValid := ValidateSchema(entities, prevSchema)
-					if !isPrevSchemaValid || isForceRefresh {
-						// Clear the database and fill it with the new data
-						db.Clear()
-						db.Close()
-						db = NewDB(isInMemory, dbPath)
-						FillDatabase(entities, db)
-						db.storeSchema(entities)
+					if err := reload(event.Name); err != nil {
+						red.Fprintln(os.Stderr, "Couldn't reload the schema, the previous one is still served:", err)
 					}
-
-					// Close the previous server and create a new one
-					server := NewRestServer(
-						db,
-						entities,
-						AddLogger(),
-						AddHomePage(schemaPath),
-						AddStaticFiles(staticPath),
-					)
-					server.InitRouter()
-					srv.Close()
-					srv.Handler = server.mux
-
-					go func() {
-						log.Fatal(srv.ListenAndServe())
-					}()
 				}
 			}
 		}()
 
 		// gracefully shutdown the server
 		ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
-		defer stop()
 		<-ctx.Done()
+		// A second signal kills the server
+		stop()
 		log.Println("Shutting down the server...")
+		ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			red.Fprintln(os.Stderr, "Requests were still running after", drainTimeout, "the dump may miss their writes:", err)
+		} else {
+			// A reload migrating the records is waited for, and no other one starts
+			handler.Pause(0)
+		}
+		if dumpPath != "" {
+			log.Println("Writing the dump file:", dumpPath)
+			// The schema may have been reloaded since the start
+			err := WriteDump(dumpPath, db, current.Load().entities)
+			if err != nil {
+				red.Fprintln(os.Stderr, "Couldn't write the dump file", err)
+			}
+		}
 		db.Close()
-		srv.Shutdown(ctx)
 	},
 }
+
+// Loads the ingest file and validates it against the schema.
+// Without a schema, the entities are taken from the data file.
+// Exits with a report of the invalid records if the data doesn't match the schema.
+func loadIngestFile(path string, entities []Entity) (Dataset, []Entity) {
+	data, entities, err := readIngestFile(path, entities)
+	if err != nil {
+		ErrExit("Refusing to start,", err)
+	}
+	return data, entities
+}
+
+// Loads the ingest file like loadIngestFile, the invalid records are reported and an error is returned
+func readIngestFile(path string, entities []Entity) (Dataset, []Entity, error) {
+	data, err := LoadDataFile(path, entities)
+	if err != nil {
+		return nil, nil, fmt.Errorf("couldn't load the ingest file: %w", err)
+	}
+
+	if entities == nil {
+		return data, EntitiesFromData(data), nil
+	}
+
+	violations := CheckData(entities, data)
+	if len(violations) != 0 {
+		reportViolations(violations)
+		return nil, nil, fmt.Errorf("found %d problem(s) in %s", len(violations), path)
+	}
+	return data, entities, nil
+}
+
+// Returns a hash of the content of a file
+func fileSum(path string) (string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Returns the schema the stored records were generated from.
+// A schema that can't be read is treated as missing, so the data is generated again.
+func storedSchema(db Store) []Entity {
+	schema, err := db.GetSchema()
+	if err != nil {
+		log.Println("Couldn't read the stored schema:", err)
+	}
+	return schema
+}
+
+// Brings the stored records in line with the schema.
+// The records of a changed schema are migrated, see MigrateDatabase. They're generated again when there are none yet,
+// when they can't be migrated, on --refresh or when a data file is ingested.
+func syncDatabase(entities []Entity, ingested Dataset, db Store, isTopUp bool, isForceRefresh bool) error {
+	prev := storedSchema(db)
+	if prev != nil && ingested == nil && !isForceRefresh {
+		if ValidateSchema(entities, prev) {
+			return nil
+		}
+		err := MigrateDatabase(entities, prev, db)
+		if err == nil {
+			if err := db.StoreSchema(entities); err != nil {
+				return fmt.Errorf("couldn't store the schema: %w", err)
+			}
+			return nil
+		}
+		if !errors.Is(err, ErrNotMigratable) {
+			return fmt.Errorf("couldn't migrate the database: %w", err)
+		}
+		log.Printf("%v, generating them again", err)
+	}
+
+	if err := db.Clear(); err != nil {
+		return fmt.Errorf("couldn't clear the database: %w", err)
+	}
+	if err := db.StoreSchema(entities); err != nil {
+		return fmt.Errorf("couldn't store the schema: %w", err)
+	}
+	return seedDatabase(entities, ingested, db, isTopUp)
+}
+
+// Fills the database from the ingested data if any, or with fake data otherwise
+func seedDatabase(entities []Entity, ingested Dataset, db Store, isTopUp bool) error {
+	if ingested == nil {
+		if err := FillDatabase(entities, db); err != nil {
+			return fmt.Errorf("couldn't generate the data: %w", err)
+		}
+		return nil
+	}
+	if err := IngestData(entities, ingested, db, isTopUp); err != nil {
+		return fmt.Errorf("couldn't ingest the data: %w", err)
+	}
+	return nil
+}
+
+func reportViolations(violations []Violation) {
+	for _, v := range violations {
+		red.Fprintln(os.Stderr, v)
+	}
+}
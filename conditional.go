@@ -0,0 +1,122 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrPreconditionFailed = errors.New("the record doesn't match If-Match")
+
+// Last modification times of the records changed through the API.
+// Records that weren't changed since the server started were last modified when it started.
+type modTimes struct {
+	mu       sync.RWMutex
+	start    time.Time
+	records  map[string]time.Time
+	entities map[string]time.Time
+}
+
+func newModTimes() *modTimes {
+	return &modTimes{
+		start:    time.Now().UTC().Truncate(time.Second),
+		records:  make(map[string]time.Time),
+		entities: make(map[string]time.Time),
+	}
+}
+
+// Records a change of a record, HTTP dates have a precision of a second
+func (m *modTimes) touch(entityName string, id string) {
+	now := time.Now().UTC().Truncate(time.Second)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.records[entityName+"/"+id] = now
+	m.entities[entityName] = now
+}
+
+func (m *modTimes) record(entityName string, id string) time.Time {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if t, ok := m.records[entityName+"/"+id]; ok {
+		return t
+	}
+	return m.start
+}
+
+// Returns the last time a record of the entity was created, changed or deleted
+func (m *modTimes) entity(entityName string) time.Time {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if t, ok := m.entities[entityName]; ok {
+		return t
+	}
+	return m.start
+}
+
+// Returns a strong ETag for a response, stored records are hashed as they are
+func ETag(data any) string {
+	h := sha256.New()
+	switch v := data.(type) {
+	case []byte:
+		h.Write(v)
+	case [][]byte:
+		for _, record := range v {
+			h.Write(record)
+			h.Write([]byte{'\n'})
+		}
+	default:
+		b, _ := json.Marshal(data)
+		h.Write(b)
+	}
+	return `"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`
+}
+
+// Checks an ETag against an If-Match or If-None-Match header.
+// Weak validators match their strong counterpart, which is only right for If-None-Match.
+func matchETag(header string, etag string, weak bool) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if weak {
+			tag = strings.TrimPrefix(tag, "W/")
+		}
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// Replies to a GET with the data and its validators, or with 304 if the client's copy is fresh
+func conditionalResponse(r *http.Request, data any, modified time.Time) *ResResult {
+	etag := ETag(data)
+	header := http.Header{
+		"Etag":          {etag},
+		"Last-Modified": {modified.Format(http.TimeFormat)},
+	}
+
+	// If-Modified-Since is ignored when If-None-Match is there (RFC 9110)
+	notModified := false
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		notModified = matchETag(inm, etag, true)
+	} else if ims, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil {
+		notModified = !modified.After(ims)
+	}
+	if notModified {
+		return &ResResult{Status: http.StatusNotModified, Header: header}
+	}
+	return &ResResult{Status: http.StatusOK, Header: header, Data: data}
+}
+
+// Checks the If-Match header of a write against the stored record
+func checkIfMatch(r *http.Request, value []byte) error {
+	ifMatch := r.Header.Get("If-Match")
+	if ifMatch != "" && !matchETag(ifMatch, ETag(value), false) {
+		return ErrPreconditionFailed
+	}
+	return nil
+}
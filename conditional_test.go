@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMatchETag(t *testing.T) {
+	etag := `"abc"`
+	for _, test := range []struct {
+		header string
+		weak   bool
+		want   bool
+	}{
+		{`"abc"`, false, true},
+		{`"abd"`, false, false},
+		{`*`, false, true},
+		{`"x", "abc"`, false, true},
+		{`"x","abc"`, false, true},
+		{`"x", "y"`, false, false},
+		{`W/"abc"`, false, false},
+		{`W/"abc"`, true, true},
+		{`"x", W/"abc"`, true, true},
+		{`abc`, true, false},
+	} {
+		if got := matchETag(test.header, etag, test.weak); got != test.want {
+			t.Errorf("matchETag(%s, weak %v) = %v, want %v", test.header, test.weak, got, test.want)
+		}
+	}
+}
+
+func TestETag(t *testing.T) {
+	a, b := []byte(`{"id":1}`), []byte(`{"id":2}`)
+	if ETag(a) == ETag(b) {
+		t.Error("different records have the same ETag")
+	}
+	if ETag(a) != ETag([]byte(`{"id":1}`)) {
+		t.Error("the same record has different ETags")
+	}
+	// Records aren't concatenated without a separator
+	if ETag([][]byte{a, b}) == ETag([][]byte{[]byte(`{"id":1}{"id":2}`)}) {
+		t.Error("a list and a single record have the same ETag")
+	}
+	if ETag(map[string]any{"count": 1}) != ETag(map[string]any{"count": 1}) {
+		t.Error("the same value has different ETags")
+	}
+}
+
+func TestConditionalResponse(t *testing.T) {
+	data := []byte(`{"id":1}`)
+	etag := ETag(data)
+	modified := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	for _, test := range []struct {
+		name   string
+		header http.Header
+		want   int
+	}{
+		{"no validators", nil, http.StatusOK},
+		{"matching If-None-Match", http.Header{"If-None-Match": {etag}}, http.StatusNotModified},
+		{"weak If-None-Match", http.Header{"If-None-Match": {"W/" + etag}}, http.StatusNotModified},
+		{"any If-None-Match", http.Header{"If-None-Match": {"*"}}, http.StatusNotModified},
+		{"stale If-None-Match", http.Header{"If-None-Match": {`"old"`}}, http.StatusOK},
+		{"If-Modified-Since at the change", http.Header{"If-Modified-Since": {modified.Format(http.TimeFormat)}}, http.StatusNotModified},
+		{"If-Modified-Since after the change", http.Header{"If-Modified-Since": {modified.Add(time.Hour).Format(http.TimeFormat)}}, http.StatusNotModified},
+		{"If-Modified-Since before the change", http.Header{"If-Modified-Since": {modified.Add(-time.Hour).Format(http.TimeFormat)}}, http.StatusOK},
+		{"invalid If-Modified-Since", http.Header{"If-Modified-Since": {"yesterday"}}, http.StatusOK},
+		{"If-None-Match wins over If-Modified-Since", http.Header{
+			"If-None-Match":     {`"old"`},
+			"If-Modified-Since": {modified.Format(http.TimeFormat)},
+		}, http.StatusOK},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/users/1", nil)
+			for key, values := range test.header {
+				r.Header[key] = values
+			}
+			res := conditionalResponse(r, data, modified)
+			if res.Status != test.want {
+				t.Errorf("got %d, want %d", res.Status, test.want)
+			}
+			if res.Header.Get("Etag") != etag || res.Header.Get("Last-Modified") != "Wed, 01 May 2024 12:00:00 GMT" {
+				t.Errorf("missing validators: %v", res.Header)
+			}
+			if res.Status == http.StatusNotModified && res.Data != nil {
+				t.Error("304 with a body")
+			}
+		})
+	}
+}
+
+func TestCheckIfMatch(t *testing.T) {
+	value := []byte(`{"id":1}`)
+	for _, test := range []struct {
+		header string
+		want   error
+	}{
+		{"", nil},
+		{ETag(value), nil},
+		{"*", nil},
+		{`"old", ` + ETag(value), nil},
+		{`"old"`, ErrPreconditionFailed},
+		{"W/" + ETag(value), ErrPreconditionFailed},
+	} {
+		r := httptest.NewRequest("PUT", "/users/1", nil)
+		if test.header != "" {
+			r.Header.Set("If-Match", test.header)
+		}
+		if err := checkIfMatch(r, value); !errors.Is(err, test.want) {
+			t.Errorf("If-Match %s: got %v, want %v", test.header, err, test.want)
+		}
+	}
+}
@@ -1,81 +1,228 @@
 package main
 
 import (
+	"bytes"
+	"encoding/binary"
 	"encoding/json"
-	"log"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
 
 	badger "github.com/dgraph-io/badger/v4"
 )
 
+// Storage backend of the server. Records are json documents keyed by entity name and id,
+// GetAll and Dump return them in the order of their encoded ids (see EncodeKey).
 type Store interface {
 	GetAll(entityname string, validator *Validtor) ([][]byte, error)
+	// Returns the number of records the validator keeps, only the keys are read when it has no validation
+	Count(entityname string, validator *Validtor) (int, error)
 	Get(entityname string, key []byte) ([]byte, error)
 	Set(entityname string, key []byte, value []byte) error
-	Delete(entityname string, key []byte) error
-	Patch(entityname string, key []byte, value []byte) error
+	// Writes a new record, fails with ErrExists if a record has the key
+	Create(entityname string, key []byte, value []byte) error
+	// Deletes a record and returns it, check can refuse the deletion by returning an error
+	Delete(entityname string, key []byte, check func(value []byte) error) ([]byte, error)
+	Patch(entityname string, key []byte, patch func(value []byte) ([]byte, error)) ([]byte, error)
+	Dump(entitynames []string) (map[string][][]byte, error)
+	// Applies the writes in a single transaction, nothing is written if one of them fails.
+	// The autoincrement counters are raised past the integer ids written.
+	Batch(writes []Write) error
+	NextID(entityname string) (int64, error)
+	// Returns the last id handed out by NextID, without taking one
+	LastID(entityname string) (int64, error)
+	SetIndexes(entities []Entity) error
+
+	// Returns the schema the records were generated from, nil if there is none
+	GetSchema() ([]Entity, error)
+	StoreSchema(schema []Entity) error
+	// Removes every record, the stored schema and the id counters
+	Clear() error
+	Close() error
+}
+
+// A write of Batch, a nil value deletes the record
+type Write struct {
+	Entity string
+	Key    []byte
+	Value  []byte
+}
+
+type StoreKind string
+
+const (
+	BadgerStore   StoreKind = "badger"   // persisted in the --db-path directory, in memory with --memmory
+	MemoryStore   StoreKind = "memory"   // maps in memory, nothing is persisted
+	JSONFileStore StoreKind = "jsonfile" // a json-server style file at --db-path
+	SQLiteStore   StoreKind = "sqlite"   // tables of a SQLite file at --db-path, in memory with --memmory
+)
+
+var storeKinds = []StoreKind{BadgerStore, MemoryStore, JSONFileStore, SQLiteStore}
+
+// Opens the storage backend of the given kind
+func NewStore(kind StoreKind, isInMemory bool, dbPath string) (Store, error) {
+	switch kind {
+	case BadgerStore:
+		return NewDB(isInMemory, dbPath)
+	case MemoryStore:
+		return NewMemDB(), nil
+	case JSONFileStore:
+		// The default path is a directory name
+		if filepath.Ext(dbPath) == "" {
+			dbPath += ".json"
+		}
+		return NewJSONFileDB(filepath.Clean(dbPath))
+	case SQLiteStore:
+		if filepath.Ext(dbPath) == "" {
+			dbPath += ".sqlite"
+		}
+		return NewSQLiteDB(isInMemory, filepath.Clean(dbPath))
+	}
+	return nil, fmt.Errorf("unknown store %q", kind)
 }
 
 type DB struct {
-	db *badger.DB
+	db      *badger.DB
+	mu      sync.RWMutex       // guards indexes, they're set again when the schema is reloaded
+	indexes map[string][]Field // indexed fields by entity name
 }
 
 type Validtor struct {
 	validate  []func([]byte) bool
 	terminate []func([][]byte) bool
+	filters   []Filter // checked by validate, stores can use them to skip records
+	after     []byte   // encoded id, the records start after it (see EncodeKey)
 }
 
-const privateSchema = "__schema"
+// Returns true if a record passes every validation, a nil validator keeps every record.
+// The validations are run in order and stop at the first failure, some of them count the records they see.
+func (v *Validtor) keeps(record []byte) bool {
+	if v == nil {
+		return true
+	}
+	for _, f := range v.validate {
+		if !f(record) {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns true once the records kept are enough and the store can stop reading,
+// stores check it before reading each record
+func (v *Validtor) done(result [][]byte) bool {
+	if v == nil {
+		return false
+	}
+	for _, f := range v.terminate {
+		if f(result) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true if the validator checks the records, they're counted from their keys otherwise
+func (v *Validtor) validates() bool {
+	return v != nil && len(v.validate) != 0
+}
+
+// Counts the records a validator keeps by reading them with GetAll, for the stores that must read the values
+func countKept(s Store, entityname string, valid *Validtor) (int, error) {
+	n := 0
+	counter := &Validtor{filters: valid.filters, after: valid.after}
+	counter.validate = append(slices.Clone(valid.validate), func([]byte) bool {
+		n++
+		return false
+	})
+	_, err := s.GetAll(entityname, counter)
+	return n, err
+}
+
+const (
+	privateSchema   = "__schema"
+	privateSequence = "__sequence-" // followed by the entity name, holds the last autoincrement id
+)
+
+// Returned by stores when a record doesn't exist
+var ErrNotFound = errors.New("record not found")
 
-func NewDB(isInMemory bool, dbPath string) *DB {
+// Returned by Create when a record already has the key
+var ErrExists = errors.New("record already exists")
+
+func NewDB(isInMemory bool, dbPath string) (*DB, error) {
 	opt := badger.DefaultOptions(dbPath)
 	if isInMemory {
-		opt = opt.WithInMemory(true)
+		opt = badger.DefaultOptions("").WithInMemory(true)
 	}
 	db, err := badger.Open(opt)
 	if err != nil {
-		log.Fatal("Couldn't Open Database")
+		return nil, err
 	}
-	return &DB{db}
+	return &DB{db: db}, nil
 }
 
-func (db *DB) Close() {
-	db.db.Close()
+func (db *DB) Close() error {
+	return db.db.Close()
 }
 
-func (db *DB) Clear() {
-	db.db.DropAll()
+func (db *DB) Clear() error {
+	return db.db.DropAll()
 }
 
 func (db *DB) GetAll(entityname string, valid *Validtor) ([][]byte, error) {
 	result := make([][]byte, 0)
-	var err error
-	prefix := []byte(entityname)
-	db.db.View(func(txn *badger.Txn) error {
-		it := txn.NewIterator(badger.DefaultIteratorOptions)
-		defer it.Close()
-	seeker:
-		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
-			item := it.Item()
-			err = item.Value(func(v []byte) error {
-				if valid != nil {
-					for _, f := range valid.validate {
-						if !f(v) {
-							return nil
-						}
+	prefix := []byte(entityname + "-")
+
+	// Keeps a record if it's valid
+	visit := func(item *badger.Item) error {
+		return item.Value(func(v []byte) error {
+			if valid.keeps(v) {
+				// v is only valid during the transaction
+				result = append(result, slices.Clone(v))
+			}
+			return nil
+		})
+	}
+
+	err := db.db.View(func(txn *badger.Txn) error {
+		// Filters on an indexed field only read the records found in the index
+		if valid != nil {
+			if ranges, ok := indexRanges(valid.filters, db.indexedFields(entityname), entityname); ok {
+				keys, err := indexLookup(txn, ranges)
+				if err != nil {
+					return err
+				}
+				for _, key := range keys {
+					if valid.done(result) {
+						return nil
+					}
+					if valid.after != nil && bytes.Compare(key, valid.after) <= 0 {
+						continue
+					}
+					item, err := txn.Get(append(slices.Clone(prefix), key...))
+					if errors.Is(err, badger.ErrKeyNotFound) {
+						continue
+					}
+					if err != nil {
+						return err
+					}
+					if err := visit(item); err != nil {
+						return err
 					}
 				}
-				result = append(result, v)
 				return nil
-			})
-			if err != nil {
-				return err
 			}
-			if valid != nil {
-				for _, f := range valid.terminate {
-					if f(result) {
-						break seeker
-					}
-				}
+		}
+
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for seek(it, prefix, valid); it.ValidForPrefix(prefix) && !valid.done(result); it.Next() {
+			if err := visit(it.Item()); err != nil {
+				return err
 			}
 		}
 		return nil
@@ -86,32 +233,93 @@ func (db *DB) GetAll(entityname string, valid *Validtor) ([][]byte, error) {
 	return result, nil
 }
 
+// Counts the keys of the records without reading their values when the validator doesn't check them
+func (db *DB) Count(entityname string, valid *Validtor) (int, error) {
+	if valid.validates() {
+		return countKept(db, entityname, valid)
+	}
+	n := 0
+	prefix := []byte(entityname + "-")
+	err := db.db.View(func(txn *badger.Txn) error {
+		opt := badger.DefaultIteratorOptions
+		opt.PrefetchValues = false
+		it := txn.NewIterator(opt)
+		defer it.Close()
+		for seek(it, prefix, valid); it.ValidForPrefix(prefix); it.Next() {
+			n++
+		}
+		return nil
+	})
+	return n, err
+}
+
+// Moves an iterator to the first record of an entity, or to the record after the one the validator starts after
+func seek(it *badger.Iterator, prefix []byte, valid *Validtor) {
+	if valid == nil || valid.after == nil {
+		it.Seek(prefix)
+		return
+	}
+	start := append(slices.Clone(prefix), valid.after...)
+	it.Seek(start)
+	if it.ValidForPrefix(start) && bytes.Equal(it.Item().Key(), start) {
+		it.Next()
+	}
+}
+
+// Returns the badger key of a record, ids are encoded so integers are kept in numeric order
+func recordKey(entityname string, id []byte) []byte {
+	return append([]byte(entityname+"-"), EncodeKey(string(id))...)
+}
+
+// Reads the value a write replaces so its index entries can be removed,
+// nil if the record doesn't exist or if its entity has no index
+func (db *DB) indexedValue(txn *badger.Txn, entityname string, key []byte) ([]byte, error) {
+	if len(db.indexedFields(entityname)) == 0 {
+		return nil, nil
+	}
+	item, err := txn.Get(recordKey(entityname, key))
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return item.ValueCopy(nil)
+}
+
 func (db *DB) Get(entityname string, key []byte) ([]byte, error) {
 	var result []byte
 	err := db.db.View(func(txn *badger.Txn) error {
-		item, err := txn.Get(append([]byte(entityname+"-"), key...))
+		item, err := txn.Get(recordKey(entityname, key))
 		if err != nil {
 			return err
 		}
-		err = item.Value(func(v []byte) error {
-			result = v
-			return nil
-		})
+		result, err = item.ValueCopy(nil)
 		if err != nil {
 			return err
 		}
 		return nil
 	})
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return nil, ErrNotFound
+	}
 	if err != nil {
 		return nil, err
 	}
 	return result, nil
 }
 
+// Writes a record and its index entries, fails with ErrConflict if a unique value is taken
 func (db *DB) Set(entityname string, key []byte, value []byte) error {
-	err := db.db.Update(func(txn *badger.Txn) error {
-		err := txn.Set(append([]byte(entityname+"-"), key...), value)
-		return err
+	err := db.update(func(txn *badger.Txn) error {
+		old, err := db.indexedValue(txn, entityname, key)
+		if err != nil {
+			return err
+		}
+		if err := db.updateIndexes(txn, entityname, EncodeKey(string(key)), old, value); err != nil {
+			return err
+		}
+		return txn.Set(recordKey(entityname, key), value)
 	})
 	if err != nil {
 		return err
@@ -119,59 +327,320 @@ func (db *DB) Set(entityname string, key []byte, value []byte) error {
 	return nil
 }
 
-func (db *DB) Delete(entityname string, key []byte) error {
-	err := db.db.Update(func(txn *badger.Txn) error {
-		err := txn.Delete(append([]byte(entityname+"-"),
-			key...))
-		return err
+// Writes a new record and its index entries, fails with ErrExists if a record has the key
+func (db *DB) Create(entityname string, key []byte, value []byte) error {
+	create := func(txn *badger.Txn) error {
+		_, err := txn.Get(recordKey(entityname, key))
+		if err == nil {
+			return ErrExists
+		}
+		if !errors.Is(err, badger.ErrKeyNotFound) {
+			return err
+		}
+		if err := db.updateIndexes(txn, entityname, EncodeKey(string(key)), nil, value); err != nil {
+			return err
+		}
+		return txn.Set(recordKey(entityname, key), value)
+	}
+
+	// The missing record is read in the transaction, a concurrent write of it conflicts and the loser finds it on the next try
+	return db.update(create)
+}
+
+// Runs an update transaction, it runs again when a concurrent transaction changed what it read
+func (db *DB) update(fn func(txn *badger.Txn) error) error {
+	for {
+		err := db.db.Update(fn)
+		if !errors.Is(err, badger.ErrConflict) {
+			return err
+		}
+	}
+}
+
+// Deletes a record and returns it, the check runs on the record in the same transaction
+func (db *DB) Delete(entityname string, key []byte, check func(value []byte) error) ([]byte, error) {
+	var result []byte
+	err := db.update(func(txn *badger.Txn) error {
+		item, err := txn.Get(recordKey(entityname, key))
+		if err != nil {
+			return err
+		}
+		result, err = item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		if check != nil {
+			if err := check(result); err != nil {
+				return err
+			}
+		}
+		if err := db.updateIndexes(txn, entityname, EncodeKey(string(key)), result, nil); err != nil {
+			return err
+		}
+		return txn.Delete(recordKey(entityname, key))
 	})
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return nil, ErrNotFound
+	}
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return nil
+	return result, nil
 }
 
-func (db *DB) Patch(entityname string, key []byte, valye []byte) error {
-	err := db.db.Update(func(txn *badger.Txn) error {
-		item, err := txn.Get(append([]byte(entityname+"-"), key...))
+// Replaces a record by the result of the patch function and returns it.
+// The record is read, patched and written in the same transaction.
+func (db *DB) Patch(entityname string, key []byte, patch func(value []byte) ([]byte, error)) ([]byte, error) {
+	var result []byte
+	err := db.update(func(txn *badger.Txn) error {
+		item, err := txn.Get(recordKey(entityname, key))
 		if err != nil {
 			return err
 		}
-		var value []byte
-		err = item.Value(func(v []byte) error {
-			value = v
-			return nil
-		})
+		value, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		result, err = patch(value)
+		if err != nil {
+			return err
+		}
+		if err := db.updateIndexes(txn, entityname, EncodeKey(string(key)), value, result); err != nil {
+			return err
+		}
+		return txn.Set(recordKey(entityname, key), result)
+	})
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Applies the writes and their index entries in a single transaction.
+// The writes must fit in a transaction, badger.ErrTxnTooBig is returned otherwise.
+func (db *DB) Batch(writes []Write) error {
+	return db.update(func(txn *badger.Txn) error {
+		written := make(map[string]int64)
+		for _, w := range writes {
+			old, err := db.indexedValue(txn, w.Entity, w.Key)
+			if err != nil {
+				return err
+			}
+			if err := db.updateIndexes(txn, w.Entity, EncodeKey(string(w.Key)), old, w.Value); err != nil {
+				return fmt.Errorf("%s %s: %w", w.Entity, w.Key, err)
+			}
+			if w.Value == nil {
+				err = txn.Delete(recordKey(w.Entity, w.Key))
+			} else {
+				err = txn.Set(recordKey(w.Entity, w.Key), w.Value)
+			}
+			if err != nil {
+				return err
+			}
+			if n, ok := intID(string(w.Key)); ok && w.Value != nil {
+				written[w.Entity] = max(written[w.Entity], n)
+			}
+		}
+
+		// Entities without a counter start after their greatest id anyway
+		for entityname, n := range written {
+			last, ok, err := db.counter(txn, entityname)
+			if err != nil {
+				return err
+			}
+			if ok && n > last {
+				if err := txn.Set([]byte(privateSequence+entityname), binary.BigEndian.AppendUint64(nil, uint64(n))); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// Returns the next id of an autoincrement entity.
+// The counter is kept in the database, it starts after the greatest integer id of the entity.
+func (db *DB) NextID(entityname string) (int64, error) {
+	var next int64
+	increment := func(txn *badger.Txn) error {
+		last, err := db.lastID(txn, entityname)
 		if err != nil {
 			return err
 		}
-		value = append(value, valye...)
-		err = txn.Set(append([]byte(entityname+"-"), key...), value)
+		next = last + 1
+		return txn.Set([]byte(privateSequence+entityname), binary.BigEndian.AppendUint64(nil, uint64(next)))
+	}
+
+	// Concurrent requests conflict on the counter, the loser tries again
+	err := db.update(increment)
+	return next, err
+}
+
+func (db *DB) LastID(entityname string) (int64, error) {
+	var last int64
+	err := db.db.View(func(txn *badger.Txn) error {
+		var err error
+		last, err = db.lastID(txn, entityname)
 		return err
 	})
+	return last, err
+}
+
+// Returns the counter of an entity, or its greatest integer id if it has no counter yet
+func (db *DB) lastID(txn *badger.Txn, entityname string) (int64, error) {
+	last, ok, err := db.counter(txn, entityname)
+	if err != nil || ok {
+		return last, err
+	}
+	return db.maxID(txn, entityname), nil
+}
+
+func (db *DB) counter(txn *badger.Txn, entityname string) (int64, bool, error) {
+	item, err := txn.Get([]byte(privateSequence + entityname))
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	var last int64
+	err = item.Value(func(v []byte) error {
+		last = int64(binary.BigEndian.Uint64(v))
+		return nil
+	})
+	return last, true, err
+}
+
+// Returns the greatest integer id of an entity, or 0 if there are none
+func (db *DB) maxID(txn *badger.Txn, entityname string) int64 {
+	opt := badger.DefaultIteratorOptions
+	opt.Reverse = true
+	opt.PrefetchValues = false
+	it := txn.NewIterator(opt)
+	defer it.Close()
+
+	prefix := []byte(entityname + "-")
+	it.Seek(append(slices.Clone(prefix), maxIntKey...))
+	if !it.ValidForPrefix(prefix) {
+		return 0
+	}
+	n, _ := intID(DecodeKey(it.Item().Key()[len(prefix):]))
+	return max(n, 0)
+}
+
+// Reads the records of every given entity in a single transaction,
+// so the result is a consistent snapshot of the database
+func (db *DB) Dump(entitynames []string) (map[string][][]byte, error) {
+	result := make(map[string][][]byte, len(entitynames))
+	err := db.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for _, entityname := range entitynames {
+			records := make([][]byte, 0)
+			prefix := []byte(entityname + "-")
+			for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+				v, err := it.Item().ValueCopy(nil)
+				if err != nil {
+					return err
+				}
+				records = append(records, v)
+			}
+			result[entityname] = records
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Writes a json-server style snapshot (`{ "entity": [ ... ] }`) of the store to a file.
+// The file is written to a temporary file first and then renamed,
+// so readers never see a partial dump.
+func WriteDump(path string, s Store, entities []Entity) error {
+	snapshot, err := Snapshot(s, entities)
 	if err != nil {
 		return err
 	}
-	return nil
+
+	content, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, content)
 }
 
-func (db *DB) getSchema() []Entity {
+// Writes a file through a temporary file renamed over it, so readers never see a partial file
+func writeFileAtomic(path string, content []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	// Temporary files are only readable by their owner
+	if err = tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	_, err = tmp.Write(content)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Returns the records of every entity keyed by entity name
+func Snapshot(s Store, entities []Entity) (map[string][]json.RawMessage, error) {
+	names := make([]string, 0, len(entities))
+	for _, e := range entities {
+		names = append(names, e.Name)
+	}
+
+	dump, err := s.Dump(names)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot := make(map[string][]json.RawMessage, len(dump))
+	for name, records := range dump {
+		snapshot[name] = make([]json.RawMessage, 0, len(records))
+		for _, record := range records {
+			snapshot[name] = append(snapshot[name], record)
+		}
+	}
+	return snapshot, nil
+}
+
+func (db *DB) GetSchema() ([]Entity, error) {
 	var result []Entity
-	db.db.View(func(txn *badger.Txn) error {
+	err := db.db.View(func(txn *badger.Txn) error {
 		item, err := txn.Get([]byte(privateSchema))
-		if err != nil {
+		if errors.Is(err, badger.ErrKeyNotFound) {
 			return nil
 		}
-		item.Value(func(v []byte) error {
-			json.Unmarshal(v, &result)
-			return nil
+		if err != nil {
+			return err
+		}
+		return item.Value(func(v []byte) error {
+			return json.Unmarshal(v, &result)
 		})
-		return nil
 	})
-	return result
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
 }
 
-func (db *DB) storeSchema(schema []Entity) error {
+func (db *DB) StoreSchema(schema []Entity) error {
 	schemaBytes, err := json.Marshal(schema)
 	if err != nil {
 		return err
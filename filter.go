@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A condition on a record field taken from the query string.
+// `?status=active` keeps the records whose status is active, an operator
+// suffix changes the comparison: `?price_gte=10`, `?status_ne=draft`,
+// `?name_like=^jo`, `?status_in=active,pending`.
+// Nested fields are separated by dots: `?address.city=Paris`.
+type Filter struct {
+	Field    string
+	Operator string
+	Values   []string
+	patterns []*regexp.Regexp
+}
+
+const (
+	EqOperator   = "eq"
+	GteOperator  = "gte"
+	LteOperator  = "lte"
+	NeOperator   = "ne"
+	LikeOperator = "like"
+	InOperator   = "in"
+)
+
+var filterOperators = []string{GteOperator, LteOperator, NeOperator, LikeOperator, InOperator}
+
+// Query params used for something else than filtering (`_page`, `_sort`, `q`, ...)
+func isReservedParam(key string) bool {
+	return strings.HasPrefix(key, "_") || key == "q"
+}
+
+// Parses the filters of a query string
+func ParseFilters(query url.Values) ([]Filter, error) {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		if !isReservedParam(key) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	filters := make([]Filter, 0, len(keys))
+	for _, key := range keys {
+		filter := Filter{Field: key, Operator: EqOperator, Values: query[key]}
+		for _, op := range filterOperators {
+			if field, ok := strings.CutSuffix(key, "_"+op); ok && field != "" {
+				filter.Field, filter.Operator = field, op
+				break
+			}
+		}
+
+		switch filter.Operator {
+		case InOperator:
+			values := make([]string, 0, len(filter.Values))
+			for _, v := range filter.Values {
+				values = append(values, strings.Split(v, ",")...)
+			}
+			filter.Values = values
+		case LikeOperator:
+			for _, v := range filter.Values {
+				re, err := regexp.Compile("(?i)" + v)
+				if err != nil {
+					return nil, fmt.Errorf("%s: invalid pattern: %w", key, err)
+				}
+				filter.patterns = append(filter.patterns, re)
+			}
+		case GteOperator, LteOperator:
+			if len(filter.Values) != 1 {
+				return nil, fmt.Errorf("%s: expected a single value", key)
+			}
+		}
+
+		filters = append(filters, filter)
+	}
+	return filters, nil
+}
+
+// Returns a validator keeping the records that match every filter
+func FilterValidator(filters []Filter) *Validtor {
+	v := &Validtor{filters: filters}
+	if len(filters) == 0 {
+		return v
+	}
+	v.validate = append(v.validate, func(b []byte) bool {
+		var record map[string]any
+		if err := json.Unmarshal(b, &record); err != nil {
+			return false
+		}
+		return MatchFilters(filters, record)
+	})
+	return v
+}
+
+// Counts the records matching the filters without keeping them, only the keys are read without filters
+func CountRecords(s Store, entityName string, filters []Filter) (int, error) {
+	return s.Count(entityName, FilterValidator(filters))
+}
+
+func MatchFilters(filters []Filter, record map[string]any) bool {
+	for _, f := range filters {
+		if !f.Match(record) {
+			return false
+		}
+	}
+	return true
+}
+
+// Checks a record against the filter.
+// When the field holds a list (or is nested in one), any of its values can match.
+func (f Filter) Match(record map[string]any) bool {
+	values := lookup(record, strings.Split(f.Field, "."))
+
+	switch f.Operator {
+	case NeOperator:
+		return !slices.ContainsFunc(values, func(v any) bool {
+			return slices.ContainsFunc(f.Values, func(q string) bool { return equals(v, q) })
+		})
+	case GteOperator, LteOperator:
+		return slices.ContainsFunc(values, func(v any) bool {
+			c, ok := compare(v, f.Values[0])
+			return ok && (f.Operator == GteOperator && c >= 0 || f.Operator == LteOperator && c <= 0)
+		})
+	case LikeOperator:
+		return slices.ContainsFunc(values, func(v any) bool {
+			return slices.ContainsFunc(f.patterns, func(re *regexp.Regexp) bool {
+				return re.MatchString(fmt.Sprint(v))
+			})
+		})
+	default:
+		return slices.ContainsFunc(values, func(v any) bool {
+			return slices.ContainsFunc(f.Values, func(q string) bool { return equals(v, q) })
+		})
+	}
+}
+
+// Returns the values at a dotted path, lists along the way are flattened
+func lookup(value any, path []string) []any {
+	if list, ok := value.([]any); ok {
+		values := make([]any, 0, len(list))
+		for _, v := range list {
+			values = append(values, lookup(v, path)...)
+		}
+		return values
+	}
+	if len(path) == 0 {
+		return []any{value}
+	}
+
+	obj, ok := value.(map[string]any)
+	if !ok {
+		return nil
+	}
+	v, ok := obj[path[0]]
+	if !ok {
+		return nil
+	}
+	return lookup(v, path[1:])
+}
+
+// Compares a json value with a query value, the query value is read as the json value's type
+func equals(v any, q string) bool {
+	switch v := v.(type) {
+	case nil:
+		return q == "null"
+	case float64:
+		n, err := strconv.ParseFloat(q, 64)
+		return err == nil && n == v
+	case bool:
+		b, err := strconv.ParseBool(q)
+		return err == nil && b == v
+	case string:
+		return v == q
+	}
+	return false
+}
+
+// Orders a json value and a query value, numbers are compared numerically and strings lexicographically
+func compare(v any, q string) (int, bool) {
+	switch v := v.(type) {
+	case float64:
+		n, err := strconv.ParseFloat(q, 64)
+		if err != nil {
+			return 0, false
+		}
+		switch {
+		case v < n:
+			return -1, true
+		case v > n:
+			return 1, true
+		}
+		return 0, true
+	case string:
+		return strings.Compare(v, q), true
+	}
+	return 0, false
+}
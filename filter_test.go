@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestParseFilters(t *testing.T) {
+	for _, test := range []struct {
+		query string
+		want  []Filter
+		err   string
+	}{
+		{"", []Filter{}, ""},
+		{"_page=2&_sort=name&q=ada", []Filter{}, ""},
+		{"status=active", []Filter{{Field: "status", Operator: EqOperator, Values: []string{"active"}}}, ""},
+		{"status=active&status=pending", []Filter{{Field: "status", Operator: EqOperator, Values: []string{"active", "pending"}}}, ""},
+		{"price_gte=10&price_lte=20", []Filter{
+			{Field: "price", Operator: GteOperator, Values: []string{"10"}},
+			{Field: "price", Operator: LteOperator, Values: []string{"20"}},
+		}, ""},
+		{"status_ne=draft", []Filter{{Field: "status", Operator: NeOperator, Values: []string{"draft"}}}, ""},
+		{"status_in=active,pending&status_in=late", []Filter{{Field: "status", Operator: InOperator, Values: []string{"active", "pending", "late"}}}, ""},
+		{"address.city=Paris", []Filter{{Field: "address.city", Operator: EqOperator, Values: []string{"Paris"}}}, ""},
+		{"_in=x", []Filter{}, ""},
+		{"created_in_ne=x", []Filter{{Field: "created_in", Operator: NeOperator, Values: []string{"x"}}}, ""},
+		{"price_gte=1&price_gte=2", nil, "price_gte: expected a single value"},
+		{"name_like=(", nil, "name_like: invalid pattern: error parsing regexp: missing closing ): `(?i)(`"},
+	} {
+		t.Run(test.query, func(t *testing.T) {
+			values, _ := url.ParseQuery(test.query)
+			got, err := ParseFilters(values)
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Fatalf("got error %v, want %s", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := range got {
+				got[i].patterns = nil
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestFilterMatch(t *testing.T) {
+	record := map[string]any{
+		"name":    "Ada Lovelace",
+		"age":     36.0,
+		"active":  true,
+		"manager": nil,
+		"tags":    []any{"math", "poetry"},
+		"address": map[string]any{"city": "London"},
+		"jobs":    []any{map[string]any{"title": "analyst"}, map[string]any{"title": "writer"}},
+	}
+
+	for _, test := range []struct {
+		query string
+		want  bool
+	}{
+		{"name=Ada Lovelace", true},
+		{"name=Ada", false},
+		{"age=36", true},
+		{"age=36.0", true},
+		{"age=abc", false},
+		{"active=true", true},
+		{"active=1", true},
+		{"active=false", false},
+		{"manager=null", true},
+		{"missing=null", false},
+		{"age_gte=36", true},
+		{"age_gte=37", false},
+		{"age_lte=36", true},
+		{"age_lte=9", false},
+		{"age_gte=x", false},
+		{"name_gte=Ada", true},
+		{"name_lte=Ada", false},
+		{"name_ne=Grace", true},
+		{"name_ne=Ada Lovelace", false},
+		{"missing_ne=x", true},
+		{"name_like=^ada", true},
+		{"name_like=grace&name_like=love", true},
+		{"name_like=^love", false},
+		{"age_in=12,36", true},
+		{"age_in=12,13", false},
+		{"tags=poetry", true},
+		{"tags_ne=poetry", false},
+		{"address.city=London", true},
+		{"address.city=Paris", false},
+		{"jobs.title=writer", true},
+		{"jobs.title_like=^ana", true},
+		{"name=Ada Lovelace&age_gte=40", false},
+	} {
+		t.Run(test.query, func(t *testing.T) {
+			values, _ := url.ParseQuery(test.query)
+			filters, err := ParseFilters(values)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := MatchFilters(filters, record); got != test.want {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestFilterValidator(t *testing.T) {
+	db := NewMemDB()
+	for i := 1; i <= 5; i++ {
+		mustSet(t, db, "users", fmt.Sprint(i), record(i, "age", float64(i*10)))
+	}
+
+	filters, err := ParseFilters(url.Values{"age_gte": {"20"}, "age_lte": {"40"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := db.GetAll("users", FilterValidator(filters))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := ids(t, res); !reflect.DeepEqual(got, []string{"2", "3", "4"}) {
+		t.Errorf("got %v, want [2 3 4]", got)
+	}
+	if count, err := CountRecords(db, "users", filters); err != nil || count != 3 {
+		t.Errorf("CountRecords: got %d, %v, want 3", count, err)
+	}
+}
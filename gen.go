@@ -1,64 +1,358 @@
 package main
 
 import (
+	cryptorand "crypto/rand"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
+	"hash/fnv"
 	"log"
+	"math"
 	"math/rand"
+	"regexp/syntax"
+	"slices"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/go-faker/faker/v4"
 )
 
+// Ids of the records that can be referenced, by entity name
+type References map[string][]any
+
+// Source of randomness and references used to generate the records of an entity.
+// A generator must only be used by one goroutine at a time.
+type Generator struct {
+	src  rand.Source
+	rand *rand.Rand
+	refs References
+	now  time.Time
+
+	seeded bool
+	lastID int64 // milliseconds of the last time-ordered id
+
+	entity    string // entity whose records are generated, see generateEntity
+	generated []any  // ids of the records generated so far, its own refs can point to them
+}
+
+// Upper bound of dates without a `to` option when the data is seeded, so the dates don't depend on the day
+var seededNow = time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// Faker only has global random sources, they are swapped for the generator's source on every call
+var (
+	fakerMu     sync.Mutex
+	fakerSource = faker.NewSafeSource(rand.NewSource(time.Now().UnixNano()))
+)
+
+// Returns a generator for an entity.
+// With a non-zero seed the generator always produces the same values, otherwise it's randomly seeded.
+func NewGenerator(seed int64, entityName string, refs References) *Generator {
+	now, seeded := seededNow, true
+	if seed == 0 {
+		seeded = false
+		seed = rand.Int63()
+		now = time.Now().UTC()
+	}
+
+	// Every entity gets its own sequence so entities can be generated concurrently
+	h := fnv.New64a()
+	binary.Write(h, binary.LittleEndian, seed)
+	h.Write([]byte(entityName))
+
+	src := rand.NewSource(int64(h.Sum64()))
+	return &Generator{src: src, rand: rand.New(src), refs: refs, now: now, seeded: seeded}
+}
+
+// Calls faker with the generator's random source
+func (g *Generator) fake(fn func() any) any {
+	fakerMu.Lock()
+	defer fakerMu.Unlock()
+	faker.SetRandomSource(g.src)
+	faker.SetCryptoSource(g.rand)
+	defer faker.SetRandomSource(fakerSource)
+	defer faker.SetCryptoSource(cryptorand.Reader)
+	return fn()
+}
+
 // Returns a fake value for a given field
-func GetFake(f Field) (any, error) {
+func GetFake(f Field, g *Generator) (any, error) {
+	if p := nullProbability(f); p > 0 && g.rand.Float64() < p {
+		return nil, nil
+	}
+	if enum, ok := f.Options["enum"].([]any); ok {
+		return g.pickEnum(enum, f.Options["weights"]), nil
+	}
+
 	switch f.Kind {
 	case StringType:
-		return faker.Name(), nil
+		return g.getString(f), nil
 	case NumberType:
-		val, _ := faker.RandomInt(0, 100)
-		return val, nil
+		return g.getNumber(f), nil
 	case BooleanType:
-		if rand.Intn(10) >= 5 {
+		if g.rand.Intn(10) >= 5 {
 			return true, nil
 		} else {
 			return false, nil
 		}
 	case NameType:
-		return faker.Name(), nil
+		return g.name(), nil
 	case UsernameType:
-		return faker.Username(), nil
+		return g.fake(func() any { return faker.Username() }), nil
 	case FullnameType:
-		return faker.FirstName() + " " + faker.LastName(), nil
+		return g.fake(func() any { return faker.FirstName() + " " + faker.LastName() }), nil
 	case EmailType:
-		return faker.Email(), nil
+		return g.fake(func() any { return faker.Email() }), nil
 	case DateType:
-		return faker.Date(), nil
+		return g.getDate(f)
 	case UrlType:
-		return faker.URL(), nil
+		return g.fake(func() any { return faker.URL() }), nil
 	case IpType:
-		return faker.IPv4(), nil
+		return g.fake(func() any { return faker.IPv4() }), nil
 	case UuidType:
-		return faker.UUIDHyphenated(), nil
+		return g.fake(func() any { return faker.UUIDHyphenated() }), nil
 	case IdType:
-		return faker.UUIDDigit(), nil
+		return g.fake(func() any { return faker.UUIDDigit() }), nil
 	case AddressType:
-		return faker.GetAddress(), nil
+		return g.fake(func() any { return faker.GetRealAddress() }), nil
 	case PhoneType:
-		return faker.Phonenumber(), nil
+		return g.fake(func() any { return faker.Phonenumber() }), nil
 	case ParagraphType:
-		return faker.Paragraph(), nil
+		return g.fitLength(f, g.fake(func() any { return faker.Paragraph() }).(string)), nil
+	case RefType:
+		return g.getRef(f)
+	case ObjectType:
+		return GenerateFakeData(f.Schema, g)
+	case ArrayType:
+		items := make([]any, g.itemCount(f))
+		for i := range items {
+			item, err := GetFake(*f.Items, g)
+			if err != nil {
+				return nil, err
+			}
+			items[i] = item
+		}
+		return items, nil
 	default:
 		s := fmt.Sprintf("Unknown Field Type : %s", f.Kind)
 		return nil, fmt.Errorf(s)
 	}
 }
 
+// Picks a value of the enum, weights are relative and default to 1 for every value
+func (g *Generator) pickEnum(enum []any, weights any) any {
+	w, ok := weights.([]any)
+	if !ok {
+		return enum[g.rand.Intn(len(enum))]
+	}
+
+	total := 0.0
+	for _, v := range w {
+		total += v.(float64)
+	}
+	r := g.rand.Float64() * total
+	for i, v := range w {
+		r -= v.(float64)
+		if r < 0 {
+			return enum[i]
+		}
+	}
+	return enum[len(enum)-1]
+}
+
+// Returns a number between `min` and `max` (0 and 100 by default), rounded to `precision` decimals
+func (g *Generator) getNumber(f Field) any {
+	min, max := optionFloat(f, "min", 0), optionFloat(f, "max", 100)
+	precision := optionInt(f, "precision", 0)
+
+	if precision == 0 {
+		lo, hi := int(math.Ceil(min)), int(math.Floor(max))
+		if hi < lo {
+			return lo
+		}
+		return lo + g.rand.Intn(hi-lo+1)
+	}
+
+	scale := math.Pow(10, float64(precision))
+	return math.Round((min+g.rand.Float64()*(max-min))*scale) / scale
+}
+
+// Returns a string matching the `regex` option if any, a name otherwise
+func (g *Generator) getString(f Field) string {
+	if pattern, ok := f.Options["regex"].(string); ok {
+		re, _ := syntax.Parse(pattern, syntax.Perl)
+		var sb strings.Builder
+		g.writeRegex(&sb, re.Simplify())
+		return sb.String()
+	}
+	if f.Options["minLength"] != nil || f.Options["maxLength"] != nil {
+		return g.fitLength(f, g.fake(func() any { return faker.Sentence() }).(string))
+	}
+	return g.name()
+}
+
+// Same as faker.Name, which picks the gender once per process and would ignore the seed
+func (g *Generator) name() string {
+	if g.rand.Intn(2) == 0 {
+		return g.fake(func() any { return faker.TitleFemale() + " " + faker.FirstNameFemale() + " " + faker.LastName() }).(string)
+	}
+	return g.fake(func() any { return faker.TitleMale() + " " + faker.FirstNameMale() + " " + faker.LastName() }).(string)
+}
+
+// Extends or cuts a text so its length is between `minLength` and `maxLength`
+func (g *Generator) fitLength(f Field, text string) string {
+	if f.Options["minLength"] == nil && f.Options["maxLength"] == nil {
+		return text
+	}
+	minLength := optionInt(f, "minLength", 0)
+	maxLength := optionInt(f, "maxLength", max(minLength, len(text)))
+
+	length := minLength
+	if maxLength > minLength {
+		length += g.rand.Intn(maxLength - minLength + 1)
+	}
+	for len(text) < length {
+		text += " " + g.fake(func() any { return faker.Sentence() }).(string)
+	}
+	text = strings.TrimRight(text[:length], " ")
+	for len(text) < minLength {
+		text += "."
+	}
+	return text
+}
+
+// Writes a random string matching a simplified regular expression
+func (g *Generator) writeRegex(sb *strings.Builder, re *syntax.Regexp) {
+	const maxRepeat = 5
+
+	switch re.Op {
+	case syntax.OpLiteral:
+		sb.WriteString(string(re.Rune))
+	case syntax.OpCharClass:
+		sb.WriteRune(g.pickRune(re.Rune))
+	case syntax.OpAnyChar, syntax.OpAnyCharNotNL:
+		sb.WriteRune(rune(' ' + g.rand.Intn('~'-' '+1)))
+	case syntax.OpCapture:
+		g.writeRegex(sb, re.Sub[0])
+	case syntax.OpConcat:
+		for _, sub := range re.Sub {
+			g.writeRegex(sb, sub)
+		}
+	case syntax.OpAlternate:
+		g.writeRegex(sb, re.Sub[g.rand.Intn(len(re.Sub))])
+	case syntax.OpQuest, syntax.OpStar, syntax.OpPlus, syntax.OpRepeat:
+		min, max := re.Min, re.Max
+		switch re.Op {
+		case syntax.OpQuest:
+			min, max = 0, 1
+		case syntax.OpStar:
+			min, max = 0, maxRepeat
+		case syntax.OpPlus:
+			min, max = 1, maxRepeat
+		}
+		if max == -1 {
+			max = min + maxRepeat
+		}
+		for n := min + g.rand.Intn(max-min+1); n > 0; n-- {
+			g.writeRegex(sb, re.Sub[0])
+		}
+	}
+}
+
+// Picks a rune from the ranges of a character class, printable ascii is preferred when possible
+func (g *Generator) pickRune(ranges []rune) rune {
+	printable := make([]rune, 0, len(ranges))
+	for i := 0; i < len(ranges); i += 2 {
+		lo, hi := max(ranges[i], ' '), min(ranges[i+1], '~')
+		if lo <= hi {
+			printable = append(printable, lo, hi)
+		}
+	}
+	if len(printable) != 0 {
+		ranges = printable
+	}
+
+	total := 0
+	for i := 0; i < len(ranges); i += 2 {
+		total += int(ranges[i+1]-ranges[i]) + 1
+	}
+	n := g.rand.Intn(total)
+	for i := 0; i < len(ranges); i += 2 {
+		size := int(ranges[i+1]-ranges[i]) + 1
+		if n < size {
+			return ranges[i] + rune(n)
+		}
+		n -= size
+	}
+	return ranges[0]
+}
+
+// Returns a date between `from` and `to` in the field's `format`
+func (g *Generator) getDate(f Field) (any, error) {
+	from, to, err := dateRange(f)
+	if err != nil {
+		return nil, err
+	}
+	if f.Options["to"] == nil {
+		to = g.now
+	}
+
+	t := from
+	if span := to.Unix() - from.Unix(); span > 0 {
+		t = from.Add(time.Duration(g.rand.Int63n(span)) * time.Second)
+	}
+
+	layout := dateLayout(f)
+	if layout == "" {
+		return t.Unix(), nil
+	}
+	return t.Format(layout), nil
+}
+
+// Picks existing ids of the referenced entity.
+// With the `many` option, returns a list of distinct ids between `minItems` and `maxItems` long.
+func (g *Generator) getRef(f Field) (any, error) {
+	ids := g.refs[refEntity(f)]
+	self := g.entity != "" && refEntity(f) == g.entity
+	if self {
+		ids = append(slices.Clip(ids), g.generated...)
+	}
+
+	if many, _ := f.Options["many"].(bool); many {
+		n := min(g.itemCount(f), len(ids))
+
+		picked := make([]any, 0, n)
+		for _, i := range g.rand.Perm(len(ids))[:n] {
+			picked = append(picked, ids[i])
+		}
+		return picked, nil
+	}
+
+	if len(ids) == 0 {
+		// Self references are optional (see DependencyLevels)
+		if self {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("%s: no %s to reference", f.Name, refEntity(f))
+	}
+	return ids[g.rand.Intn(len(ids))], nil
+}
+
+// Returns a random length between `minItems` and `maxItems` (1 to 3 by default)
+func (g *Generator) itemCount(f Field) int {
+	minItems := optionInt(f, "minItems", 1)
+	maxItems := optionInt(f, "maxItems", max(minItems, 3))
+	if maxItems <= minItems {
+		return minItems
+	}
+	return minItems + g.rand.Intn(maxItems-minItems+1)
+}
+
 // Generates fake data for a given schema
-func GenerateFakeData(schema []Field) (map[string]any, error) {
+func GenerateFakeData(schema []Field, g *Generator) (map[string]any, error) {
 	data := make(map[string]any)
 	for _, f := range schema {
-		val, err := GetFake(f)
+		val, err := GetFake(f, g)
 		if err != nil {
 			return nil, err
 		}
@@ -67,40 +361,183 @@ func GenerateFakeData(schema []Field) (map[string]any, error) {
 	return data, nil
 }
 
+// Generates records for the entities in dependency order, so every ref points to an existing record.
+// counts is the number of records to generate by entity name.
+// refs holds the ids of the records that already exist, the generated ids are added to it.
+// Entities that don't depend on each other are generated concurrently, so emit must be safe for concurrent use.
+// Each entity has its own generator seeded from the entity's seed, so seeded entities always produce the same records.
+func GenerateEntities(entities []Entity, counts map[string]int, refs References, emit func(e Entity, id string, record map[string]any) error) error {
+	levels, err := DependencyLevels(entities)
+	if err != nil {
+		return err
+	}
+
+	for _, level := range levels {
+		w := sync.WaitGroup{}
+		ids := make([][]any, len(level))
+		errs := make([]error, len(level))
+		for i, e := range level {
+			w.Add(1)
+			log.Println("Generating fake data for entity:", e.Name)
+			go func(i int, e Entity, w *sync.WaitGroup) {
+				defer w.Done()
+				g := NewGenerator(e.Seed, e.Name, refs)
+				ids[i], errs[i] = generateEntity(e, counts[e.Name], g, emit)
+			}(i, e, &w)
+		}
+		w.Wait()
+
+		for i, e := range level {
+			if errs[i] != nil {
+				return errs[i]
+			}
+			refs[e.Name] = append(refs[e.Name], ids[i]...)
+		}
+	}
+	return nil
+}
+
+// How many times a record is generated again when one of its unique values is already taken
+const maxUniqueRetries = 10
+
+// Generates count records for an entity and returns their ids.
+// Records are generated again until their natural key and unique fields are free.
+// Autoincrement ids follow the greatest id of the records that already exist.
+func generateEntity(e Entity, count int, g *Generator, emit func(Entity, string, map[string]any) error) ([]any, error) {
+	unique := make(map[string]map[string]bool)
+	for _, f := range e.Schema {
+		if isUnique(f) || f.Name == e.NaturalKey() {
+			unique[f.Name] = make(map[string]bool)
+		}
+	}
+	if key := e.NaturalKey(); key != "" {
+		for _, id := range g.refs[e.Name] {
+			unique[key][FormatID(id)] = true
+		}
+	}
+	taken := func(m map[string]any) string {
+		for name, values := range unique {
+			if m[name] != nil && values[FormatID(m[name])] {
+				return name
+			}
+		}
+		return ""
+	}
+	next := maxIntID(g.refs[e.Name]) + 1
+	g.entity = e.Name
+
+	ids := make([]any, 0, count)
+	for i := 0; i < count; i++ {
+		m, err := GenerateFakeData(e.Schema, g)
+		if err != nil {
+			return nil, err
+		}
+		for retry := 0; taken(m) != ""; retry++ {
+			if retry == maxUniqueRetries {
+				return nil, fmt.Errorf("%s: couldn't generate a unique %s after %d tries", e.Name, taken(m), maxUniqueRetries)
+			}
+			if m, err = GenerateFakeData(e.Schema, g); err != nil {
+				return nil, err
+			}
+		}
+		for name, values := range unique {
+			if m[name] != nil {
+				values[FormatID(m[name])] = true
+			}
+		}
+
+		if key := e.NaturalKey(); key != "" {
+			m["id"] = m[key]
+		} else if m["id"] == nil && e.IDStrategy == AutoIncrementStrategy {
+			m["id"] = next
+			next++
+		} else if m["id"] == nil {
+			m["id"] = g.randomID(e.IDStrategy)
+		}
+		id := FormatID(m["id"])
+
+		err = emit(e, id, m)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, m["id"])
+		g.generated = append(g.generated, m["id"])
+	}
+	return ids, nil
+}
+
 // Fills the database with fake data
-func FillDatabase(entities []Entity, s Store) {
-	w := sync.WaitGroup{}
+func FillDatabase(entities []Entity, s Store) error {
+	counts := make(map[string]int, len(entities))
+	for _, e := range entities {
+		counts[e.Name] = e.Count
+	}
+
+	err := GenerateEntities(entities, counts, make(References), storeRecord(s))
+	if err != nil {
+		return err
+	}
+	log.Println("Done!")
+	return nil
+}
+
+// Fills the database with records from a dataset.
+// Records without an id get one from the entity's id strategy, autoincrement ids follow the greatest id of the dataset.
+// If topUp is set, each entity is completed with fake data up to its count.
+func IngestData(entities []Entity, data Dataset, s Store, topUp bool) error {
+	refs := make(References)
+	counts := make(map[string]int, len(entities))
 	for _, e := range entities {
-		w.Add(1)
-		log.Println("Generating fake data for entity:", e.Name)
-		go func(e Entity, w *sync.WaitGroup) {
-			for i := 0; i < e.Count; i++ {
-				m, err := GenerateFakeData(e.Schema)
-				if err != nil {
-					log.Println(err)
-					return
-				}
-
-				if m["id"] == nil {
-					m["id"] = faker.UUIDDigit()
-				}
-				id := m["id"].(string)
-
-				b, err := json.Marshal(m)
-				if err != nil {
-					fmt.Println(err)
-					return
-				}
-
-				err = s.Set(e.Name, []byte(id), b)
-				if err != nil {
-					log.Println(err)
-					return
-				}
+		log.Println("Ingesting data for entity:", e.Name)
+		// Not the entity's own generator, the top up would generate the same ids
+		g := NewGenerator(e.Seed, e.Name+"/ingest", nil)
+		ids := make([]any, 0, len(data[e.Name]))
+		for _, m := range data[e.Name] {
+			if key := e.NaturalKey(); key != "" && m[key] != nil {
+				m["id"] = m[key]
+			}
+			if m["id"] != nil {
+				ids = append(ids, m["id"])
 			}
-			w.Done()
-		}(e, &w)
+		}
+		next := maxIntID(ids) + 1
+		for _, m := range data[e.Name] {
+			if m["id"] == nil && e.IDStrategy == AutoIncrementStrategy {
+				m["id"] = next
+				next++
+			} else if m["id"] == nil {
+				m["id"] = g.randomID(e.IDStrategy)
+			}
+			id := FormatID(m["id"])
+
+			err := storeRecord(s)(e, id, m)
+			if err != nil {
+				return err
+			}
+			refs[e.Name] = append(refs[e.Name], m["id"])
+		}
+
+		if topUp && len(data[e.Name]) < e.Count {
+			counts[e.Name] = e.Count - len(data[e.Name])
+		}
+	}
+
+	if topUp {
+		err := GenerateEntities(entities, counts, refs, storeRecord(s))
+		if err != nil {
+			return err
+		}
 	}
-	w.Wait()
 	log.Println("Done!")
+	return nil
+}
+
+func storeRecord(s Store) func(Entity, string, map[string]any) error {
+	return func(e Entity, id string, m map[string]any) error {
+		b, err := json.Marshal(m)
+		if err != nil {
+			return err
+		}
+		return s.Set(e.Name, []byte(id), b)
+	}
 }
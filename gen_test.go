@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Every field type, with the options that draw more random values
+const seededSchema = `{"entities": [
+	{"name": "users", "count": 8, "schema": [
+		{"name": "name", "type": "name"},
+		{"name": "username", "type": "username"},
+		{"name": "fullname", "type": "fullname"},
+		{"name": "email", "type": "email", "options": {"unique": true}},
+		{"name": "code", "type": "string", "options": {"regex": "[A-Z]{3}-[0-9]{4}"}},
+		{"name": "bio", "type": "paragraph", "options": {"maxLength": 80}},
+		{"name": "age", "type": "number", "options": {"min": 18, "max": 90, "nullable": 0.2}},
+		{"name": "active", "type": "bool"},
+		{"name": "joined", "type": "date", "options": {"format": "2006-01-02"}},
+		{"name": "site", "type": "url"},
+		{"name": "ip", "type": "ip"},
+		{"name": "uuid", "type": "uuid"},
+		{"name": "ref", "type": "id"},
+		{"name": "address", "type": "address"},
+		{"name": "phone", "type": "phone"},
+		{"name": "role", "type": "string", "options": {"enum": ["admin", "user"], "weights": [1, 4]}},
+		{"name": "settings", "type": "object", "schema": [{"name": "theme", "type": "string", "options": {"enum": ["dark", "light"]}}]},
+		{"name": "tags", "type": "string[]", "options": {"minItems": 0, "maxItems": 4}}
+	]},
+	{"name": "posts", "count": 12, "idStrategy": "ulid", "schema": [
+		{"name": "title", "type": "string"},
+		{"name": "author", "type": "ref", "options": {"entity": "users"}},
+		{"name": "readers", "type": "ref", "options": {"entity": "users", "many": true}},
+		{"name": "replyTo", "type": "ref", "options": {"entity": "posts", "nullable": true}}
+	]},
+	{"name": "tags", "count": 5, "idStrategy": "autoincrement", "schema": [{"name": "label", "type": "string"}]}
+]}`
+
+// Generates the data of the schema with a seed and returns its dump, like `serveur --seed` then --out-dump
+func generateDump(t *testing.T, schemaPath string, seed int64) []byte {
+	t.Helper()
+	entities, err := ParseFile(schemaPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seed != 0 {
+		SetSeed(entities, seed)
+	}
+	db := NewMemDB()
+	if err := FillDatabase(entities, db); err != nil {
+		t.Fatal(err)
+	}
+	dump := filepath.Join(t.TempDir(), "dump.json")
+	if err := WriteDump(dump, db, entities); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(dump)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestSeedDeterminism(t *testing.T) {
+	schemaPath := filepath.Join(t.TempDir(), "schema.json")
+	if err := os.WriteFile(schemaPath, []byte(seededSchema), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	first := generateDump(t, schemaPath, 42)
+	for run := 0; run < 3; run++ {
+		if got := generateDump(t, schemaPath, 42); !bytes.Equal(got, first) {
+			t.Fatalf("run %d generated different data with the same seed:\n%s\nwant:\n%s", run, got, first)
+		}
+	}
+	if bytes.Equal(generateDump(t, schemaPath, 43), first) {
+		t.Error("another seed generated the same data")
+	}
+	// Without a seed the data is random
+	if bytes.Equal(generateDump(t, schemaPath, 0), generateDump(t, schemaPath, 0)) {
+		t.Error("unseeded runs generated the same data")
+	}
+}
+
+// Records referencing their own entity point to the records generated before them
+func TestGenerateSelfReferences(t *testing.T) {
+	employees := Entity{
+		Name:       "employees",
+		Seed:       7,
+		IDStrategy: AutoIncrementStrategy,
+		Schema: []Field{
+			{Name: "manager", Kind: RefType, Options: map[string]any{"entity": "employees", "nullable": 0.2}},
+			{Name: "mentors", Kind: RefType, Options: map[string]any{"entity": "employees", "many": true}},
+		},
+	}
+
+	generated := make([]map[string]any, 0)
+	err := GenerateEntities([]Entity{employees}, map[string]int{"employees": 20}, make(References), func(e Entity, id string, record map[string]any) error {
+		generated = append(generated, record)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(generated) != 20 {
+		t.Fatalf("got %d records, want 20", len(generated))
+	}
+
+	managed := 0
+	for i, record := range generated {
+		id := record["id"].(int64)
+		if manager, ok := record["manager"].(int64); ok {
+			managed++
+			if manager >= id {
+				t.Errorf("record %d references %d, which isn't generated yet", id, manager)
+			}
+		} else if record["manager"] != nil {
+			t.Errorf("record %d: unexpected manager %v", id, record["manager"])
+		}
+		mentors := record["mentors"].([]any)
+		if i == 0 && len(mentors) != 0 {
+			t.Errorf("the first record references %v", mentors)
+		}
+		for _, mentor := range mentors {
+			if mentor.(int64) >= id {
+				t.Errorf("record %d references %d, which isn't generated yet", id, mentor)
+			}
+		}
+	}
+	if generated[0]["manager"] != nil {
+		t.Errorf("the first record references %v", generated[0]["manager"])
+	}
+	if managed == 0 {
+		t.Error("no record references another one")
+	}
+}
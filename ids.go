@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How the ids of an entity's records are minted, any other value is the name of a field used as natural key
+type IDStrategy string
+
+const (
+	UUIDStrategy          IDStrategy = "uuid"          // random RFC 9562 v4 uuid
+	UUIDv7Strategy        IDStrategy = "uuidv7"        // time-ordered RFC 9562 v7 uuid
+	ULIDStrategy          IDStrategy = "ulid"          // time-ordered 26 characters id
+	NanoIDStrategy        IDStrategy = "nanoid"        // 21 url-safe characters
+	AutoIncrementStrategy IDStrategy = "autoincrement" // 1, 2, 3... the counter is kept in the store
+)
+
+var idStrategies = []IDStrategy{UUIDStrategy, UUIDv7Strategy, ULIDStrategy, NanoIDStrategy, AutoIncrementStrategy}
+
+// Field types that can be used as natural key
+var naturalKeyTypes = []FieldType{StringType, NumberType, NameType, UsernameType, FullnameType, EmailType, UrlType, IpType, UuidType, IdType, PhoneType}
+
+const (
+	nanoIDAlphabet = "_-0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	ulidAlphabet   = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+)
+
+// Checks the id strategy of an entity, a natural key must be a required scalar field
+func validateIDStrategy(e Entity) error {
+	if e.IDStrategy == "" || slices.Contains(idStrategies, e.IDStrategy) {
+		return nil
+	}
+	i := slices.IndexFunc(e.Schema, func(f Field) bool { return f.Name == string(e.IDStrategy) })
+	if i == -1 {
+		return fmt.Errorf("%s: unknown id strategy %q, it's neither a strategy nor a field", e.Name, e.IDStrategy)
+	}
+	if f := e.Schema[i]; !slices.Contains(naturalKeyTypes, f.Kind) || isNullable(f) {
+		return fmt.Errorf("%s: the natural key %q must be a non nullable string or number", e.Name, f.Name)
+	}
+	return nil
+}
+
+// Returns the field used as natural key, or an empty string if the ids are minted
+func (e Entity) NaturalKey() string {
+	if e.IDStrategy == "" || slices.Contains(idStrategies, e.IDStrategy) {
+		return ""
+	}
+	return string(e.IDStrategy)
+}
+
+// Returns a violation if a replaced or patched record changes its natural key, which is also its id
+func naturalKeyViolations(e Entity, record map[string]any) []Violation {
+	key := e.NaturalKey()
+	if key == "" || FormatID(record[key]) == FormatID(record["id"]) {
+		return nil
+	}
+	return []Violation{{Entity: e.Name, Path: key, Reason: "the natural key can't be changed"}}
+}
+
+// Mints an id with a random strategy, autoincrement and natural keys are handled by the callers
+func (g *Generator) randomID(strategy IDStrategy) string {
+	switch strategy {
+	case UUIDv7Strategy:
+		b := make([]byte, 16)
+		g.rand.Read(b)
+		binary.BigEndian.PutUint64(b[:8], uint64(g.idTime())<<16|binary.BigEndian.Uint64(b[:8])&0xffff)
+		return formatUUID(b, 7)
+	case ULIDStrategy:
+		var sb strings.Builder
+		ms := g.idTime()
+		for i := 9; i >= 0; i-- {
+			sb.WriteByte(ulidAlphabet[(ms>>(5*i))&31])
+		}
+		for i := 0; i < 16; i++ {
+			sb.WriteByte(ulidAlphabet[g.rand.Intn(32)])
+		}
+		return sb.String()
+	case NanoIDStrategy:
+		b := make([]byte, 21)
+		for i := range b {
+			b[i] = nanoIDAlphabet[g.rand.Intn(len(nanoIDAlphabet))]
+		}
+		return string(b)
+	}
+	b := make([]byte, 16)
+	g.rand.Read(b)
+	return formatUUID(b, 4)
+}
+
+// Milliseconds of time-ordered ids, they always increase even within the same millisecond.
+// Seeded generators count from their fixed now so the ids don't depend on the time.
+func (g *Generator) idTime() int64 {
+	now := time.Now()
+	if g.seeded {
+		now = g.now
+	}
+	g.lastID = max(now.UnixMilli(), g.lastID+1)
+	return g.lastID
+}
+
+func formatUUID(b []byte, version byte) string {
+	b[6] = b[6]&0x0f | version<<4
+	b[8] = b[8]&0x3f | 0x80
+	s := hex.EncodeToString(b)
+	return s[:8] + "-" + s[8:12] + "-" + s[12:16] + "-" + s[16:20] + "-" + s[20:]
+}
+
+// Ids of records created through the API don't need to be reproducible
+var (
+	apiIDsMu sync.Mutex
+	apiIDs   = NewGenerator(0, "", nil)
+)
+
+// Returns a random id for records created outside of data generation
+func RandomID(strategy IDStrategy) string {
+	apiIDsMu.Lock()
+	defer apiIDsMu.Unlock()
+	return apiIDs.randomID(strategy)
+}
+
+// Returns an id as a string, integers decoded from JSON are written without exponent
+func FormatID(id any) string {
+	if f, ok := id.(float64); ok && f == math.Trunc(f) && math.Abs(f) < 1<<53 {
+		return strconv.FormatInt(int64(f), 10)
+	}
+	return fmt.Sprint(id)
+}
+
+// Returns the greatest integer id, or 0 if there are none
+func maxIntID(ids []any) int64 {
+	var n int64
+	for _, id := range ids {
+		if v, ok := intID(FormatID(id)); ok {
+			n = max(n, v)
+		}
+	}
+	return n
+}
+
+// Reads an id written as an integer
+func intID(id string) (int64, bool) {
+	n, err := strconv.ParseInt(id, 10, 64)
+	return n, err == nil && strconv.FormatInt(n, 10) == id
+}
+
+// Encodes an id into a store key.
+// Integer ids are encoded in fixed width big endian so the records are kept in numeric order,
+// before the other ids which are stored as they are.
+func EncodeKey(id string) []byte {
+	n, ok := intID(id)
+	if !ok {
+		return []byte(id)
+	}
+	key := make([]byte, 9)
+	binary.BigEndian.PutUint64(key[1:], uint64(n)^(1<<63))
+	return key
+}
+
+// Decodes a store key into an id
+func DecodeKey(key []byte) string {
+	if len(key) == 9 && key[0] == 0 {
+		return strconv.FormatInt(int64(binary.BigEndian.Uint64(key[1:])^(1<<63)), 10)
+	}
+	return string(key)
+}
+
+// Last possible integer key, used to find the greatest integer id
+var maxIntKey = EncodeKey(strconv.FormatInt(math.MaxInt64, 10))
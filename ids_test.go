@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"math"
+	"slices"
+	"strconv"
+	"testing"
+)
+
+func TestEncodeKey(t *testing.T) {
+	// Integer ids in numeric order, then the other ids as strings
+	sorted := []string{
+		strconv.FormatInt(math.MinInt64, 10), "-10", "-9", "-1", "0", "1", "2", "9", "10", "11", "100", "255", "256",
+		strconv.FormatInt(math.MaxInt64, 10),
+		"+1", "-0", "007", "1.5", "10a", "9223372036854775808", "a", "abc", "b",
+	}
+
+	keys := make([][]byte, 0, len(sorted))
+	for _, id := range sorted {
+		key := EncodeKey(id)
+		if got := DecodeKey(key); got != id {
+			t.Errorf("DecodeKey(EncodeKey(%q)) = %q", id, got)
+		}
+		keys = append(keys, key)
+	}
+
+	reversed := slices.Clone(keys)
+	slices.Reverse(reversed)
+	slices.SortFunc(reversed, bytes.Compare)
+	got := make([]string, 0, len(reversed))
+	for _, key := range reversed {
+		got = append(got, DecodeKey(key))
+	}
+	if !slices.Equal(got, sorted) {
+		t.Errorf("keys sorted as %q, want %q", got, sorted)
+	}
+
+	if bytes.Compare(EncodeKey(strconv.FormatInt(math.MaxInt64, 10)), maxIntKey) != 0 {
+		t.Error("maxIntKey isn't the key of the greatest integer")
+	}
+}
+
+func TestFormatID(t *testing.T) {
+	for _, test := range []struct {
+		id   any
+		want string
+	}{
+		{1.0, "1"},
+		{-3.0, "-3"},
+		{1e15, "1000000000000000"},
+		{1.5, "1.5"},
+		{1e300, "1e+300"},
+		{"abc", "abc"},
+		{"007", "007"},
+	} {
+		if got := FormatID(test.id); got != test.want {
+			t.Errorf("FormatID(%v) = %q, want %q", test.id, got, test.want)
+		}
+	}
+}
+
+func TestValidateIDStrategy(t *testing.T) {
+	schema := []Field{
+		{Name: "email", Kind: EmailType},
+		{Name: "nickname", Kind: StringType, Options: map[string]any{"nullable": true}},
+		{Name: "address", Kind: AddressType},
+	}
+	for _, test := range []struct {
+		strategy IDStrategy
+		err      string
+	}{
+		{"", ""},
+		{UUIDStrategy, ""},
+		{AutoIncrementStrategy, ""},
+		{"email", ""},
+		{"sku", `users: unknown id strategy "sku", it's neither a strategy nor a field`},
+		{"nickname", `users: the natural key "nickname" must be a non nullable string or number`},
+		{"address", `users: the natural key "address" must be a non nullable string or number`},
+	} {
+		t.Run(string(test.strategy), func(t *testing.T) {
+			err := validateIDStrategy(Entity{Name: "users", IDStrategy: test.strategy, Schema: schema})
+			if test.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || err.Error() != test.err {
+				t.Errorf("got error %v, want %s", err, test.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+
+	badger "github.com/dgraph-io/badger/v4"
+)
+
+// Returned by stores when a write would duplicate the value of a unique field
+var ErrConflict = errors.New("unique constraint violated")
+
+// Field types that can't be indexed, they hold several values
+var noIndex = []FieldType{AddressType, ObjectType, ArrayType}
+
+func isIndexed(f Field) bool {
+	indexed, _ := f.Options["indexed"].(bool)
+	return indexed || isUnique(f)
+}
+
+// Unique fields are indexed, null values aren't considered duplicates
+func isUnique(f Field) bool {
+	unique, _ := f.Options["unique"].(bool)
+	return unique
+}
+
+// Checks that only top-level fields holding a single value are indexed
+func validateIndexes(e Entity) error {
+	return walkFields(e.Schema, "", func(f Field, path string) error {
+		if !isIndexed(f) {
+			return nil
+		}
+		if path != f.Name {
+			return fmt.Errorf("%s.%s: only top-level fields can be indexed", e.Name, path)
+		}
+		if many, _ := f.Options["many"].(bool); many || slices.Contains(noIndex, f.Kind) {
+			return fmt.Errorf("%s.%s: %s fields can't be indexed", e.Name, path, f.Kind)
+		}
+		return nil
+	})
+}
+
+// Returns the indexed fields of every entity
+func indexedFields(entities []Entity) map[string][]Field {
+	indexes := make(map[string][]Field)
+	for _, e := range entities {
+		for _, f := range e.Schema {
+			if isIndexed(f) {
+				indexes[e.Name] = append(indexes[e.Name], f)
+			}
+		}
+	}
+	return indexes
+}
+
+// Index entries are keyed by the entity, the field, the encoded value and the record key,
+// their value is the record key.
+// A unique value also has an entry keyed by the entity, the field and the encoded value, its value is the record key.
+const (
+	privateIndex   = "__index\x00"
+	privateUnique  = "__unique\x00"
+	privateIndexes = "__indexes" // indexed fields the stored index entries were written for
+)
+
+// Version of the layout of the index entries, the entries are written again when it changes
+const indexFormat = 2
+
+func indexPrefix(entityname string, field string) []byte {
+	return []byte(privateIndex + entityname + "\x00" + field + "\x00")
+}
+
+func uniqueKey(entityname string, field string, value []byte) []byte {
+	return append([]byte(privateUnique+entityname+"\x00"+field+"\x00"), value...)
+}
+
+// Returns the indexed fields of an entity
+func (db *DB) indexedFields(entityname string) []Field {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.indexes[entityname]
+}
+
+// Tags of the encoded values, values of different json types never mix
+const (
+	nullTag byte = iota + 1
+	boolTag
+	numberTag
+	stringTag
+)
+
+// Encodes a json value so the byte order of the encodings is the order of the values.
+// Strings end with 0x00 0x01 and their 0x00 bytes are escaped as 0x00 0xff,
+// so a string is never a prefix of another one. Lists and objects can't be encoded.
+func encodeValue(value any) ([]byte, bool) {
+	switch v := value.(type) {
+	case nil:
+		return []byte{nullTag}, true
+	case bool:
+		if v {
+			return []byte{boolTag, 1}, true
+		}
+		return []byte{boolTag, 0}, true
+	case float64:
+		bits := math.Float64bits(v)
+		if v == 0 {
+			bits = 0 // -0 and 0 are equal
+		}
+		if bits&(1<<63) != 0 {
+			bits = ^bits
+		} else {
+			bits |= 1 << 63
+		}
+		return binary.BigEndian.AppendUint64([]byte{numberTag}, bits), true
+	case string:
+		b := make([]byte, 0, len(v)+3)
+		b = append(b, stringTag)
+		for i := 0; i < len(v); i++ {
+			b = append(b, v[i])
+			if v[i] == 0 {
+				b = append(b, 0xff)
+			}
+		}
+		return append(b, 0, 1), true
+	}
+	return nil, false
+}
+
+// Returns the first key after every key starting with the prefix
+func prefixEnd(prefix []byte) []byte {
+	end := slices.Clone(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+// A range of index keys, end is excluded
+type keyRange struct {
+	start, end []byte
+}
+
+// Returns the key ranges of the index holding the records that can match the filters on an indexed field.
+// The ranges mirror Filter.Match: a query value matches numbers, strings, booleans and null values
+// depending on how it reads, so the records found are a superset of the matching ones.
+// Returns false if no filter can be answered by an index.
+func indexRanges(filters []Filter, fields []Field, entityname string) ([]keyRange, bool) {
+	for _, f := range filters {
+		if !slices.ContainsFunc(fields, func(field Field) bool { return field.Name == f.Field }) {
+			continue
+		}
+		prefix := indexPrefix(entityname, f.Field)
+		if f.Operator == EqOperator || f.Operator == InOperator {
+			ranges := make([]keyRange, 0, len(f.Values))
+			for _, q := range f.Values {
+				for _, v := range queryValues(q) {
+					enc, _ := encodeValue(v)
+					start := append(slices.Clone(prefix), enc...)
+					ranges = append(ranges, keyRange{start, prefixEnd(start)})
+				}
+			}
+			return ranges, true
+		}
+	}
+
+	// Range filters on the same field are combined into a single range per type
+	for _, f := range filters {
+		if f.Operator != GteOperator && f.Operator != LteOperator ||
+			!slices.ContainsFunc(fields, func(field Field) bool { return field.Name == f.Field }) {
+			continue
+		}
+		prefix := indexPrefix(entityname, f.Field)
+		ranges := make([]keyRange, 0, 2)
+		for _, tag := range []byte{numberTag, stringTag} {
+			r := keyRange{append(slices.Clone(prefix), tag), append(slices.Clone(prefix), tag+1)}
+			for _, bound := range filters {
+				if bound.Field != f.Field || bound.Operator != GteOperator && bound.Operator != LteOperator {
+					continue
+				}
+				var v any = bound.Values[0]
+				if tag == numberTag {
+					n, err := strconv.ParseFloat(bound.Values[0], 64)
+					if err != nil {
+						// Numbers only compare to numeric query values
+						r.end = r.start
+						break
+					}
+					v = n
+				}
+				enc, _ := encodeValue(v)
+				key := append(slices.Clone(prefix), enc...)
+				if bound.Operator == GteOperator && bytes.Compare(key, r.start) > 0 {
+					r.start = key
+				}
+				if end := prefixEnd(key); bound.Operator == LteOperator && bytes.Compare(end, r.end) < 0 {
+					r.end = end
+				}
+			}
+			if bytes.Compare(r.start, r.end) < 0 {
+				ranges = append(ranges, r)
+			}
+		}
+		return ranges, true
+	}
+	return nil, false
+}
+
+// Returns the json values a query value is equal to, see equals
+func queryValues(q string) []any {
+	values := []any{q}
+	if n, err := strconv.ParseFloat(q, 64); err == nil {
+		values = append(values, n)
+	}
+	if b, err := strconv.ParseBool(q); err == nil {
+		values = append(values, b)
+	}
+	if q == "null" {
+		values = append(values, nil)
+	}
+	return values
+}
+
+// Returns the keys of the records in the ranges of an index, in the order of the records
+func indexLookup(txn *badger.Txn, ranges []keyRange) ([][]byte, error) {
+	keys := make([][]byte, 0)
+	it := txn.NewIterator(badger.DefaultIteratorOptions)
+	defer it.Close()
+	for _, r := range ranges {
+		for it.Seek(r.start); it.Valid() && bytes.Compare(it.Item().Key(), r.end) < 0; it.Next() {
+			key, err := it.Item().ValueCopy(nil)
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, key)
+		}
+	}
+	slices.SortFunc(keys, bytes.Compare)
+	return slices.CompactFunc(keys, bytes.Equal), nil
+}
+
+// Returns the index keys of a record, the values are read like filters read them
+func indexKeys(entityname string, fields []Field, key []byte, value []byte) (map[string][]byte, error) {
+	keys := make(map[string][]byte)
+	if value == nil {
+		return keys, nil
+	}
+	var record map[string]any
+	if err := json.Unmarshal(value, &record); err != nil {
+		return nil, err
+	}
+	for _, f := range fields {
+		for _, v := range lookup(record, strings.Split(f.Name, ".")) {
+			enc, ok := encodeValue(v)
+			if !ok {
+				continue
+			}
+			keys[string(append(append(indexPrefix(entityname, f.Name), enc...), key...))] = nil
+			if isUnique(f) && v != nil {
+				keys[string(uniqueKey(entityname, f.Name, enc))] = []byte(f.Name)
+			}
+		}
+	}
+	return keys, nil
+}
+
+// Replaces the index entries of a record in a transaction, old or value is nil when the record is created or deleted.
+// Fails with ErrConflict if another record has the value of a unique field.
+func (db *DB) updateIndexes(txn *badger.Txn, entityname string, key []byte, old []byte, value []byte) error {
+	fields := db.indexedFields(entityname)
+	if len(fields) == 0 {
+		return nil
+	}
+	prev, err := indexKeys(entityname, fields, key, old)
+	if err != nil {
+		return err
+	}
+	next, err := indexKeys(entityname, fields, key, value)
+	if err != nil {
+		return err
+	}
+
+	for k, field := range next {
+		if _, ok := prev[k]; ok {
+			continue
+		}
+		if field != nil {
+			if err := checkUnique(txn, []byte(k), key, string(field)); err != nil {
+				return err
+			}
+		}
+		if err := txn.Set([]byte(k), key); err != nil {
+			return err
+		}
+	}
+	for k := range prev {
+		if _, ok := next[k]; !ok {
+			if err := txn.Delete([]byte(k)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Checks that no other record has a unique value.
+// The entry of the value is read in the transaction, so a concurrent write of the same value conflicts.
+func checkUnique(txn *badger.Txn, k []byte, key []byte, field string) error {
+	item, err := txn.Get(k)
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	owner, err := item.ValueCopy(nil)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(owner, key) {
+		return fmt.Errorf("%w: %s is already taken", ErrConflict, field)
+	}
+	return nil
+}
+
+// Sets the indexed fields of the entities, the records written from then on are indexed.
+// The stored records are indexed again when the indexes changed since they were written,
+// which fails with ErrConflict if they have duplicate unique values.
+func (db *DB) SetIndexes(entities []Entity) error {
+	indexes := indexedFields(entities)
+	db.mu.Lock()
+	db.indexes = indexes
+	db.mu.Unlock()
+	definition, err := json.Marshal(map[string]any{"format": indexFormat, "fields": indexes})
+	if err != nil {
+		return err
+	}
+	var stored []byte
+	err = db.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(privateIndexes))
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		stored, err = item.ValueCopy(nil)
+		return err
+	})
+	if err != nil || bytes.Equal(stored, definition) {
+		return err
+	}
+
+	if err := db.db.DropPrefix([]byte(privateIndex), []byte(privateUnique)); err != nil {
+		return err
+	}
+	wb := db.db.NewWriteBatch()
+	defer wb.Cancel()
+	err = db.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for entityname, fields := range indexes {
+			taken := make(map[string]bool)
+			prefix := []byte(entityname + "-")
+			for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+				key := it.Item().KeyCopy(nil)[len(prefix):]
+				value, err := it.Item().ValueCopy(nil)
+				if err != nil {
+					return err
+				}
+				keys, err := indexKeys(entityname, fields, key, value)
+				if err != nil {
+					return err
+				}
+				for k, field := range keys {
+					if field != nil {
+						if taken[k] {
+							return fmt.Errorf("%w: %s.%s has duplicates", ErrConflict, entityname, field)
+						}
+						taken[k] = true
+					}
+					if err := wb.Set([]byte(k), key); err != nil {
+						return err
+					}
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := wb.Set([]byte(privateIndexes), definition); err != nil {
+		return err
+	}
+	return wb.Flush()
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Time the file store waits after a change before saving, the changes made meanwhile are saved together
+const saveDelay = 100 * time.Millisecond
+
+// Store keeping the records in a json-server style file (`{ "users": [ ... ], "posts": [ ... ] }`).
+// Records are served from memory and the file is saved after the changes,
+// edits made by hand are loaded with Reload.
+type JSONFileDB struct {
+	*MemDB
+	path string
+
+	fileMu sync.Mutex // serializes the reads and writes of the file
+	saved  []byte     // content of the file when it was last read or written
+
+	saveMu sync.Mutex
+	timer  *time.Timer
+	dirty  bool
+}
+
+// Opens a json file store, the records of the file are loaded if it exists
+func NewJSONFileDB(path string) (*JSONFileDB, error) {
+	db := &JSONFileDB{MemDB: NewMemDB(), path: path}
+	if _, err := db.Reload(); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	return db, nil
+}
+
+// Returns the path of the file
+func (db *JSONFileDB) Path() string {
+	return db.path
+}
+
+func (db *JSONFileDB) Set(entityname string, key []byte, value []byte) error {
+	if err := db.MemDB.Set(entityname, key, value); err != nil {
+		return err
+	}
+	db.changed()
+	return nil
+}
+
+func (db *JSONFileDB) Create(entityname string, key []byte, value []byte) error {
+	if err := db.MemDB.Create(entityname, key, value); err != nil {
+		return err
+	}
+	db.changed()
+	return nil
+}
+
+func (db *JSONFileDB) Delete(entityname string, key []byte, check func(value []byte) error) ([]byte, error) {
+	result, err := db.MemDB.Delete(entityname, key, check)
+	if err != nil {
+		return nil, err
+	}
+	db.changed()
+	return result, nil
+}
+
+func (db *JSONFileDB) Patch(entityname string, key []byte, patch func(value []byte) ([]byte, error)) ([]byte, error) {
+	result, err := db.MemDB.Patch(entityname, key, patch)
+	if err != nil {
+		return nil, err
+	}
+	db.changed()
+	return result, nil
+}
+
+func (db *JSONFileDB) Batch(writes []Write) error {
+	if err := db.MemDB.Batch(writes); err != nil {
+		return err
+	}
+	db.changed()
+	return nil
+}
+
+func (db *JSONFileDB) Clear() error {
+	if err := db.MemDB.Clear(); err != nil {
+		return err
+	}
+	db.changed()
+	return nil
+}
+
+// Saves the pending changes
+func (db *JSONFileDB) Close() error {
+	db.saveMu.Lock()
+	if db.timer != nil {
+		db.timer.Stop()
+	}
+	db.saveMu.Unlock()
+	return db.Save()
+}
+
+// Schedules a save, it's pushed back by every change until the changes stop for saveDelay
+func (db *JSONFileDB) changed() {
+	db.saveMu.Lock()
+	defer db.saveMu.Unlock()
+	db.dirty = true
+	if db.timer == nil {
+		db.timer = time.AfterFunc(saveDelay, func() {
+			if err := db.Save(); err != nil {
+				log.Println("Couldn't save", db.path, err)
+			}
+		})
+		return
+	}
+	db.timer.Reset(saveDelay)
+}
+
+// Writes the records to the file if they changed since the last save.
+// The file isn't written when it already holds the same data, so its formatting is kept.
+func (db *JSONFileDB) Save() error {
+	db.fileMu.Lock()
+	defer db.fileMu.Unlock()
+
+	db.saveMu.Lock()
+	dirty := db.dirty
+	db.dirty = false
+	db.saveMu.Unlock()
+	if !dirty {
+		return nil
+	}
+
+	content, err := db.content()
+	if err == nil && !sameJSON(content, db.saved) {
+		if err = writeFileAtomic(db.path, content); err == nil {
+			db.saved = content
+		}
+	}
+	if err != nil {
+		db.saveMu.Lock()
+		db.dirty = true
+		db.saveMu.Unlock()
+	}
+	return err
+}
+
+// Returns the records as a json-server file, entities of the stored schema are listed even without records
+func (db *JSONFileDB) content() ([]byte, error) {
+	schema, err := db.GetSchema()
+	if err != nil {
+		return nil, err
+	}
+	db.MemDB.mu.RLock()
+	data := make(map[string][]json.RawMessage, len(db.entities))
+	for _, e := range schema {
+		data[e.Name] = make([]json.RawMessage, 0)
+	}
+	for name, e := range db.entities {
+		records := make([]json.RawMessage, 0, len(e.keys))
+		for _, key := range e.keys {
+			// Records are replaced on writes, never changed in place
+			records = append(records, e.records[key])
+		}
+		data[name] = records
+	}
+	db.MemDB.mu.RUnlock()
+	return json.MarshalIndent(data, "", "  ")
+}
+
+// Reads the file again if it changed since it was last read or written,
+// and replaces the records by the ones of the file. Returns the records that changed.
+// Nothing is replaced if the file isn't valid json, if a record has no id,
+// if the records have duplicate ids or unique values, or if they don't match the stored schema (see CheckData).
+func (db *JSONFileDB) Reload() ([]recordChange, error) {
+	db.fileMu.Lock()
+	defer db.fileMu.Unlock()
+
+	content, err := os.ReadFile(db.path)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(content, db.saved) {
+		return nil, nil
+	}
+
+	var data Dataset
+	if err := json.Unmarshal(content, &data); err != nil {
+		return nil, err
+	}
+	// Edits are checked like an ingested file. The schema is only stored once the server has started,
+	// and entities taken from the file itself have none, their records aren't checked.
+	schema, err := db.GetSchema()
+	if err != nil {
+		return nil, err
+	}
+	if slices.ContainsFunc(schema, func(e Entity) bool { return len(e.Schema) != 0 }) {
+		if violations := CheckData(schema, data); len(violations) != 0 {
+			errs := make([]error, 0, len(violations))
+			for _, v := range violations {
+				errs = append(errs, errors.New(v.String()))
+			}
+			return nil, fmt.Errorf("found %d problem(s), the records are kept as they were:\n%w", len(violations), errors.Join(errs...))
+		}
+	}
+	records := make(map[string]map[string][]byte, len(data))
+	for name, list := range data {
+		records[name] = make(map[string][]byte, len(list))
+		for i, record := range list {
+			if record["id"] == nil {
+				return nil, fmt.Errorf("%s[%d] has no id", name, i)
+			}
+			id := FormatID(record["id"])
+			if _, ok := records[name][id]; ok {
+				return nil, fmt.Errorf("%s[%d]: another record has the id %s", name, i, id)
+			}
+			// Encoded like the records written through the API
+			b, err := json.Marshal(record)
+			if err != nil {
+				return nil, err
+			}
+			records[name][id] = b
+		}
+	}
+
+	changes, err := db.replace(records)
+	if err != nil {
+		return nil, err
+	}
+	db.saved = content
+	return changes, nil
+}
+
+// Returns true if two json documents hold the same data
+func sameJSON(a []byte, b []byte) bool {
+	if bytes.Equal(a, b) {
+		return true
+	}
+	var x, y any
+	if json.Unmarshal(a, &x) != nil || json.Unmarshal(b, &y) != nil {
+		return false
+	}
+	return reflect.DeepEqual(x, y)
+}
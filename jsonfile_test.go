@@ -0,0 +1,186 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestJSONFilePersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db.json")
+	db, err := NewJSONFileDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.StoreSchema([]Entity{{Name: "users"}, {Name: "posts"}}); err != nil {
+		t.Fatal(err)
+	}
+	mustSet(t, db, "users", "2", record(2, "name", "grace"))
+	mustSet(t, db, "users", "1", record(1, "name", "ada"))
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{
+  "posts": [],
+  "users": [
+    {
+      "id": 1,
+      "name": "ada"
+    },
+    {
+      "id": 2,
+      "name": "grace"
+    }
+  ]
+}`
+	if string(content) != want {
+		t.Fatalf("file content: got\n%s\nwant\n%s", content, want)
+	}
+
+	db, err = NewJSONFileDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, _ := db.GetAll("users", nil)
+	if got := ids(t, records); !slices.Equal(got, []string{"1", "2"}) {
+		t.Fatalf("reopened store: got %v", got)
+	}
+}
+
+func TestJSONFileReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db.json")
+	db, err := NewJSONFileDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetIndexes(testEntities); err != nil {
+		t.Fatal(err)
+	}
+	mustSet(t, db, "users", "1", record(1, "name", "ada"))
+	mustSet(t, db, "users", "2", record(2, "name", "grace"))
+	if err := db.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if changes, err := db.Reload(); err != nil || len(changes) != 0 {
+		t.Fatalf("Reload of the saved file: got %v %v, want no change", changes, err)
+	}
+
+	edit := func(content string) {
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	edit(`{"users": [{"id": 1, "name": "ada"}, {"id": 3, "name": "hopper"}]}`)
+	changes, err := db.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]string, 0, len(changes))
+	for _, c := range changes {
+		got = append(got, c.entity+"/"+c.id+"="+string(c.value))
+	}
+	slices.Sort(got)
+	want := []string{"users/2=", `users/3={"id":3,"name":"hopper"}`}
+	if !slices.Equal(got, want) {
+		t.Fatalf("Reload changes: got %v, want %v", got, want)
+	}
+	// Ids added by hand aren't handed out
+	if next, _ := db.NextID("users"); next != 4 {
+		t.Fatalf("NextID after a reload: got %d, want 4", next)
+	}
+
+	for _, content := range []string{
+		`{"users": [`,
+		`{"users": [{"name": "no id"}]}`,
+		`{"users": [{"id": 1}, {"id": 1}]}`,
+	} {
+		edit(content)
+		if _, err := db.Reload(); err == nil {
+			t.Fatalf("Reload of %s: expected an error", content)
+		}
+	}
+	edit(`{"users": [{"id": 1, "email": "a@example.com"}, {"id": 2, "email": "a@example.com"}]}`)
+	if _, err := db.Reload(); !errors.Is(err, ErrConflict) {
+		t.Fatalf("Reload with duplicate unique values: got %v, want ErrConflict", err)
+	}
+	records, _ := db.GetAll("users", nil)
+	if got := ids(t, records); !slices.Equal(got, []string{"1", "3"}) {
+		t.Fatalf("refused reloads changed the records: got %v", got)
+	}
+}
+
+// Edits that don't match the stored schema are refused, the previous records are kept
+func TestJSONFileReloadSchema(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db.json")
+	db, err := NewJSONFileDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema := []Entity{
+		{Name: "users", Schema: []Field{{Name: "name", Kind: StringType}, {Name: "age", Kind: NumberType}}},
+		{Name: "posts", Schema: []Field{{Name: "author", Kind: RefType, Options: map[string]any{"entity": "users"}}}},
+	}
+	if err := db.StoreSchema(schema); err != nil {
+		t.Fatal(err)
+	}
+	mustSet(t, db, "users", "1", record(1, "name", "ada", "age", 36))
+	mustSet(t, db, "posts", "1", record(1, "author", 1))
+	if err := db.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	edit := func(content string) {
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, test := range []struct {
+		name    string
+		content string
+		err     string
+	}{
+		{"wrong type", `{"users": [{"id": 1, "name": "ada", "age": "36"}], "posts": []}`, `users[1].age: expected number, got "36"`},
+		{"missing field", `{"users": [{"id": 1, "name": "ada"}], "posts": []}`, "users[1].age: missing field"},
+		{"unexpected field", `{"users": [{"id": 1, "name": "ada", "age": 36, "admin": true}], "posts": []}`, "users[1].admin: unexpected field"},
+		{"dangling ref", `{"users": [{"id": 1, "name": "ada", "age": 36}], "posts": [{"id": 1, "author": 2}]}`, "posts[1].author: no users with id 2"},
+		{"unknown entity", `{"users": [], "posts": [], "tags": [{"id": 1}]}`, "tags[*].*: unknown entity"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			edit(test.content)
+			_, err := db.Reload()
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("got error %v, want %s", err, test.err)
+			}
+			dump, _ := db.Dump([]string{"users", "posts"})
+			if len(dump["users"]) != 1 || string(dump["users"][0]) != string(record(1, "name", "ada", "age", 36)) || len(dump["posts"]) != 1 {
+				t.Fatalf("a refused edit changed the records: %s", dump)
+			}
+		})
+	}
+
+	edit(`{"users": [{"id": 1, "name": "ada", "age": 37}, {"id": 2, "name": "grace", "age": 45}], "posts": [{"id": 1, "author": 2}]}`)
+	changes, err := db.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 3 {
+		t.Fatalf("got %d changes, want 3", len(changes))
+	}
+
+	// Entities without a schema aren't checked, like an ingested file without a schema
+	if err := db.StoreSchema(EntitiesFromData(Dataset{"users": nil, "posts": nil})); err != nil {
+		t.Fatal(err)
+	}
+	edit(`{"users": [{"id": 1, "nickname": "ada"}], "posts": [{"id": 1, "author": 3}]}`)
+	if _, err := db.Reload(); err != nil {
+		t.Fatalf("Reload without a schema: %v", err)
+	}
+}
@@ -23,11 +23,17 @@ func main() {
 	rootCmd.Flags().StringP("db-path", "d", "./db", "Path to the database directory. It will be created if it doesn't exist")
 	rootCmd.Flags().StringP("out-dump", "o", "", "Path to the dump file. the output will be a json file")
 	rootCmd.Flags().StringP("ingest", "i", "", "Path to the ingest file. It should be a json file. If schema is provided, it will be used to validate the data")
+	rootCmd.Flags().Bool("top-up", false, "Complete the ingested data with fake records up to the count of each entity")
 	rootCmd.Flags().BoolP("memmory", "m", false, "Run the server in memmory mode. No data will be persisted")
+	rootCmd.Flags().String("store", string(BadgerStore), "Storage backend: badger, memory, jsonfile or sqlite")
 	rootCmd.Flags().IntP("port", "p", 3000, "Port to listen on")
+	rootCmd.Flags().Int64("seed", 0, "Seed for the data generation, the same seed always generates the same data. Overrides the schema's seed")
+	rootCmd.Flags().String("validation", string(LenientValidation), "Validation of request bodies: strict, lenient or off. Entities can override it in the schema")
 	rootCmd.Flags().BoolP("verbose", "v", false, "Verbose mode")
 	rootCmd.Flags().StringP("log", "l", "serveur.log.txt", "write logs to a specific file")
 
+	genCmd.Flags().Int64("seed", 0, "Seed for the data generation, the same seed always generates the same data. Overrides the schema's seed")
+
 	rootCmd.AddCommand(checkCmd)
 	rootCmd.AddCommand(genCmd)
 	rootCmd.AddCommand(initCmd)
@@ -0,0 +1,464 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sort"
+	"sync"
+)
+
+// Store keeping the records in maps, nothing is persisted.
+// It's the fastest backend, meant for tests and throwaway servers.
+type MemDB struct {
+	mu        sync.RWMutex
+	entities  map[string]*memEntity
+	schema    []byte // stored as json like the other backends do
+	sequences map[string]int64
+	indexes   map[string][]Field // indexed fields by entity name
+	unique    map[string][]byte  // unique index keys (see indexKeys) to the key of the record holding the value
+}
+
+// Records of an entity by encoded id, keys holds the encoded ids in order
+type memEntity struct {
+	keys    []string
+	records map[string][]byte
+}
+
+func NewMemDB() *MemDB {
+	db := &MemDB{}
+	db.reset()
+	return db
+}
+
+func (db *MemDB) reset() {
+	db.entities = make(map[string]*memEntity)
+	db.schema = nil
+	db.sequences = make(map[string]int64)
+	db.unique = make(map[string][]byte)
+}
+
+func (db *MemDB) Close() error {
+	return nil
+}
+
+func (db *MemDB) Clear() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.reset()
+	return nil
+}
+
+func (db *MemDB) GetAll(entityname string, valid *Validtor) ([][]byte, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	result := make([][]byte, 0)
+	e, ok := db.entities[entityname]
+	if !ok {
+		return result, nil
+	}
+	for _, key := range e.keys[e.start(valid):] {
+		if valid.done(result) {
+			break
+		}
+		if v := e.records[key]; valid.keeps(v) {
+			result = append(result, slices.Clone(v))
+		}
+	}
+	return result, nil
+}
+
+func (db *MemDB) Count(entityname string, valid *Validtor) (int, error) {
+	if valid.validates() {
+		return countKept(db, entityname, valid)
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	e, ok := db.entities[entityname]
+	if !ok {
+		return 0, nil
+	}
+	return len(e.keys) - e.start(valid), nil
+}
+
+// Returns the index in keys of the first record read with a validator
+func (e *memEntity) start(valid *Validtor) int {
+	if valid == nil || valid.after == nil {
+		return 0
+	}
+	i, found := slices.BinarySearch(e.keys, string(valid.after))
+	if found {
+		i++
+	}
+	return i
+}
+
+func (db *MemDB) Get(entityname string, key []byte) ([]byte, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	e, ok := db.entities[entityname]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	v, ok := e.records[string(EncodeKey(string(key)))]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return slices.Clone(v), nil
+}
+
+// Writes a record, fails with ErrConflict if a unique value is taken
+func (db *MemDB) Set(entityname string, key []byte, value []byte) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.set(entityname, key, value, false)
+}
+
+// Writes a new record, fails with ErrExists if a record has the key
+func (db *MemDB) Create(entityname string, key []byte, value []byte) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.set(entityname, key, value, true)
+}
+
+// Writes a record, the lock must be held
+func (db *MemDB) set(entityname string, key []byte, value []byte, create bool) error {
+	e, ok := db.entities[entityname]
+	if !ok {
+		e = &memEntity{records: make(map[string][]byte)}
+		db.entities[entityname] = e
+	}
+	k := string(EncodeKey(string(key)))
+	old, exists := e.records[k]
+	if exists && create {
+		return ErrExists
+	}
+	if err := db.updateUnique(entityname, []byte(k), old, value); err != nil {
+		return err
+	}
+	if !exists {
+		i, _ := slices.BinarySearch(e.keys, k)
+		e.keys = slices.Insert(e.keys, i, k)
+	}
+	e.records[k] = slices.Clone(value)
+	return nil
+}
+
+// Deletes a record and returns it, the check runs on the record under the lock
+func (db *MemDB) Delete(entityname string, key []byte, check func(value []byte) error) ([]byte, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	e, ok := db.entities[entityname]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	k := string(EncodeKey(string(key)))
+	old, ok := e.records[k]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	if check != nil {
+		if err := check(slices.Clone(old)); err != nil {
+			return nil, err
+		}
+	}
+	if err := db.remove(entityname, k, old); err != nil {
+		return nil, err
+	}
+	return old, nil
+}
+
+// Deletes a stored record by encoded key, the lock must be held
+func (db *MemDB) remove(entityname string, k string, old []byte) error {
+	if err := db.updateUnique(entityname, []byte(k), old, nil); err != nil {
+		return err
+	}
+	e := db.entities[entityname]
+	i, _ := slices.BinarySearch(e.keys, k)
+	e.keys = slices.Delete(e.keys, i, i+1)
+	delete(e.records, k)
+	return nil
+}
+
+// Applies the writes under the lock, the ones already applied are undone if one fails
+func (db *MemDB) Batch(writes []Write) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	undo := make([]Write, 0, len(writes))
+	rollback := func() {
+		for i := len(undo) - 1; i >= 0; i-- {
+			db.write(undo[i])
+		}
+	}
+
+	written := make(map[string]int64)
+	for _, w := range writes {
+		var old []byte
+		if e, ok := db.entities[w.Entity]; ok {
+			old = e.records[string(EncodeKey(string(w.Key)))]
+		}
+		if err := db.write(w); err != nil {
+			rollback()
+			return fmt.Errorf("%s %s: %w", w.Entity, w.Key, err)
+		}
+		undo = append(undo, Write{Entity: w.Entity, Key: w.Key, Value: old})
+		if n, ok := intID(string(w.Key)); ok && w.Value != nil {
+			written[w.Entity] = max(written[w.Entity], n)
+		}
+	}
+
+	// Entities without a counter start after their greatest id anyway
+	for entityname, n := range written {
+		if last, ok := db.sequences[entityname]; ok && n > last {
+			db.sequences[entityname] = n
+		}
+	}
+	return nil
+}
+
+// Sets or deletes a record, the lock must be held
+func (db *MemDB) write(w Write) error {
+	if w.Value != nil {
+		return db.set(w.Entity, w.Key, w.Value, false)
+	}
+	k := string(EncodeKey(string(w.Key)))
+	if e, ok := db.entities[w.Entity]; ok {
+		if old, ok := e.records[k]; ok {
+			return db.remove(w.Entity, k, old)
+		}
+	}
+	return nil
+}
+
+// Replaces a record by the result of the patch function and returns it,
+// nothing is written if the patch fails
+func (db *MemDB) Patch(entityname string, key []byte, patch func(value []byte) ([]byte, error)) ([]byte, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	e, ok := db.entities[entityname]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	k := string(EncodeKey(string(key)))
+	old, ok := e.records[k]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	result, err := patch(slices.Clone(old))
+	if err != nil {
+		return nil, err
+	}
+	if err := db.updateUnique(entityname, []byte(k), old, result); err != nil {
+		return nil, err
+	}
+	e.records[k] = slices.Clone(result)
+	return result, nil
+}
+
+// Returns the records of every given entity, read under the same lock
+func (db *MemDB) Dump(entitynames []string) (map[string][][]byte, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	result := make(map[string][][]byte, len(entitynames))
+	for _, entityname := range entitynames {
+		records := make([][]byte, 0)
+		if e, ok := db.entities[entityname]; ok {
+			for _, key := range e.keys {
+				records = append(records, slices.Clone(e.records[key]))
+			}
+		}
+		result[entityname] = records
+	}
+	return result, nil
+}
+
+// Returns the next id of an autoincrement entity, the counter starts after the greatest integer id of the entity
+func (db *MemDB) NextID(entityname string) (int64, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	next := db.lastID(entityname) + 1
+	db.sequences[entityname] = next
+	return next, nil
+}
+
+func (db *MemDB) LastID(entityname string) (int64, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.lastID(entityname), nil
+}
+
+// Returns the counter of an entity, or its greatest integer id if it has no counter yet
+func (db *MemDB) lastID(entityname string) int64 {
+	if last, ok := db.sequences[entityname]; ok {
+		return last
+	}
+	return maxID(db.entities[entityname])
+}
+
+// Returns the greatest integer id of an entity, or 0 if there are none
+func maxID(e *memEntity) int64 {
+	if e == nil {
+		return 0
+	}
+	// Integer keys come first, the last one is right before the first key after maxIntKey
+	i := sort.SearchStrings(e.keys, string(maxIntKey)+"\x00")
+	if i == 0 {
+		return 0
+	}
+	n, _ := intID(DecodeKey([]byte(e.keys[i-1])))
+	return max(n, 0)
+}
+
+// Checks the unique values of a record and replaces its entries, old or value is nil when the record is created or deleted
+func (db *MemDB) updateUnique(entityname string, key []byte, old []byte, value []byte) error {
+	fields := db.indexes[entityname]
+	if len(fields) == 0 {
+		return nil
+	}
+	prev, err := indexKeys(entityname, fields, key, old)
+	if err != nil {
+		return err
+	}
+	next, err := indexKeys(entityname, fields, key, value)
+	if err != nil {
+		return err
+	}
+	for k, field := range next {
+		if owner, ok := db.unique[k]; ok && field != nil && !bytes.Equal(owner, key) {
+			return fmt.Errorf("%w: %s is already taken", ErrConflict, field)
+		}
+	}
+	for k, field := range prev {
+		if field != nil {
+			delete(db.unique, k)
+		}
+	}
+	for k, field := range next {
+		if field != nil {
+			db.unique[k] = key
+		}
+	}
+	return nil
+}
+
+// Sets the indexed fields of the entities. Records are scanned in memory so only unique values are tracked,
+// fails with ErrConflict if the stored records have duplicate unique values.
+func (db *MemDB) SetIndexes(entities []Entity) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.indexes = indexedFields(entities)
+	unique, err := db.uniqueValues(db.entities)
+	if err != nil {
+		return err
+	}
+	db.unique = unique
+	return nil
+}
+
+// Returns the unique values of the records, fails with ErrConflict if there are duplicates
+func (db *MemDB) uniqueValues(entities map[string]*memEntity) (map[string][]byte, error) {
+	unique := make(map[string][]byte)
+	for entityname, fields := range db.indexes {
+		e, ok := entities[entityname]
+		if !ok {
+			continue
+		}
+		for _, key := range e.keys {
+			keys, err := indexKeys(entityname, fields, []byte(key), e.records[key])
+			if err != nil {
+				return nil, err
+			}
+			for k, field := range keys {
+				if field == nil {
+					continue
+				}
+				if _, taken := unique[k]; taken {
+					return nil, fmt.Errorf("%w: %s.%s has duplicates", ErrConflict, entityname, field)
+				}
+				unique[k] = []byte(key)
+			}
+		}
+	}
+	return unique, nil
+}
+
+func (db *MemDB) GetSchema() ([]Entity, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.schema == nil {
+		return nil, nil
+	}
+	var result []Entity
+	if err := json.Unmarshal(db.schema, &result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (db *MemDB) StoreSchema(schema []Entity) error {
+	b, err := json.Marshal(schema)
+	if err != nil {
+		return err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.schema = b
+	return nil
+}
+
+// A record changed outside of the API, value is nil when it was deleted
+type recordChange struct {
+	entity string
+	id     string
+	value  []byte
+}
+
+// Replaces every record by the given ones, keyed by entity name and id.
+// Nothing is replaced if they have duplicate unique values.
+// Returns the records that were created, changed or deleted.
+func (db *MemDB) replace(records map[string]map[string][]byte) ([]recordChange, error) {
+	entities := make(map[string]*memEntity, len(records))
+	for entityname, byID := range records {
+		e := &memEntity{keys: make([]string, 0, len(byID)), records: make(map[string][]byte, len(byID))}
+		for id, value := range byID {
+			k := string(EncodeKey(id))
+			e.keys = append(e.keys, k)
+			e.records[k] = value
+		}
+		slices.Sort(e.keys)
+		entities[entityname] = e
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	unique, err := db.uniqueValues(entities)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := make([]recordChange, 0)
+	for entityname, e := range entities {
+		old := db.entities[entityname]
+		for _, key := range e.keys {
+			if old == nil || !bytes.Equal(old.records[key], e.records[key]) {
+				changes = append(changes, recordChange{entityname, DecodeKey([]byte(key)), e.records[key]})
+			}
+		}
+	}
+	for entityname, old := range db.entities {
+		for _, key := range old.keys {
+			if e := entities[entityname]; e == nil || e.records[key] == nil {
+				changes = append(changes, recordChange{entityname, DecodeKey([]byte(key)), nil})
+			}
+		}
+	}
+
+	// Ids added by hand aren't handed out again
+	for entityname, next := range db.sequences {
+		db.sequences[entityname] = max(next, maxID(entities[entityname]))
+	}
+	db.entities = entities
+	db.unique = unique
+	return changes, nil
+}
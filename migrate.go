@@ -0,0 +1,472 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"reflect"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Returned by MigrateDatabase when the records must be generated again instead
+var ErrNotMigratable = errors.New("the records can't be migrated")
+
+// Changes the stored records to fit a new schema instead of generating them again.
+// Records of removed entities are deleted and new entities are generated.
+// Removed fields are dropped from the records and new fields are filled with generated values.
+// Changed fields are converted to their new type (`"42"` to 42, a date to another format, a value to a list...),
+// a field with a `renamedFrom` option takes the value of the old field. Values that can't be converted,
+// or that don't pass the new options, are generated again.
+// When the count of an entity grows, only the missing records are generated. When it shrinks the records are kept,
+// they can't be told apart from the ones created through the API.
+// Every record is migrated before anything is written, then the writes are applied in a single transaction (see Store.Batch),
+// so a failed migration leaves the store as it was.
+// Fails with ErrNotMigratable if the ids of an entity are minted differently.
+func MigrateDatabase(entities []Entity, prev []Entity, s Store) error {
+	previous := make(map[string]Entity, len(prev))
+	for _, e := range prev {
+		previous[e.Name] = e
+	}
+	for _, e := range entities {
+		old, ok := previous[e.Name]
+		if !ok {
+			continue
+		}
+		if e.IDStrategy != old.IDStrategy || e.NaturalKey() != old.NaturalKey() {
+			return fmt.Errorf("%w: the ids of %s changed", ErrNotMigratable, e.Name)
+		}
+		if key := e.NaturalKey(); key != "" {
+			f, _ := schemaField(e.Schema, []string{key})
+			oldF, _ := schemaField(old.Schema, []string{key})
+			if !reflect.DeepEqual(f, oldF) {
+				return fmt.Errorf("%w: the ids of %s changed", ErrNotMigratable, e.Name)
+			}
+		}
+	}
+
+	removed := make(map[string][][]byte)
+	for _, old := range prev {
+		if slices.ContainsFunc(entities, func(e Entity) bool { return e.Name == old.Name }) {
+			continue
+		}
+		records, err := s.GetAll(old.Name, nil)
+		if err != nil {
+			return err
+		}
+		removed[old.Name] = records
+	}
+
+	// The records are read before the missing ones are generated, those already fit the schema
+	refs := make(References)
+	stored := make(map[string][][]byte, len(entities))
+	for _, e := range entities {
+		if _, ok := previous[e.Name]; !ok {
+			continue
+		}
+		records, err := s.GetAll(e.Name, nil)
+		if err != nil {
+			return err
+		}
+		stored[e.Name] = records
+		for _, r := range records {
+			var record struct {
+				ID any `json:"id"`
+			}
+			if err := json.Unmarshal(r, &record); err == nil && record.ID != nil {
+				refs[e.Name] = append(refs[e.Name], record.ID)
+			}
+		}
+	}
+
+	counts := make(map[string]int, len(entities))
+	delta := slices.Clone(entities)
+	for i, e := range delta {
+		old, ok := previous[e.Name]
+		switch {
+		case !ok:
+			counts[e.Name] = e.Count
+		case e.Count > old.Count:
+			counts[e.Name] = e.Count - old.Count
+			// Seeded entities continue with another sequence, the first one would generate the stored records again
+			if e.Seed != 0 {
+				delta[i].Seed += int64(old.Count)
+			}
+		}
+	}
+	generated, err := generateMissing(delta, counts, refs, s)
+	if err != nil {
+		return err
+	}
+
+	writes := make([]Write, 0)
+	for name, records := range removed {
+		log.Println("Deleting the records of entity:", name)
+		for _, r := range records {
+			writes = append(writes, Write{Entity: name, Key: []byte(recordID(r))})
+		}
+	}
+	for _, e := range entities {
+		old, ok := previous[e.Name]
+		if !ok {
+			for _, record := range generated[e.Name] {
+				w, err := newWrite(e.Name, record)
+				if err != nil {
+					return err
+				}
+				writes = append(writes, w)
+			}
+			continue
+		}
+		if reflect.DeepEqual(e.Schema, old.Schema) && len(generated[e.Name]) == 0 {
+			continue
+		}
+		m := &migration{g: NewGenerator(e.Seed, e.Name+"/migrate", refs), ids: refIDSets(refs)}
+		records, err := m.entity(old, e, stored[e.Name], generated[e.Name])
+		if err != nil {
+			return err
+		}
+		writes = append(writes, records...)
+	}
+
+	if err := s.Batch(writes); err != nil {
+		return err
+	}
+	log.Println("Done!")
+	return nil
+}
+
+func newWrite(entity string, record map[string]any) (Write, error) {
+	value, err := json.Marshal(record)
+	return Write{Entity: entity, Key: []byte(FormatID(record["id"])), Value: value}, err
+}
+
+// Generates the missing records of the entities without writing them.
+// Autoincrement ids follow the store's counter, the written records raise it so they're never handed out again by a POST.
+func generateMissing(entities []Entity, counts map[string]int, refs References, s Store) (map[string][]map[string]any, error) {
+	var mu sync.Mutex
+	generated := make(map[string][]map[string]any)
+	last := make(map[string]int64)
+	err := GenerateEntities(entities, counts, refs, func(e Entity, id string, m map[string]any) error {
+		// Entities of the same level are generated concurrently
+		mu.Lock()
+		defer mu.Unlock()
+		if e.IDStrategy == AutoIncrementStrategy {
+			if _, ok := last[e.Name]; !ok {
+				n, err := s.LastID(e.Name)
+				if err != nil {
+					return err
+				}
+				last[e.Name] = n
+			}
+			last[e.Name]++
+			// The generated id is replaced in the record, it's the one added to the references
+			m["id"] = last[e.Name]
+		}
+		generated[e.Name] = append(generated[e.Name], m)
+		return nil
+	})
+	return generated, err
+}
+
+// Returns the ids of the references by entity, formatted
+func refIDSets(refs References) map[string]map[string]bool {
+	ids := make(map[string]map[string]bool, len(refs))
+	for name, list := range refs {
+		ids[name] = make(map[string]bool, len(list))
+		for _, id := range list {
+			ids[name][FormatID(id)] = true
+		}
+	}
+	return ids
+}
+
+// Converts the records of an entity to its new schema
+type migration struct {
+	g   *Generator
+	ids map[string]map[string]bool // ids that references can point to
+}
+
+// Migrates the stored records of an entity and returns the ones that changed, followed by the generated ones.
+// Unique values are generated again when they're already taken, the stored records keep theirs first.
+func (m *migration) entity(old Entity, e Entity, records [][]byte, generated []map[string]any) ([]Write, error) {
+	taken := make(map[string]map[string]bool)
+	for _, f := range e.Schema {
+		if isUnique(f) {
+			taken[f.Name] = make(map[string]bool)
+		}
+	}
+
+	migrated := !reflect.DeepEqual(old.Schema, e.Schema)
+	if migrated {
+		log.Println("Migrating the records of entity:", e.Name)
+	}
+	writes := make([]Write, 0, len(generated))
+	for _, b := range records {
+		var record map[string]any
+		if err := json.Unmarshal(b, &record); err != nil {
+			return nil, err
+		}
+		changed := false
+		if migrated {
+			var err error
+			if changed, err = m.object(old.Schema, e.Schema, record); err != nil {
+				return nil, err
+			}
+		}
+		regenerated, err := m.unique(e, record, taken)
+		if err != nil {
+			return nil, err
+		}
+		if !changed && !regenerated {
+			continue
+		}
+		w, err := newWrite(e.Name, record)
+		if err != nil {
+			return nil, err
+		}
+		writes = append(writes, w)
+	}
+	if migrated {
+		log.Printf("%d of %d %s record(s) updated", len(writes), len(records), e.Name)
+	}
+
+	for _, record := range generated {
+		if _, err := m.unique(e, record, taken); err != nil {
+			return nil, err
+		}
+		w, err := newWrite(e.Name, record)
+		if err != nil {
+			return nil, err
+		}
+		writes = append(writes, w)
+	}
+	return writes, nil
+}
+
+// Generates the unique values of a record again while they're taken, then takes them.
+// Returns true if a value changed.
+func (m *migration) unique(e Entity, record map[string]any, taken map[string]map[string]bool) (bool, error) {
+	changed := false
+	for _, f := range e.Schema {
+		values, ok := taken[f.Name]
+		if !ok {
+			continue
+		}
+		for retry := 0; record[f.Name] != nil && values[FormatID(record[f.Name])]; retry++ {
+			if retry == maxUniqueRetries {
+				return false, fmt.Errorf("%s: couldn't generate a unique %s after %d tries", e.Name, f.Name, maxUniqueRetries)
+			}
+			v, err := GetFake(f, m.g)
+			if err != nil {
+				return false, err
+			}
+			record[f.Name] = v
+			changed = true
+		}
+		if record[f.Name] != nil {
+			values[FormatID(record[f.Name])] = true
+		}
+	}
+	return changed, nil
+}
+
+// Migrates the fields of an object in place, returns true if it changed.
+// Keys that aren't fields of the old schema (like the id) are kept.
+func (m *migration) object(prev []Field, next []Field, obj map[string]any) (bool, error) {
+	changed := false
+	for _, f := range next {
+		from := f.Name
+		if name, ok := f.Options["renamedFrom"].(string); ok && !slices.ContainsFunc(next, func(n Field) bool { return n.Name == name }) {
+			from = name
+		}
+		i := slices.IndexFunc(prev, func(p Field) bool { return p.Name == from })
+		value, exists := obj[from]
+		switch {
+		case i == -1:
+			v, err := GetFake(f, m.g)
+			if err != nil {
+				return false, err
+			}
+			obj[f.Name] = v
+			changed = true
+			continue
+		case !exists || from == f.Name && reflect.DeepEqual(prev[i], f):
+			continue
+		}
+
+		v, err := m.value(prev[i], f, value)
+		if err != nil {
+			return false, err
+		}
+		if from != f.Name || !reflect.DeepEqual(v, value) {
+			obj[f.Name] = v
+			changed = true
+		}
+	}
+
+	// Renamed fields are removed too
+	for _, p := range prev {
+		if _, exists := obj[p.Name]; exists && !slices.ContainsFunc(next, func(f Field) bool { return f.Name == p.Name }) {
+			delete(obj, p.Name)
+			changed = true
+		}
+	}
+	return changed, nil
+}
+
+// Converts a value to a changed field, the value is generated again if it can't be converted
+// or if the result doesn't pass the field's options
+func (m *migration) value(from Field, to Field, v any) (any, error) {
+	result, ok := m.convert(from, to, v)
+	if ok && len(checkField(to, result, to.Name, CheckPolicy{})) == 0 && m.refsExist(to, result) {
+		return result, nil
+	}
+	return GetFake(to, m.g)
+}
+
+// Returns false if a reference points to a record that doesn't exist
+func (m *migration) refsExist(f Field, v any) bool {
+	if f.Kind == ArrayType {
+		list, _ := v.([]any)
+		return !slices.ContainsFunc(list, func(item any) bool { return !m.refsExist(*f.Items, item) })
+	}
+	if f.Kind != RefType || v == nil {
+		return true
+	}
+	if list, ok := v.([]any); ok {
+		return !slices.ContainsFunc(list, func(id any) bool { return !m.ids[refEntity(f)][FormatID(id)] })
+	}
+	return m.ids[refEntity(f)][FormatID(v)]
+}
+
+// Returns a value converted to the type of a field, or false if it can't be
+func (m *migration) convert(from Field, to Field, v any) (any, bool) {
+	if v == nil {
+		return nil, true
+	}
+	list, isList := v.([]any)
+	many, _ := to.Options["many"].(bool)
+
+	switch {
+	case to.Kind == ArrayType:
+		if !isList {
+			item, ok := m.convert(itemField(from), *to.Items, v)
+			return []any{item}, ok
+		}
+		items := make([]any, 0, len(list))
+		for _, item := range list {
+			converted, ok := m.convert(itemField(from), *to.Items, item)
+			if !ok {
+				return nil, false
+			}
+			items = append(items, converted)
+		}
+		return items, true
+
+	case to.Kind == RefType && many:
+		if !isList {
+			list = []any{v}
+		}
+		return list, true
+
+	case isList:
+		// A list only converts to a single value when it holds one
+		if len(list) != 1 {
+			return nil, false
+		}
+		return m.convert(itemField(from), to, list[0])
+
+	case to.Kind == ObjectType:
+		obj, ok := v.(map[string]any)
+		if !ok || from.Kind != ObjectType {
+			return nil, false
+		}
+		// The stored object is compared with the result
+		obj = maps.Clone(obj)
+		if _, err := m.object(from.Schema, to.Schema, obj); err != nil {
+			return nil, false
+		}
+		return obj, true
+	}
+
+	switch to.Kind {
+	case NumberType:
+		switch v := v.(type) {
+		case float64:
+			return v, true
+		case string:
+			n, err := strconv.ParseFloat(v, 64)
+			return n, err == nil
+		}
+	case BooleanType:
+		switch v := v.(type) {
+		case bool:
+			return v, true
+		case float64:
+			return v != 0, true
+		case string:
+			b, err := strconv.ParseBool(v)
+			return b, err == nil
+		}
+	case DateType:
+		t, ok := fieldDate(from, v)
+		if !ok {
+			return nil, false
+		}
+		layout := dateLayout(to)
+		if layout == "" {
+			return float64(t.Unix()), true
+		}
+		return t.Format(layout), true
+	case AddressType:
+		_, ok := v.(map[string]any)
+		return v, ok
+	case RefType:
+		return v, isID(v)
+	default:
+		switch v := v.(type) {
+		case string:
+			return v, true
+		case float64:
+			return strconv.FormatFloat(v, 'f', -1, 64), true
+		case bool:
+			return strconv.FormatBool(v), true
+		}
+	}
+	return nil, false
+}
+
+// Returns the field of the items of a list field, other fields are returned as they are
+func itemField(f Field) Field {
+	if f.Items != nil {
+		return *f.Items
+	}
+	if many, _ := f.Options["many"].(bool); many {
+		f.Options = map[string]any{"entity": refEntity(f)}
+	}
+	return f
+}
+
+// Reads a date value: a unix timestamp, a string formatted like the field's dates, or any date parseDate reads
+func fieldDate(f Field, v any) (time.Time, bool) {
+	switch v := v.(type) {
+	case float64:
+		return time.Unix(int64(v), 0).UTC(), true
+	case string:
+		if f.Kind == DateType {
+			if layout := dateLayout(f); layout != "" {
+				if t, err := time.Parse(layout, v); err == nil {
+					return t, true
+				}
+			}
+		}
+		t, err := parseDate(v)
+		return t, err == nil
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestMigrateDatabase(t *testing.T) {
+	prev := []Entity{
+		{Name: "users", Count: 2, IDStrategy: AutoIncrementStrategy, Schema: []Field{
+			{Name: "name", Kind: StringType},
+			{Name: "age", Kind: StringType},
+			{Name: "joined", Kind: DateType},
+			{Name: "tag", Kind: StringType},
+			{Name: "legacy", Kind: BooleanType},
+			{Name: "address", Kind: ObjectType, Schema: []Field{{Name: "city", Kind: StringType}}},
+		}},
+		{Name: "posts", Count: 1, Schema: []Field{
+			{Name: "author", Kind: RefType, Options: map[string]any{"entity": "users"}},
+		}},
+		{Name: "old", Count: 1, Schema: []Field{{Name: "x", Kind: StringType}}},
+	}
+	next := []Entity{
+		{Name: "users", Count: 3, IDStrategy: AutoIncrementStrategy, Schema: []Field{
+			{Name: "fullName", Kind: StringType, Options: map[string]any{"renamedFrom": "name"}},
+			{Name: "age", Kind: NumberType, Options: map[string]any{"max": 100.0}},
+			{Name: "joined", Kind: DateType, Options: map[string]any{"format": "unix"}},
+			{Name: "tag", Kind: ArrayType, Items: &Field{Kind: StringType}},
+			{Name: "email", Kind: EmailType},
+			{Name: "address", Kind: ObjectType, Schema: []Field{
+				{Name: "city", Kind: StringType},
+				{Name: "country", Kind: StringType, Options: map[string]any{"enum": []any{"FR"}}},
+			}},
+		}},
+		{Name: "posts", Count: 1, Schema: []Field{
+			{Name: "author", Kind: RefType, Options: map[string]any{"entity": "users", "many": true}},
+		}},
+	}
+
+	db := NewMemDB()
+	mustSet(t, db, "users", "1", record(1, "name", "ada", "age", "36", "joined", "2020-02-03", "tag", "a", "legacy", true,
+		"address", map[string]any{"city": "Paris"}, "extra", "kept"))
+	mustSet(t, db, "users", "2", record(2, "name", "grace", "age", "unknown", "joined", "2021-01-01", "tag", "b", "legacy", false,
+		"address", map[string]any{"city": "Lyon"}))
+	mustSet(t, db, "posts", "p", record("p", "author", 2))
+	mustSet(t, db, "old", "o", record("o", "x", "y"))
+	// Ids handed out by POST aren't generated again
+	for i := 0; i < 3; i++ {
+		if _, err := db.NextID("users"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := MigrateDatabase(next, prev, db); err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(entity string, id string) map[string]any {
+		t.Helper()
+		b, err := db.Get(entity, []byte(id))
+		if err != nil {
+			t.Fatalf("%s %s: %v", entity, id, err)
+		}
+		var r map[string]any
+		if err := json.Unmarshal(b, &r); err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+
+	ada := get("users", "1")
+	for key, want := range map[string]any{
+		"fullName": "ada",
+		"age":      36.0,
+		"joined":   1580688000.0,
+		"tag":      []any{"a"},
+		"address":  map[string]any{"city": "Paris", "country": "FR"},
+		"extra":    "kept",
+	} {
+		if !reflect.DeepEqual(ada[key], want) {
+			t.Errorf("%s: got %v, want %v", key, ada[key], want)
+		}
+	}
+	for _, key := range []string{"name", "legacy"} {
+		if _, ok := ada[key]; ok {
+			t.Errorf("%s wasn't removed", key)
+		}
+	}
+	if email, _ := ada["email"].(string); email == "" {
+		t.Errorf("email wasn't generated: %v", ada["email"])
+	}
+
+	// A value that can't be converted is generated
+	if age, ok := get("users", "2")["age"].(float64); !ok || age > 100 {
+		t.Errorf("age: got %v, want a generated number", get("users", "2")["age"])
+	}
+	if author := get("posts", "p")["author"]; !reflect.DeepEqual(author, []any{2.0}) {
+		t.Errorf("author: got %v, want [2]", author)
+	}
+
+	users, _ := db.GetAll("users", nil)
+	if got, want := ids(t, users), []string{"1", "2", "6"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("users: got %v, want %v", got, want)
+	}
+	if old, _ := db.GetAll("old", nil); len(old) != 0 {
+		t.Errorf("records of a removed entity are kept: %s", old)
+	}
+
+	changed := []Entity{next[0], next[1]}
+	changed[0].IDStrategy = UUIDStrategy
+	if err := MigrateDatabase(changed, next, db); !errors.Is(err, ErrNotMigratable) {
+		t.Errorf("ids minted differently: got %v, want ErrNotMigratable", err)
+	}
+}
+
+func TestMigrateDatabaseUnique(t *testing.T) {
+	slot := func(count int, options map[string]any) []Entity {
+		return []Entity{
+			{Name: "notes", Count: 1, Schema: []Field{{Name: "text", Kind: StringType}}},
+			{Name: "tickets", Count: count, IDStrategy: AutoIncrementStrategy, Schema: []Field{
+				{Name: "slot", Kind: NumberType, Options: options},
+			}},
+		}
+	}
+	prev := slot(1, nil)
+	prev[1].Schema[0].Kind = StringType
+
+	db := NewMemDB()
+	mustSet(t, db, "notes", "n", record("n", "text", "kept"))
+	mustSet(t, db, "tickets", "1", record(1, "slot", "2"))
+
+	// The generated record can't take the converted value of the stored one
+	next := slot(2, map[string]any{"unique": true, "enum": []any{1.0, 2.0}})
+	if err := MigrateDatabase(next, prev, db); err != nil {
+		t.Fatal(err)
+	}
+	tickets, _ := db.GetAll("tickets", nil)
+	slots := make([]any, 0, len(tickets))
+	for _, b := range tickets {
+		var r map[string]any
+		json.Unmarshal(b, &r)
+		slots = append(slots, r["slot"])
+	}
+	if !reflect.DeepEqual(slots, []any{2.0, 1.0}) {
+		t.Errorf("slots: got %v, want [2 1]", slots)
+	}
+
+	// A failure leaves the store as it was
+	mustSet(t, db, "tickets", "3", record(3, "slot", 2))
+	changed := slot(3, map[string]any{"unique": true, "enum": []any{1.0, 2.0}})
+	changed[0].Schema = []Field{{Name: "body", Kind: StringType, Options: map[string]any{"renamedFrom": "text"}}}
+	before, _ := db.Dump([]string{"notes", "tickets"})
+	if err := MigrateDatabase(changed, next, db); err == nil {
+		t.Fatal("migrating 3 tickets to 2 unique slots succeeded")
+	}
+	after, _ := db.Dump([]string{"notes", "tickets"})
+	if !reflect.DeepEqual(before, after) {
+		t.Errorf("a failed migration changed the store:\n%s\n%s", before, after)
+	}
+}
+
+// Records the writes made outside of Batch and fails the batch
+type failingBatch struct {
+	Store
+	writes []string
+}
+
+func (s *failingBatch) Set(entityname string, key []byte, value []byte) error {
+	s.writes = append(s.writes, "Set "+entityname)
+	return s.Store.Set(entityname, key, value)
+}
+
+func (s *failingBatch) Delete(entityname string, key []byte, check func(value []byte) error) ([]byte, error) {
+	s.writes = append(s.writes, "Delete "+entityname)
+	return s.Store.Delete(entityname, key, check)
+}
+
+func (s *failingBatch) NextID(entityname string) (int64, error) {
+	s.writes = append(s.writes, "NextID "+entityname)
+	return s.Store.NextID(entityname)
+}
+
+func (s *failingBatch) Batch(writes []Write) error {
+	return errors.New("disk full")
+}
+
+func TestMigrateDatabaseFailure(t *testing.T) {
+	prev := []Entity{
+		{Name: "notes", Count: 1, Schema: []Field{{Name: "text", Kind: StringType}}},
+		{Name: "tickets", Count: 1, IDStrategy: AutoIncrementStrategy, Schema: []Field{{Name: "title", Kind: StringType}}},
+	}
+	next := []Entity{
+		{Name: "tickets", Count: 3, IDStrategy: AutoIncrementStrategy, Schema: []Field{{Name: "title", Kind: NumberType}}},
+		{Name: "tags", Count: 2, Schema: []Field{{Name: "label", Kind: StringType}}},
+	}
+	db := NewMemDB()
+	mustSet(t, db, "notes", "n", record("n", "text", "kept"))
+	mustSet(t, db, "tickets", "1", record(1, "title", "42"))
+	if _, err := db.NextID("tickets"); err != nil {
+		t.Fatal(err)
+	}
+
+	names := []string{"notes", "tickets", "tags"}
+	before, _ := db.Dump(names)
+	s := &failingBatch{Store: db}
+	if err := MigrateDatabase(next, prev, s); err == nil || err.Error() != "disk full" {
+		t.Fatalf("got error %v, want disk full", err)
+	}
+	if len(s.writes) != 0 {
+		t.Errorf("written outside of the batch: %v", s.writes)
+	}
+	after, _ := db.Dump(names)
+	if !reflect.DeepEqual(before, after) {
+		t.Errorf("a failed migration changed the store:\n%s\n%s", before, after)
+	}
+	// The counter is at 2, the id taken before the migration
+	if last, _ := db.LastID("tickets"); last != 2 {
+		t.Errorf("a failed migration took ids: the last one is %d, want 2", last)
+	}
+
+	// The same migration succeeds once the batch goes through
+	if err := MigrateDatabase(next, prev, db); err != nil {
+		t.Fatal(err)
+	}
+	after, _ = db.Dump(names)
+	if len(after["notes"]) != 0 || len(after["tickets"]) != 3 || len(after["tags"]) != 2 {
+		t.Errorf("migrated counts: got %d notes, %d tickets, %d tags, want 0, 3 and 2", len(after["notes"]), len(after["tickets"]), len(after["tags"]))
+	}
+	if next, _ := db.NextID("tickets"); next != 5 {
+		t.Errorf("NextID after the migration: got %d, want 5", next)
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"slices"
+	"sort"
+	"time"
+)
+
+type optionKind string
+
+const (
+	numberOption   optionKind = "a number"
+	integerOption  optionKind = "a positive integer"
+	boolOption     optionKind = "a boolean"
+	stringOption   optionKind = "a string"
+	listOption     optionKind = "a list"
+	nullableOption optionKind = "a boolean or a probability between 0 and 1"
+)
+
+// Options every field accepts, except the ones in noEnum can't have an enum
+var commonOptions = map[string]optionKind{
+	"nullable":    nullableOption,
+	"required":    boolOption,
+	"indexed":     boolOption,
+	"unique":      boolOption,
+	"renamedFrom": stringOption,
+	"enum":        listOption,
+	"weights":     listOption,
+}
+
+var noEnum = []FieldType{BooleanType, AddressType, RefType, ObjectType, ArrayType}
+
+// Options specific to a field type
+var fieldOptions = map[FieldType]map[string]optionKind{
+	NumberType: {
+		"min":       numberOption,
+		"max":       numberOption,
+		"precision": integerOption,
+	},
+	StringType: {
+		"minLength": integerOption,
+		"maxLength": integerOption,
+		"regex":     stringOption,
+	},
+	ParagraphType: {
+		"minLength": integerOption,
+		"maxLength": integerOption,
+	},
+	DateType: {
+		"from":   stringOption,
+		"to":     stringOption,
+		"format": stringOption,
+	},
+	ArrayType: {
+		"minItems": integerOption,
+		"maxItems": integerOption,
+	},
+	RefType: {
+		"entity":   stringOption,
+		"many":     boolOption,
+		"minItems": integerOption,
+		"maxItems": integerOption,
+	},
+}
+
+// Named date formats, any other format is used as a Go time layout
+var dateFormats = map[string]string{
+	"date":     time.DateOnly,
+	"datetime": time.RFC3339,
+}
+
+// Checks that every option of a field is known for its type and has a valid value
+func validateOptions(f Field) error {
+	keys := make([]string, 0, len(f.Options))
+	for key := range f.Options {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		kind, ok := fieldOptions[f.Kind][key]
+		if !ok {
+			kind, ok = commonOptions[key]
+		}
+		if !ok || (key == "enum" || key == "weights") && slices.Contains(noEnum, f.Kind) {
+			return fmt.Errorf("unknown option %q for type %s", key, f.Kind)
+		}
+		if !isOptionKind(f.Options[key], kind) {
+			return fmt.Errorf("option %q must be %s", key, kind)
+		}
+	}
+
+	if min, max := f.Options["min"], f.Options["max"]; min != nil && max != nil && min.(float64) > max.(float64) {
+		return errors.New("option \"min\" is greater than \"max\"")
+	}
+	if min, max := f.Options["minLength"], f.Options["maxLength"]; min != nil && max != nil && min.(float64) > max.(float64) {
+		return errors.New("option \"minLength\" is greater than \"maxLength\"")
+	}
+	if min, max := f.Options["minItems"], f.Options["maxItems"]; min != nil && max != nil && min.(float64) > max.(float64) {
+		return errors.New("option \"minItems\" is greater than \"maxItems\"")
+	}
+
+	if enum, ok := f.Options["enum"].([]any); ok && len(enum) == 0 {
+		return errors.New("option \"enum\" can't be empty")
+	}
+	if weights, ok := f.Options["weights"].([]any); ok {
+		enum, _ := f.Options["enum"].([]any)
+		if len(weights) != len(enum) {
+			return errors.New("option \"weights\" must have one weight per enum value")
+		}
+		for _, w := range weights {
+			if v, ok := w.(float64); !ok || v < 0 {
+				return errors.New("option \"weights\" must only contain positive numbers")
+			}
+		}
+	}
+
+	if pattern, ok := f.Options["regex"].(string); ok {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return fmt.Errorf("option \"regex\": %w", err)
+		}
+	}
+
+	if f.Kind == DateType {
+		from, to, err := dateRange(f)
+		if err != nil {
+			return err
+		}
+		if from.After(to) {
+			return errors.New("option \"from\" is after \"to\"")
+		}
+	}
+
+	// Enum values are checked against the type and the other options of the field
+	if enum, ok := f.Options["enum"].([]any); ok {
+		plain := f
+		plain.Options = make(map[string]any, len(f.Options))
+		for key, v := range f.Options {
+			if key != "enum" && key != "weights" {
+				plain.Options[key] = v
+			}
+		}
+		for i, v := range enum {
+			if reason := checkValue(plain, v); reason != "" {
+				return fmt.Errorf("option \"enum\": value %d: %s", i, reason)
+			}
+		}
+	}
+
+	return nil
+}
+
+func isOptionKind(value any, kind optionKind) bool {
+	switch kind {
+	case numberOption:
+		_, ok := value.(float64)
+		return ok
+	case integerOption:
+		v, ok := value.(float64)
+		return ok && v >= 0 && v == math.Trunc(v)
+	case boolOption:
+		_, ok := value.(bool)
+		return ok
+	case stringOption:
+		_, ok := value.(string)
+		return ok
+	case listOption:
+		_, ok := value.([]any)
+		return ok
+	case nullableOption:
+		if _, ok := value.(bool); ok {
+			return true
+		}
+		v, ok := value.(float64)
+		return ok && v >= 0 && v <= 1
+	}
+	return false
+}
+
+func optionInt(f Field, key string, def int) int {
+	if v, ok := f.Options[key].(float64); ok {
+		return int(v)
+	}
+	return def
+}
+
+func optionFloat(f Field, key string, def float64) float64 {
+	if v, ok := f.Options[key].(float64); ok {
+		return v
+	}
+	return def
+}
+
+// Returns the probability of a field being null, `"nullable": true` is a coin flip
+func nullProbability(f Field) float64 {
+	switch v := f.Options["nullable"].(type) {
+	case bool:
+		if v {
+			return 0.5
+		}
+	case float64:
+		return v
+	}
+	return 0
+}
+
+func isNullable(f Field) bool {
+	return nullProbability(f) > 0
+}
+
+// Required fields must be in request bodies even when the validation is lenient
+func isRequired(f Field) bool {
+	required, _ := f.Options["required"].(bool)
+	return required
+}
+
+// Returns the Go time layout of a date field, or an empty string for unix timestamps
+func dateLayout(f Field) string {
+	format, ok := f.Options["format"].(string)
+	if !ok {
+		return time.DateOnly
+	}
+	if format == "unix" {
+		return ""
+	}
+	if layout, ok := dateFormats[format]; ok {
+		return layout
+	}
+	return format
+}
+
+// Returns the bounds of a date field, from the unix epoch to now by default
+func dateRange(f Field) (time.Time, time.Time, error) {
+	from, to := time.Unix(0, 0).UTC(), time.Now().UTC()
+	for key, bound := range map[string]*time.Time{"from": &from, "to": &to} {
+		s, ok := f.Options[key].(string)
+		if !ok {
+			continue
+		}
+		t, err := parseDate(s)
+		if err != nil {
+			return from, to, fmt.Errorf("option %q must be a date (2006-01-02 or RFC 3339)", key)
+		}
+		*bound = t
+	}
+	return from, to, nil
+}
+
+func parseDate(s string) (time.Time, error) {
+	t, err := time.Parse(time.DateOnly, s)
+	if err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestValidateOptions(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		field Field
+		err   string
+	}{
+		{"no options", Field{Kind: StringType}, ""},
+		{"number range", Field{Kind: NumberType, Options: map[string]any{"min": 1.0, "max": 5.0, "precision": 2.0}}, ""},
+		{"unknown option", Field{Kind: NumberType, Options: map[string]any{"regex": "a"}}, `unknown option "regex" for type number`},
+		{"enum on a boolean", Field{Kind: BooleanType, Options: map[string]any{"enum": []any{true}}}, `unknown option "enum" for type bool`},
+		{"wrong option kind", Field{Kind: StringType, Options: map[string]any{"maxLength": "5"}}, `option "maxLength" must be a positive integer`},
+		{"nullable probability", Field{Kind: StringType, Options: map[string]any{"nullable": 0.5}}, ""},
+		{"min above max", Field{Kind: NumberType, Options: map[string]any{"min": 5.0, "max": 1.0}}, `option "min" is greater than "max"`},
+		{"minLength above maxLength", Field{Kind: StringType, Options: map[string]any{"minLength": 5.0, "maxLength": 1.0}}, `option "minLength" is greater than "maxLength"`},
+		{"minItems above maxItems", Field{Kind: ArrayType, Items: &Field{Kind: StringType}, Options: map[string]any{"minItems": 3.0, "maxItems": 1.0}}, `option "minItems" is greater than "maxItems"`},
+		{"invalid regex", Field{Kind: StringType, Options: map[string]any{"regex": "["}}, "option \"regex\": error parsing regexp: missing closing ]: `[`"},
+		{"date range", Field{Kind: DateType, Options: map[string]any{"from": "2020-01-01", "to": "2021-01-01"}}, ""},
+		{"reversed date range", Field{Kind: DateType, Options: map[string]any{"from": "2021-01-01", "to": "2020-01-01"}}, `option "from" is after "to"`},
+		{"empty enum", Field{Kind: StringType, Options: map[string]any{"enum": []any{}}}, `option "enum" can't be empty`},
+		{"weights", Field{Kind: StringType, Options: map[string]any{"enum": []any{"a", "b"}, "weights": []any{1.0, 3.0}}}, ""},
+		{"missing weight", Field{Kind: StringType, Options: map[string]any{"enum": []any{"a", "b"}, "weights": []any{1.0}}}, `option "weights" must have one weight per enum value`},
+		{"negative weight", Field{Kind: StringType, Options: map[string]any{"enum": []any{"a"}, "weights": []any{-1.0}}}, `option "weights" must only contain positive numbers`},
+		{"string enum", Field{Kind: StringType, Options: map[string]any{"enum": []any{"FR", "DE"}}}, ""},
+		{"number enum", Field{Kind: NumberType, Options: map[string]any{"enum": []any{1.0, 2.5}}}, ""},
+		{"email enum", Field{Kind: EmailType, Options: map[string]any{"enum": []any{"ada@example.com"}}}, ""},
+		{"nullable enum", Field{Kind: StringType, Options: map[string]any{"enum": []any{"FR", nil}, "nullable": true}}, ""},
+		{"number in a string enum", Field{Kind: StringType, Options: map[string]any{"enum": []any{"FR", 1.0}}}, `option "enum": value 1: expected string, got 1`},
+		{"string in a number enum", Field{Kind: NumberType, Options: map[string]any{"enum": []any{"1"}}}, `option "enum": value 0: expected number, got "1"`},
+		{"enum outside the range", Field{Kind: NumberType, Options: map[string]any{"enum": []any{1.0, 10.0}, "max": 5.0}}, `option "enum": value 1: expected a number <= 5, got 10`},
+		{"invalid email enum", Field{Kind: EmailType, Options: map[string]any{"enum": []any{"ada"}}}, `option "enum": value 0: expected email, got "ada"`},
+		{"null in an enum", Field{Kind: StringType, Options: map[string]any{"enum": []any{nil}}}, `option "enum": value 0: expected string, got null`},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			err := validateOptions(test.field)
+			if test.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || err.Error() != test.err {
+				t.Errorf("got error %v, want %s", err, test.err)
+			}
+		})
+	}
+}
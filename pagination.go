@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+type PaginationMode string
+
+const (
+	PageMode   PaginationMode = "page"   // `_page` and `_limit`
+	RangeMode  PaginationMode = "range"  // `_start` with `_end` or `_limit`
+	CursorMode PaginationMode = "cursor" // `_cursor` and `_limit`
+)
+
+const defaultLimit = 10
+
+// Window of records requested by a list route.
+// Paginate parses it from the query string, the handler fills Total and Last.
+type Pagination struct {
+	Mode   PaginationMode
+	Offset int
+	Limit  int
+	After  string // id after which a cursor page starts
+
+	Total int    // number of records matching the filters
+	Count int    // number of records in the page
+	Last  string // id of the last record of the page
+}
+
+type paginationKey struct{}
+
+// Returns the pagination of a request, or nil if the request isn't paginated
+func PaginationFrom(r *http.Request) *Pagination {
+	page, _ := r.Context().Value(paginationKey{}).(*Pagination)
+	return page
+}
+
+// Parses the pagination params of a query string, returns nil if there are none
+func ParsePagination(query url.Values) (*Pagination, error) {
+	ints := make(map[string]int)
+	for _, key := range []string{"_page", "_limit", "_start", "_end"} {
+		if !query.Has(key) {
+			continue
+		}
+		n, err := strconv.Atoi(query.Get(key))
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("%s: expected a positive integer", key)
+		}
+		ints[key] = n
+	}
+
+	limit, hasLimit := ints["_limit"]
+	if !hasLimit {
+		limit = defaultLimit
+	}
+
+	switch {
+	case query.Has("_cursor"):
+		page := &Pagination{Mode: CursorMode, Limit: limit}
+		if cursor := query.Get("_cursor"); cursor != "" {
+			after, err := decodeCursor(cursor)
+			if err != nil {
+				return nil, errors.New("_cursor: invalid cursor")
+			}
+			page.After = after
+		}
+		return page, nil
+
+	case query.Has("_start") || query.Has("_end"):
+		start := ints["_start"]
+		if end, ok := ints["_end"]; ok {
+			if end < start {
+				return nil, errors.New("_end: expected a value greater than _start")
+			}
+			limit = end - start
+		} else if !hasLimit {
+			limit = -1
+		}
+		return &Pagination{Mode: RangeMode, Offset: start, Limit: limit}, nil
+
+	case query.Has("_page") || hasLimit:
+		page := 1
+		if p, ok := ints["_page"]; ok && p > 0 {
+			page = p
+		}
+		return &Pagination{Mode: PageMode, Offset: (page - 1) * limit, Limit: limit}, nil
+	}
+
+	return nil, nil
+}
+
+// Adds the window of the page to a validator, the store stops reading at the end of the page.
+// A cursor page starts after the key of its record. The records before the page aren't counted,
+// Total is counted apart (see Store.Count).
+func (p *Pagination) Apply(v *Validtor) {
+	if p.After != "" {
+		v.after = EncodeKey(p.After)
+	}
+
+	skipped := 0
+	v.validate = append(v.validate, func([]byte) bool {
+		if skipped < p.Offset {
+			skipped++
+			return false
+		}
+		return true
+	})
+	v.terminate = append(v.terminate, func(result [][]byte) bool {
+		return p.Limit >= 0 && len(result) >= p.Limit
+	})
+}
+
+// Records the result of the page
+func (p *Pagination) Done(result [][]byte, total int) {
+	p.Total = total
+	p.Count = len(result)
+	if len(result) != 0 {
+		p.Last = recordID(result[len(result)-1])
+	}
+}
+
+// Cuts the page out of records that are already in memory, used when the records are sorted.
+// A cursor page starts after the record of the cursor, it's empty if that record is gone.
+func (p *Pagination) Slice(records []map[string]any) []map[string]any {
+	start, end := p.window(len(records), func(i int) string {
+		if records[i]["id"] == nil {
+			return ""
+		}
+		return FormatID(records[i]["id"])
+	})
+	return records[start:end]
+}
+
+// Returns the bounds of the page in a list of n records, id returns the id of the i-th record
+func (p *Pagination) window(n int, id func(i int) string) (int, int) {
+	p.Total = n
+
+	start := p.Offset
+	if p.After != "" {
+		start = n
+		for i := 0; i < n; i++ {
+			if id(i) == p.After {
+				start = i + 1
+				break
+			}
+		}
+	}
+	start = min(start, n)
+	end := n
+	if p.Limit >= 0 {
+		end = min(start+p.Limit, end)
+	}
+
+	p.Count = end - start
+	if end > start {
+		p.Last = id(end - 1)
+	}
+	return start, end
+}
+
+// Returns the RFC 8288 Link header of the page
+func (p *Pagination) Links(r *http.Request) string {
+	links := make([]string, 0, 4)
+	link := func(rel string, params map[string]string) {
+		u := *r.URL
+		query := u.Query()
+		for _, key := range []string{"_page", "_start", "_end", "_cursor"} {
+			query.Del(key)
+		}
+		for key, value := range params {
+			query.Set(key, value)
+		}
+		u.RawQuery = query.Encode()
+		u.Host = r.Host
+		u.Scheme = "http"
+		if r.TLS != nil {
+			u.Scheme = "https"
+		}
+		links = append(links, fmt.Sprintf("<%s>; rel=%q", u.String(), rel))
+	}
+
+	switch p.Mode {
+	case CursorMode:
+		if p.Limit > 0 && p.Count == p.Limit {
+			link("next", map[string]string{"_cursor": encodeCursor(p.Last)})
+		}
+
+	case PageMode:
+		if p.Limit == 0 {
+			break
+		}
+		page := p.Offset/p.Limit + 1
+		last := max(1, (p.Total+p.Limit-1)/p.Limit)
+		link("first", map[string]string{"_page": "1"})
+		if page > 1 {
+			link("prev", map[string]string{"_page": strconv.Itoa(min(page-1, last))})
+		}
+		if page < last {
+			link("next", map[string]string{"_page": strconv.Itoa(page + 1)})
+		}
+		link("last", map[string]string{"_page": strconv.Itoa(last)})
+
+	case RangeMode:
+		if p.Limit <= 0 {
+			break
+		}
+		window := func(start int) map[string]string {
+			return map[string]string{"_start": strconv.Itoa(start), "_end": strconv.Itoa(start + p.Limit)}
+		}
+		link("first", window(0))
+		if p.Offset > 0 {
+			link("prev", window(max(0, p.Offset-p.Limit)))
+		}
+		if p.Offset+p.Limit < p.Total {
+			link("next", window(p.Offset+p.Limit))
+		}
+		link("last", window(max(0, (p.Total-1)/p.Limit*p.Limit)))
+	}
+
+	return strings.Join(links, ", ")
+}
+
+// Cursors are opaque to clients, they hold the id of the last record of the previous page
+func encodeCursor(id string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(id))
+}
+
+func decodeCursor(cursor string) (string, error) {
+	id, err := base64.RawURLEncoding.DecodeString(cursor)
+	return string(id), err
+}
+
+// Returns the id of a stored record, records are stored in the order of their id
+func recordID(b []byte) string {
+	var record struct {
+		ID any `json:"id"`
+	}
+	if err := json.Unmarshal(b, &record); err != nil || record.ID == nil {
+		return ""
+	}
+	return FormatID(record.ID)
+}
+
+// Sets the pagination headers right before the response is written,
+// the handler has filled the pagination by then
+type paginationWriter struct {
+	http.ResponseWriter
+	r           *http.Request
+	page        *Pagination
+	wroteHeader bool
+}
+
+func (w *paginationWriter) WriteHeader(status int) {
+	if !w.wroteHeader && status < 300 {
+		w.Header().Set("X-Total-Count", strconv.Itoa(w.page.Total))
+		w.Header().Add("Access-Control-Expose-Headers", "X-Total-Count, Link")
+		if links := w.page.Links(w.r); links != "" {
+			w.Header().Set("Link", links)
+		}
+	}
+	w.wroteHeader = true
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *paginationWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func withPagination(r *http.Request, page *Pagination) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), paginationKey{}, page))
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParsePagination(t *testing.T) {
+	for _, test := range []struct {
+		query string
+		want  *Pagination
+		err   string
+	}{
+		{"", nil, ""},
+		{"name=ada", nil, ""},
+		{"_limit=5", &Pagination{Mode: PageMode, Limit: 5}, ""},
+		{"_page=3", &Pagination{Mode: PageMode, Offset: 20, Limit: defaultLimit}, ""},
+		{"_page=3&_limit=4", &Pagination{Mode: PageMode, Offset: 8, Limit: 4}, ""},
+		{"_page=0&_limit=4", &Pagination{Mode: PageMode, Limit: 4}, ""},
+		{"_limit=0", &Pagination{Mode: PageMode, Limit: 0}, ""},
+		{"_start=5", &Pagination{Mode: RangeMode, Offset: 5, Limit: -1}, ""},
+		{"_start=5&_end=8", &Pagination{Mode: RangeMode, Offset: 5, Limit: 3}, ""},
+		{"_start=5&_limit=2", &Pagination{Mode: RangeMode, Offset: 5, Limit: 2}, ""},
+		{"_end=4", &Pagination{Mode: RangeMode, Limit: 4}, ""},
+		{"_cursor=", &Pagination{Mode: CursorMode, Limit: defaultLimit}, ""},
+		{"_cursor=" + encodeCursor("12") + "&_limit=3", &Pagination{Mode: CursorMode, Limit: 3, After: "12"}, ""},
+		{"_limit=-1", nil, "_limit: expected a positive integer"},
+		{"_page=x", nil, "_page: expected a positive integer"},
+		{"_start=5&_end=2", nil, "_end: expected a value greater than _start"},
+		{"_cursor=%25%25", nil, "_cursor: invalid cursor"},
+	} {
+		t.Run(test.query, func(t *testing.T) {
+			values, _ := url.ParseQuery(test.query)
+			got, err := ParsePagination(values)
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Fatalf("got error %v, want %s", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+// Apply reads a page from a store and Slice cuts it from records in memory, both must agree
+func TestPaginationWindow(t *testing.T) {
+	records := make([]map[string]any, 0, 7)
+	for i := 1; i <= 7; i++ {
+		records = append(records, map[string]any{"id": float64(i)})
+	}
+	tests := []struct {
+		query string
+		want  []string
+		total int
+		reads int // records read by the store
+	}{
+		{"_limit=3", []string{"1", "2", "3"}, 7, 3},
+		{"_page=3&_limit=3", []string{"7"}, 7, 7},
+		{"_page=4&_limit=3", []string{}, 7, 7},
+		{"_limit=0", []string{}, 7, 0},
+		{"_start=2&_limit=0", []string{}, 7, 0},
+		{"_start=2&_end=4", []string{"3", "4"}, 7, 4},
+		{"_start=5", []string{"6", "7"}, 7, 7},
+		{"_cursor=" + encodeCursor("2") + "&_limit=2", []string{"3", "4"}, 7, 2},
+		{"_cursor=" + encodeCursor("6") + "&_limit=2", []string{"7"}, 7, 1},
+		{"_cursor=&_limit=0", []string{}, 7, 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.query, func(t *testing.T) {
+			values, _ := url.ParseQuery(test.query)
+			page, err := ParsePagination(values)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make([]string, 0)
+			for _, r := range page.Slice(records) {
+				got = append(got, FormatID(r["id"]))
+			}
+			if !reflect.DeepEqual(got, test.want) || page.Total != test.total {
+				t.Errorf("Slice: got %v of %d, want %v of %d", got, page.Total, test.want, test.total)
+			}
+		})
+	}
+
+	forEachStore(t, func(t *testing.T, db Store) {
+		for i := 1; i <= 7; i++ {
+			mustSet(t, db, "users", fmt.Sprint(i), record(i, "even", i%2 == 0))
+		}
+
+		for _, test := range tests {
+			values, _ := url.ParseQuery(test.query)
+			page, _ := ParsePagination(values)
+			reads := 0
+			v := &Validtor{validate: []func([]byte) bool{func([]byte) bool { reads++; return true }}}
+			page.Apply(v)
+			res, err := db.GetAll("users", v)
+			if err != nil {
+				t.Fatal(err)
+			}
+			total, err := CountRecords(db, "users", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			page.Done(res, total)
+			if got := ids(t, res); !reflect.DeepEqual(got, test.want) || page.Total != test.total {
+				t.Errorf("Apply %s: got %v of %d, want %v of %d", test.query, got, page.Total, test.want, test.total)
+			}
+			// The store stops at the end of the page and a cursor page starts after its record
+			if reads != test.reads {
+				t.Errorf("Apply %s: %d records read, want %d", test.query, reads, test.reads)
+			}
+		}
+
+		// The total only counts the records matching the filters, before the cursor too
+		filters := []Filter{{Field: "even", Values: []string{"true"}}}
+		page := &Pagination{Mode: CursorMode, Limit: 1, After: "2"}
+		v := FilterValidator(filters)
+		page.Apply(v)
+		res, err := db.GetAll("users", v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		total, err := CountRecords(db, "users", filters)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := ids(t, res); !reflect.DeepEqual(got, []string{"4"}) || total != 3 {
+			t.Errorf("filtered: got %v of %d, want [4] of 3", got, total)
+		}
+	})
+}
+
+func TestPaginationLinks(t *testing.T) {
+	link := func(query string, rel string) string {
+		return fmt.Sprintf("<http://localhost/users?%s&name=ada>; rel=%q", query, rel)
+	}
+	for _, test := range []struct {
+		name string
+		page Pagination
+		want []string
+	}{
+		{"first page", Pagination{Mode: PageMode, Limit: 10, Total: 25},
+			[]string{link("_page=1", "first"), link("_page=2", "next"), link("_page=3", "last")}},
+		{"middle page", Pagination{Mode: PageMode, Offset: 10, Limit: 10, Total: 25},
+			[]string{link("_page=1", "first"), link("_page=1", "prev"), link("_page=3", "next"), link("_page=3", "last")}},
+		{"empty list", Pagination{Mode: PageMode, Limit: 10},
+			[]string{link("_page=1", "first"), link("_page=1", "last")}},
+		{"no limit", Pagination{Mode: PageMode, Total: 25}, nil},
+		{"range", Pagination{Mode: RangeMode, Offset: 5, Limit: 5, Total: 12},
+			[]string{link("_end=5&_start=0", "first"), link("_end=5&_start=0", "prev"), link("_end=15&_start=10", "next"), link("_end=15&_start=10", "last")}},
+		{"open range", Pagination{Mode: RangeMode, Offset: 5, Limit: -1, Total: 12}, nil},
+		{"full cursor page", Pagination{Mode: CursorMode, Limit: 2, Count: 2, Last: "4"},
+			[]string{link("_cursor="+encodeCursor("4"), "next")}},
+		{"last cursor page", Pagination{Mode: CursorMode, Limit: 2, Count: 1, Last: "5"}, nil},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "http://localhost/users?name=ada&_page=2", nil)
+			var want string
+			if test.want != nil {
+				want = strings.Join(test.want, ", ")
+			}
+			if got := test.page.Links(r); got != want {
+				t.Errorf("got %s, want %s", got, want)
+			}
+		})
+	}
+}
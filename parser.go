@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -9,6 +10,7 @@ import (
 	"os"
 	"reflect"
 	"slices"
+	"strings"
 
 	"github.com/fsnotify/fsnotify"
 )
@@ -17,34 +19,77 @@ type Field struct {
 	Name    string         `json:"name"`
 	Kind    FieldType      `json:"type"`
 	Options map[string]any `json:"options"`
+	Schema  []Field        `json:"schema,omitempty"` // Fields of an object
+	Items   *Field         `json:"items,omitempty"`  // Type of the elements of an array
 }
 
 type Entity struct {
-	Name   string  `json:"name"`
-	Count  int     `json:"count"`
-	Schema []Field `json:"schema"`
+	Name       string         `json:"name"`
+	Count      int            `json:"count"`
+	Seed       int64          `json:"seed,omitempty"`       // Makes the generated data reproducible, 0 is random
+	Validation ValidationMode `json:"validation,omitempty"` // Overrides the server's validation of request bodies
+	IDStrategy IDStrategy     `json:"idStrategy,omitempty"` // How ids are minted, uuid by default
+	Schema     []Field        `json:"schema"`
+}
+
+// Schema file with settings shared by every entity
+type schemaFile struct {
+	Seed     int64    `json:"seed"`
+	Entities []Entity `json:"entities"`
 }
 
 type FieldType string
 
 const (
 	StringType    FieldType = "string"
-	NumberType              = "number"
-	BooleanType             = "bool"
-	NameType                = "name"
-	UsernameType            = "username"
-	FullnameType            = "fullname"
-	EmailType               = "email"
-	DateType                = "date"
-	UrlType                 = "url"
-	IpType                  = "ip"
-	UuidType                = "uuid"
-	IdType                  = "id"
-	AddressType             = "address,addr"
-	PhoneType               = "phone"
-	ParagraphType           = "paragraph,pg"
+	NumberType    FieldType = "number"
+	BooleanType   FieldType = "bool"
+	NameType      FieldType = "name"
+	UsernameType  FieldType = "username"
+	FullnameType  FieldType = "fullname"
+	EmailType     FieldType = "email"
+	DateType      FieldType = "date"
+	UrlType       FieldType = "url"
+	IpType        FieldType = "ip"
+	UuidType      FieldType = "uuid"
+	IdType        FieldType = "id"
+	AddressType   FieldType = "address"
+	PhoneType     FieldType = "phone"
+	ParagraphType FieldType = "paragraph"
+	RefType       FieldType = "ref"
+	ObjectType    FieldType = "object"
+	ArrayType     FieldType = "array"
 )
 
+// Short names accepted in the schema file
+var fieldAliases = map[FieldType]FieldType{
+	"str":  StringType,
+	"num":  NumberType,
+	"addr": AddressType,
+	"pg":   ParagraphType,
+}
+
+var fieldTypes = []FieldType{
+	StringType,
+	NumberType,
+	BooleanType,
+	NameType,
+	UsernameType,
+	FullnameType,
+	EmailType,
+	DateType,
+	UrlType,
+	IpType,
+	UuidType,
+	IdType,
+	AddressType,
+	PhoneType,
+	ParagraphType,
+	RefType,
+	ObjectType,
+	ArrayType,
+}
+
 // Initializes a file watcher and returns the path to the file and the watcher
 // If the path is a url, it downloads the file and returns the path to the downloaded file
 func initFile(path string) (string, *fsnotify.Watcher) {
@@ -56,7 +101,7 @@ func initFile(path string) (string, *fsnotify.Watcher) {
 
 func downloadFile(path string) {
 	u, err := url.ParseRequestURI(path)
-	if err == nil {
+	if err == nil && (u.Scheme == "http" || u.Scheme == "https") {
 		resp, err := http.Get(u.String())
 		if err != nil {
 			ErrExit("Couldn't Download File", err)
@@ -78,28 +123,248 @@ func ParseFile(path string) ([]Entity, error) {
 	}
 	defer file.Close()
 
+	// The schema is either a list of entities or an object with a list of entities and shared settings
 	decoder := json.NewDecoder(file)
-	var entities []Entity
-	err = decoder.Decode(&entities)
+	var raw json.RawMessage
+	err = decoder.Decode(&raw)
 	if err != nil {
 		return nil, err
 	}
+
+	var schema schemaFile
+	if raw = bytes.TrimSpace(raw); len(raw) > 0 && raw[0] == '{' {
+		err = json.Unmarshal(raw, &schema)
+	} else {
+		err = json.Unmarshal(raw, &schema.Entities)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	entities := schema.Entities
 	for i, entity := range entities {
 		if entity.Count == 0 {
 			entities[i].Count = 1
 		}
-		for j, field := range entity.Schema {
-			if field.Kind == "" {
-				entities[i].Schema[j].Kind = StringType
-			}
-			if reflect.TypeOf(field.Kind).Name() != "FieldType" {
-				fmt.Println("Invalid Type: ", field.Kind)
+		if entity.Seed == 0 {
+			entities[i].Seed = schema.Seed
+		}
+		if entity.Validation != "" && !slices.Contains(validationModes, entity.Validation) {
+			return nil, fmt.Errorf("%s: unknown validation mode %q", entity.Name, entity.Validation)
+		}
+		for j := range entity.Schema {
+			field := &entities[i].Schema[j]
+			if err := parseField(field, entity.Name+"."+field.Name); err != nil {
+				return nil, err
 			}
 		}
+		if err := validateIDStrategy(entity); err != nil {
+			return nil, err
+		}
+		if err := validateIndexes(entity); err != nil {
+			return nil, err
+		}
+	}
+
+	_, err = DependencyLevels(entities)
+	if err != nil {
+		return nil, err
 	}
 	return entities, nil
 }
 
+// Overrides the seed of every entity
+func SetSeed(entities []Entity, seed int64) {
+	for i := range entities {
+		entities[i].Seed = seed
+	}
+}
+
+// Normalizes the type of a field and its sub-fields and validates their options.
+// A type ending with `[]` is a shorthand for an array of that type.
+func parseField(f *Field, path string) error {
+	if f.Kind == "" {
+		f.Kind = StringType
+	}
+	if strings.HasSuffix(string(f.Kind), "[]") {
+		f.Items = &Field{Kind: f.Kind[:len(f.Kind)-2]}
+		f.Kind = ArrayType
+	}
+	if alias, ok := fieldAliases[f.Kind]; ok {
+		f.Kind = alias
+	}
+	if !slices.Contains(fieldTypes, f.Kind) {
+		return fmt.Errorf("%s: unknown field type %q", path, f.Kind)
+	}
+
+	switch f.Kind {
+	case ObjectType:
+		if len(f.Schema) == 0 || f.Items != nil {
+			return fmt.Errorf("%s: object fields need a schema and no items", path)
+		}
+		for i := range f.Schema {
+			if err := parseField(&f.Schema[i], path+"."+f.Schema[i].Name); err != nil {
+				return err
+			}
+		}
+	case ArrayType:
+		if f.Items == nil || f.Schema != nil {
+			return fmt.Errorf("%s: array fields need items and no schema", path)
+		}
+		if err := parseField(f.Items, path+"[]"); err != nil {
+			return err
+		}
+	default:
+		if f.Schema != nil || f.Items != nil {
+			return fmt.Errorf("%s: only object fields have a schema and only array fields have items", path)
+		}
+	}
+
+	if err := validateOptions(*f); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+// Calls fn for every field, the fields of objects and the items of arrays included
+func walkFields(fields []Field, path string, fn func(f Field, path string) error) error {
+	for _, f := range fields {
+		if err := walkField(f, path+f.Name, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func walkField(f Field, path string, fn func(f Field, path string) error) error {
+	if err := fn(f, path); err != nil {
+		return err
+	}
+	if f.Items != nil {
+		return walkField(*f.Items, path+"[]", fn)
+	}
+	return walkFields(f.Schema, path+".", fn)
+}
+
+// Returns the field at a dotted path, array items are looked through
+func schemaField(fields []Field, path []string) (Field, bool) {
+	for _, f := range fields {
+		if f.Name != path[0] {
+			continue
+		}
+		for f.Items != nil {
+			f = *f.Items
+		}
+		if len(path) == 1 {
+			return f, true
+		}
+		return schemaField(f.Schema, path[1:])
+	}
+	return Field{}, false
+}
+
+// Returns the name of the entity referenced by a `ref` field
+func refEntity(f Field) string {
+	name, _ := f.Options["entity"].(string)
+	return name
+}
+
+// Returns true if a ref field can be left empty, a nullable ref or a `many` ref
+func optionalRef(f Field) bool {
+	many, _ := f.Options["many"].(bool)
+	return many || isNullable(f)
+}
+
+// Groups entities so that every entity only references entities of the previous groups.
+// Entities of the same group don't depend on each other and can be generated concurrently.
+// An entity can reference itself with an optional ref, its records reference the ones generated before them.
+// Returns an error if a reference points to an unknown entity or if references form a cycle.
+func DependencyLevels(entities []Entity) ([][]Entity, error) {
+	deps := make(map[string][]string, len(entities))
+	for _, entity := range entities {
+		deps[entity.Name] = make([]string, 0)
+	}
+	for _, entity := range entities {
+		err := walkFields(entity.Schema, entity.Name+".", func(field Field, path string) error {
+			if field.Kind != RefType {
+				return nil
+			}
+			target := refEntity(field)
+			if target == "" {
+				return fmt.Errorf("%s: ref fields need an \"entity\" option", path)
+			}
+			if _, ok := deps[target]; !ok {
+				return fmt.Errorf("%s: unknown entity %q", path, target)
+			}
+			if target == entity.Name {
+				if !optionalRef(field) {
+					return fmt.Errorf("%s: a reference to its own entity must be nullable or many, the first record has nothing to reference", path)
+				}
+				return nil
+			}
+			if !slices.Contains(deps[entity.Name], target) {
+				deps[entity.Name] = append(deps[entity.Name], target)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	levels := make([][]Entity, 0)
+	done := make(map[string]bool, len(entities))
+	for len(done) < len(entities) {
+		level := make([]Entity, 0)
+		for _, entity := range entities {
+			if done[entity.Name] {
+				continue
+			}
+			ready := !slices.ContainsFunc(deps[entity.Name], func(dep string) bool {
+				return !done[dep]
+			})
+			if ready {
+				level = append(level, entity)
+			}
+		}
+
+		if len(level) == 0 {
+			return nil, fmt.Errorf("circular references: %s", findCycle(deps, done))
+		}
+		for _, entity := range level {
+			done[entity.Name] = true
+		}
+		levels = append(levels, level)
+	}
+	return levels, nil
+}
+
+// Follows the references of the remaining entities until one comes back
+func findCycle(deps map[string][]string, done map[string]bool) string {
+	var start string
+	for name := range deps {
+		if !done[name] && (start == "" || name < start) {
+			start = name
+		}
+	}
+
+	path := []string{start}
+	for {
+		last := path[len(path)-1]
+		var next string
+		for _, dep := range deps[last] {
+			if !done[dep] {
+				next = dep
+				break
+			}
+		}
+		if i := slices.Index(path, next); i != -1 {
+			return strings.Join(append(path[i:], next), " -> ")
+		}
+		path = append(path, next)
+	}
+}
+
 func ValidateSchema(entities []Entity, prevSchema []Entity) bool {
 	if len(entities) != len(prevSchema) {
 		return false
@@ -114,7 +379,10 @@ func ValidateSchema(entities []Entity, prevSchema []Entity) bool {
 		}
 
 		if !(reflect.DeepEqual(entity.Schema, prevSchema[index].Schema) &&
-			entity.Count == prevSchema[index].Count) {
+			entity.Count == prevSchema[index].Count &&
+			entity.Seed == prevSchema[index].Seed &&
+			entity.Validation == prevSchema[index].Validation &&
+			entity.IDStrategy == prevSchema[index].IDStrategy) {
 			return false
 		}
 	}
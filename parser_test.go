@@ -0,0 +1,83 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDependencyLevels(t *testing.T) {
+	ref := func(name string, entity string, options ...any) Field {
+		f := Field{Name: name, Kind: RefType, Options: map[string]any{"entity": entity}}
+		for i := 0; i+1 < len(options); i += 2 {
+			f.Options[options[i].(string)] = options[i+1]
+		}
+		return f
+	}
+	entity := func(name string, fields ...Field) Entity {
+		return Entity{Name: name, Schema: fields}
+	}
+
+	for _, test := range []struct {
+		name     string
+		entities []Entity
+		want     [][]string
+		err      string
+	}{
+		{"no refs", []Entity{entity("users"), entity("tags")}, [][]string{{"users", "tags"}}, ""},
+		{"chain", []Entity{
+			entity("comments", ref("post", "posts"), ref("author", "users")),
+			entity("posts", ref("author", "users")),
+			entity("users"),
+		}, [][]string{{"users"}, {"posts"}, {"comments"}}, ""},
+		{"nested ref", []Entity{
+			entity("orders", Field{Name: "lines", Kind: ArrayType, Items: &Field{Kind: ObjectType, Schema: []Field{ref("product", "products")}}}),
+			entity("products"),
+		}, [][]string{{"products"}, {"orders"}}, ""},
+		{"nullable self ref", []Entity{
+			entity("employees", ref("manager", "employees", "nullable", true), ref("team", "teams")),
+			entity("teams"),
+		}, [][]string{{"teams"}, {"employees"}}, ""},
+		{"many self ref", []Entity{entity("users", ref("friends", "users", "many", true))}, [][]string{{"users"}}, ""},
+		{"required self ref", []Entity{entity("employees", ref("manager", "employees"))}, nil,
+			"employees.manager: a reference to its own entity must be nullable or many, the first record has nothing to reference"},
+		{"never null self ref", []Entity{entity("employees", ref("manager", "employees", "nullable", false))}, nil,
+			"employees.manager: a reference to its own entity must be nullable or many, the first record has nothing to reference"},
+		{"cycle", []Entity{
+			entity("a", ref("b", "b")),
+			entity("b", ref("c", "c")),
+			entity("c", ref("a", "a")),
+			entity("d"),
+		}, nil, "circular references: a -> b -> c -> a"},
+		// Only references to the entity itself can be optional, a nullable ref between two entities still orders them
+		{"nullable cycle", []Entity{
+			entity("a", ref("b", "b", "nullable", true)),
+			entity("b", ref("a", "a")),
+		}, nil, "circular references: a -> b -> a"},
+		{"unknown entity", []Entity{entity("posts", ref("author", "authors"))}, nil, `posts.author: unknown entity "authors"`},
+		{"missing entity option", []Entity{entity("posts", Field{Name: "author", Kind: RefType})}, nil, `posts.author: ref fields need an "entity" option`},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			levels, err := DependencyLevels(test.entities)
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Fatalf("got error %v, want %s", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make([][]string, 0, len(levels))
+			for _, level := range levels {
+				names := make([]string, 0, len(level))
+				for _, e := range level {
+					names = append(names, e.Name)
+				}
+				got = append(got, names)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+)
+
+// Fields kept in a response, taken from `?_fields=id,name,address.city`.
+// Each level maps a field name to the fields kept inside it, an empty level keeps the whole value.
+type Projection map[string]Projection
+
+// Parses the projection of a query string, returns nil if every field is kept
+func ParseProjection(query url.Values) (Projection, error) {
+	if !query.Has("_fields") {
+		return nil, nil
+	}
+
+	projection := make(Projection)
+	for _, param := range query["_fields"] {
+		for _, name := range strings.Split(param, ",") {
+			name = strings.TrimSpace(name)
+			if name == "" || strings.HasPrefix(name, ".") || strings.HasSuffix(name, ".") {
+				return nil, errors.New("_fields: invalid field name")
+			}
+
+			level := projection
+			for _, part := range strings.Split(name, ".") {
+				sub, ok := level[part]
+				if !ok {
+					sub = make(Projection)
+					level[part] = sub
+				}
+				level = sub
+			}
+		}
+	}
+	return projection, nil
+}
+
+// Returns a copy of the record with only the projected fields
+func (p Projection) Apply(record map[string]any) map[string]any {
+	res := make(map[string]any, len(p))
+	for name, sub := range p {
+		v, ok := record[name]
+		if !ok {
+			continue
+		}
+		if len(sub) == 0 {
+			res[name] = v
+		} else if v, ok := sub.value(v); ok {
+			res[name] = v
+		}
+	}
+	return res
+}
+
+// Projects the fields of an object, or of every object in a list
+func (p Projection) value(v any) (any, bool) {
+	switch v := v.(type) {
+	case map[string]any:
+		return p.Apply(v), true
+	case []any:
+		list := make([]any, 0, len(v))
+		for _, item := range v {
+			if item, ok := p.value(item); ok {
+				list = append(list, item)
+			}
+		}
+		return list, true
+	case nil:
+		return nil, true
+	}
+	return nil, false
+}
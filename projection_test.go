@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestProjection(t *testing.T) {
+	doc := record(1, "name", "ada", "address", map[string]any{"city": "Paris", "zip": "75001"},
+		"lines", []any{map[string]any{"sku": "a", "qty": 1}, map[string]any{"sku": "b"}, "loose"},
+		"tags", []any{"x", "y"}, "manager", nil)
+	for _, test := range []struct {
+		fields string
+		want   string
+	}{
+		{"name", `{"name":"ada"}`},
+		{"id,name", `{"id":1,"name":"ada"}`},
+		{"name, id", `{"id":1,"name":"ada"}`},
+		{"address.city", `{"address":{"city":"Paris"}}`},
+		{"address.city,address", `{"address":{"city":"Paris"}}`},
+		{"address.country", `{"address":{}}`},
+		// Lists of objects are projected item by item, other items are dropped
+		{"lines.sku", `{"lines":[{"sku":"a"},{"sku":"b"}]}`},
+		{"tags", `{"tags":["x","y"]}`},
+		{"tags.x", `{"tags":[]}`},
+		{"name.first", `{}`},
+		{"manager.name", `{"manager":null}`},
+		{"missing", `{}`},
+	} {
+		t.Run(test.fields, func(t *testing.T) {
+			p, err := ParseProjection(url.Values{"_fields": {test.fields}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := decode(t, doc)
+			if b := encode(t, p.Apply(got)); !jsonEqual(t, b, test.want) {
+				t.Errorf("got %s, want %s", b, test.want)
+			}
+		})
+	}
+
+	for _, fields := range []string{"", "name,", ".name", "address."} {
+		if _, err := ParseProjection(url.Values{"_fields": {fields}}); err == nil || err.Error() != "_fields: invalid field name" {
+			t.Errorf("%q: got error %v", fields, err)
+		}
+	}
+}
+
+func TestProjectionHandler(t *testing.T) {
+	h := testServer(t, NewMemDB(), []Entity{products}, map[string][][]byte{"products": productRecords})
+	for _, test := range []struct {
+		path string
+		want string
+	}{
+		{"/products/1?_fields=id,details.weight", `{"id":1,"details":{"weight":3}}`},
+		{"/products/3?_fields=name,details.weight", `{"name":"c"}`},
+		// The list is sorted on a field that isn't projected, then projected
+		{"/products?_fields=name&_sort=-price&_limit=3", `[{"name":"c"},{"name":"a"},{"name":"b"}]`},
+		{"/products?_fields=id&price_gte=20", `[{"id":3},{"id":4}]`},
+	} {
+		w := serve(h, "GET", test.path, "")
+		if w.Code != 200 || !jsonEqual(t, w.Body.Bytes(), test.want) {
+			t.Errorf("%s: got %d %s, want %s", test.path, w.Code, w.Body, test.want)
+		}
+	}
+
+	// The validators describe the projected response
+	full, projected := serve(h, "GET", "/products/1", ""), serve(h, "GET", "/products/1?_fields=name", "")
+	if full.Header().Get("Etag") == projected.Header().Get("Etag") {
+		t.Error("the projected record has the ETag of the full record")
+	}
+	if w := serve(h, "GET", "/products?_fields=name,", ""); w.Code != 400 {
+		t.Errorf("invalid _fields: got %d, want 400", w.Code)
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// Related records inlined in a response.
+// `?_expand=author` replaces the reference of a record by the record it points to,
+// `?_embed=posts` adds the records of another entity that reference the record.
+// Dotted names follow relations of the related records: `?_expand=post.author`.
+type Relation struct {
+	Name   string // key of the inlined records
+	Embed  bool
+	Entity string // entity of the related records
+	Field  Field  // ref field holding the relation, in the record when expanding and in the related records when embedding
+	Next   []Relation
+}
+
+// How deep relations can be followed, `a.b.c` is 3 levels deep
+const maxRelationDepth = 3
+
+// Parses the relations of a query string
+func ParseRelations(query url.Values, entities []Entity, entity Entity) ([]Relation, error) {
+	relations := make([]Relation, 0)
+	for _, param := range []string{"_expand", "_embed"} {
+		for _, value := range query[param] {
+			for _, name := range strings.Split(value, ",") {
+				path := strings.Split(strings.TrimSpace(name), ".")
+				if len(path) > maxRelationDepth {
+					return nil, fmt.Errorf("%s: %s is more than %d levels deep", param, name, maxRelationDepth)
+				}
+				var err error
+				relations, err = addRelation(relations, path, param == "_embed", entities, entity)
+				if err != nil {
+					return nil, fmt.Errorf("%s: %w", param, err)
+				}
+			}
+		}
+	}
+	if len(relations) == 0 {
+		return nil, nil
+	}
+	return relations, nil
+}
+
+// Adds the relations along a path to a tree of relations, relations already in the tree are reused
+func addRelation(relations []Relation, path []string, embed bool, entities []Entity, entity Entity) ([]Relation, error) {
+	if len(path) == 0 {
+		return relations, nil
+	}
+
+	i := slices.IndexFunc(relations, func(rel Relation) bool {
+		return rel.Name == path[0] && rel.Embed == embed
+	})
+	if i == -1 {
+		rel, err := findRelation(path[0], embed, entities, entity)
+		if err != nil {
+			return nil, err
+		}
+		relations = append(relations, rel)
+		i = len(relations) - 1
+	}
+
+	next := slices.IndexFunc(entities, func(e Entity) bool { return e.Name == relations[i].Entity })
+	var err error
+	relations[i].Next, err = addRelation(relations[i].Next, path[1:], embed, entities, entities[next])
+	return relations, err
+}
+
+// Finds the ref field behind a relation.
+// An expanded name is a ref field of the entity, with or without its `Id` or `_id` suffix.
+// An embedded name is an entity with a ref field pointing to the entity.
+func findRelation(name string, embed bool, entities []Entity, entity Entity) (Relation, error) {
+	if name == "" {
+		return Relation{}, errors.New("empty relation name")
+	}
+
+	if !embed {
+		for _, f := range entity.Schema {
+			if f.Kind == RefType && slices.Contains([]string{name, name + "Id", name + "_id"}, f.Name) {
+				return Relation{Name: name, Entity: refEntity(f), Field: f}, nil
+			}
+		}
+		return Relation{}, fmt.Errorf("%s has no reference named %q", entity.Name, name)
+	}
+
+	for _, child := range entities {
+		if child.Name != name {
+			continue
+		}
+		for _, f := range child.Schema {
+			if f.Kind == RefType && refEntity(f) == entity.Name {
+				return Relation{Name: name, Embed: true, Entity: child.Name, Field: f}, nil
+			}
+		}
+	}
+	return Relation{}, fmt.Errorf("no entity named %q references %s", name, entity.Name)
+}
+
+// Inlines the related records in the records, following nested relations.
+// Dangling references are expanded to null.
+func ResolveRelations(db Store, records []map[string]any, relations []Relation) error {
+	for _, rel := range relations {
+		var err error
+		if rel.Embed {
+			err = embedRelation(db, records, rel)
+		} else {
+			err = expandRelation(db, records, rel)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func expandRelation(db Store, records []map[string]any, rel Relation) error {
+	related := make(map[string]map[string]any)
+	for _, record := range records {
+		for _, id := range refIDs(record[rel.Field.Name]) {
+			if _, ok := related[id]; ok {
+				continue
+			}
+			b, err := db.Get(rel.Entity, []byte(id))
+			if errors.Is(err, ErrNotFound) {
+				related[id] = nil
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			var value map[string]any
+			if err := json.Unmarshal(b, &value); err != nil {
+				return err
+			}
+			related[id] = value
+		}
+	}
+
+	list := make([]map[string]any, 0, len(related))
+	for _, value := range related {
+		if value != nil {
+			list = append(list, value)
+		}
+	}
+	if err := ResolveRelations(db, list, rel.Next); err != nil {
+		return err
+	}
+
+	for _, record := range records {
+		switch v := record[rel.Field.Name].(type) {
+		case []any:
+			values := make([]any, 0, len(v))
+			for _, id := range refIDs(v) {
+				values = append(values, related[id])
+			}
+			record[rel.Name] = values
+		case nil:
+			record[rel.Name] = nil
+		default:
+			record[rel.Name] = related[FormatID(v)]
+		}
+	}
+	return nil
+}
+
+func embedRelation(db Store, records []map[string]any, rel Relation) error {
+	ids := make(map[string]bool, len(records))
+	for _, record := range records {
+		if record["id"] != nil {
+			ids[FormatID(record["id"])] = true
+		}
+	}
+
+	// Children are read in a single pass and grouped by the parent they reference
+	children := make(map[string][]any)
+	all := make([]map[string]any, 0)
+	validator := &Validtor{}
+	validator.validate = append(validator.validate, func(b []byte) bool {
+		var child map[string]any
+		if err := json.Unmarshal(b, &child); err != nil {
+			return false
+		}
+		matched := false
+		for _, id := range refIDs(child[rel.Field.Name]) {
+			if ids[id] {
+				children[id] = append(children[id], child)
+				matched = true
+			}
+		}
+		if matched {
+			all = append(all, child)
+		}
+		return false
+	})
+	if _, err := db.GetAll(rel.Entity, validator); err != nil {
+		return err
+	}
+
+	if err := ResolveRelations(db, all, rel.Next); err != nil {
+		return err
+	}
+
+	for _, record := range records {
+		list := children[FormatID(record["id"])]
+		if list == nil {
+			list = make([]any, 0)
+		}
+		record[rel.Name] = list
+	}
+	return nil
+}
+
+// Returns the ids held by a ref field, a single id or a list of ids
+func refIDs(value any) []string {
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case []any:
+		ids := make([]string, 0, len(v))
+		for _, id := range v {
+			if id != nil {
+				ids = append(ids, FormatID(id))
+			}
+		}
+		return ids
+	}
+	return []string{FormatID(value)}
+}
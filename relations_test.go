@@ -0,0 +1,81 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestRelationsHandler(t *testing.T) {
+	ref := func(name, entity string, many bool) Field {
+		return Field{Name: name, Kind: RefType, Options: map[string]any{"entity": entity, "many": many}}
+	}
+	entities := []Entity{
+		{Name: "companies", Schema: []Field{{Name: "name", Kind: StringType}}},
+		{Name: "users", Schema: []Field{{Name: "name", Kind: StringType}, ref("company", "companies", false)}},
+		{Name: "tags", Schema: []Field{{Name: "label", Kind: StringType}}},
+		{Name: "posts", Schema: []Field{{Name: "title", Kind: StringType}, ref("authorId", "users", false), ref("tags", "tags", true)}},
+		{Name: "comments", Schema: []Field{{Name: "text", Kind: StringType}, ref("post_id", "posts", false)}},
+	}
+	h := testServer(t, NewMemDB(), entities, map[string][][]byte{
+		"companies": {record(1, "name", "acme")},
+		"users":     {record(1, "name", "ada", "company", 1), record(2, "name", "grace", "company", 9)},
+		"tags":      {record(1, "label", "go"), record(2, "label", "db")},
+		"posts": {
+			record(1, "title", "hello", "authorId", 1, "tags", []any{2, 1}),
+			record(2, "title", "again", "authorId", 1, "tags", []any{}),
+			record(3, "title", "orphan", "authorId", 7, "tags", []any{1, 5}),
+			record(4, "title", "grace", "authorId", 2, "tags", nil),
+		},
+		"comments": {record(1, "text", "first", "post_id", 2), record(2, "text", "second", "post_id", 1), record(3, "text", "third", "post_id", 2)},
+	})
+
+	for _, test := range []struct {
+		path string
+		want string
+	}{
+		// The ref field is kept, the related record is set under the name of the relation
+		{"/posts/1?_expand=authorId", `{"id":1,"title":"hello","authorId":{"id":1,"name":"ada","company":1},"tags":[2,1]}`},
+		{"/posts/1?_expand=author", `{"id":1,"title":"hello","authorId":1,"author":{"id":1,"name":"ada","company":1},"tags":[2,1]}`},
+		// Lists of references keep their order, dangling references are null
+		{"/posts/3?_expand=author,tags", `{"id":3,"title":"orphan","authorId":7,"author":null,"tags":[{"id":1,"label":"go"},null]}`},
+		{"/posts/4?_expand=tags", `{"id":4,"title":"grace","authorId":2,"tags":null}`},
+		{"/posts?_expand=tags&_fields=id,tags.label&id_lte=2", `[{"id":1,"tags":[{"label":"db"},{"label":"go"}]},{"id":2,"tags":[]}]`},
+		// Nested relations
+		{"/posts/4?_expand=author.company&_fields=author", `{"author":{"id":2,"name":"grace","company":null}}`},
+		{"/comments/2?_expand=post.author.company&_fields=post.author.company.name", `{"post":{"author":{"company":{"name":"acme"}}}}`},
+		// Embedded children are listed in the order of their ids, records without children get an empty list
+		{"/users/1?_embed=posts&_fields=id,posts.id", `{"id":1,"posts":[{"id":1},{"id":2}]}`},
+		{"/users?_embed=posts&_fields=id,posts.title", `[{"id":1,"posts":[{"title":"hello"},{"title":"again"}]},{"id":2,"posts":[{"title":"grace"}]}]`},
+		{"/tags/2?_embed=posts&_fields=posts.id", `{"posts":[{"id":1}]}`},
+		{"/companies/1?_embed=users.posts.comments&_fields=users.posts.comments.text",
+			`{"users":[{"posts":[{"comments":[{"text":"second"}]},{"comments":[{"text":"first"},{"text":"third"}]}]}]}`},
+		{"/posts/2?_embed=comments&_expand=author&_fields=author.name,comments.id", `{"author":{"name":"ada"},"comments":[{"id":1},{"id":3}]}`},
+		// Relations also apply to the lists of nested routes
+		{"/users/1/posts?_expand=author&_fields=id,author.name", `[{"id":1,"author":{"name":"ada"}},{"id":2,"author":{"name":"ada"}}]`},
+	} {
+		w := serve(h, "GET", test.path, "")
+		if w.Code != 200 || !jsonEqual(t, w.Body.Bytes(), test.want) {
+			t.Errorf("%s: got %d %s, want %s", test.path, w.Code, w.Body, test.want)
+		}
+	}
+
+	for _, test := range []struct {
+		path string
+		err  string
+	}{
+		{"/posts?_expand=editor", `_expand: posts has no reference named "editor"`},
+		{"/posts?_expand=title", `_expand: posts has no reference named "title"`},
+		{"/users?_embed=tags", `_embed: no entity named "tags" references users`},
+		{"/users?_embed=posts.editors", `_embed: no entity named "editors" references posts`},
+		{"/posts?_expand=", "_expand: empty relation name"},
+		{"/companies?_embed=users.posts.comments.post", "_embed: users.posts.comments.post is more than 3 levels deep"},
+	} {
+		w := serve(h, "GET", test.path, "")
+		if w.Code != 400 {
+			t.Errorf("%s: got %d %s, want 400", test.path, w.Code, w.Body)
+			continue
+		}
+		if problem := decode(t, w.Body.Bytes()); problem["detail"] != test.err {
+			t.Errorf("%s: got %v, want %s", test.path, problem["detail"], test.err)
+		}
+	}
+}
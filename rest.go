@@ -3,24 +3,33 @@ package main
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"html/template"
 	"io"
+	"log"
 	"log/slog"
+	"mime"
 	"net/http"
-	"reflect"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/go-chi/httplog/v2"
 	"github.com/go-chi/render"
-	"github.com/go-faker/faker/v4"
 )
 
 type RestSever struct {
-	db       Store
-	mux      *chi.Mux
-	entities []Entity
+	db         Store
+	mux        *chi.Mux
+	entities   []Entity
+	validation ValidationMode
+	modTimes   *modTimes
+	search     *searchIndex
 }
 
 func NewRestServer(db Store, entities []Entity, options ...func(*RestSever)) *RestSever {
@@ -30,29 +39,78 @@ func NewRestServer(db Store, entities []Entity, options ...func(*RestSever)) *Re
 	mux.Use(middleware.Recoverer)
 
 	server := &RestSever{
-		db,
-		mux,
-		entities,
+		db:         db,
+		mux:        mux,
+		entities:   entities,
+		validation: LenientValidation,
+		modTimes:   newModTimes(),
+		search:     newSearchIndex(entities),
 	}
+	mux.NotFound(func(w http.ResponseWriter, r *http.Request) {
+		writeProblem(w, r, &ResError{
+			Error:  fmt.Sprintf("no route matches %s", r.URL.Path),
+			Status: http.StatusNotFound,
+		})
+	})
+	mux.MethodNotAllowed(server.methodNotAllowed)
 
 	for _, opt := range options {
 		opt(server)
 	}
 
+	if err := server.search.Build(db); err != nil {
+		log.Println("Couldn't build the search index:", err)
+	}
 	return server
 }
 
-// Generates CRUD routes for each entity
+// Records a change made through the API, value is nil when the record was deleted
+func (s *RestSever) recordChanged(entityName string, id string, value []byte) {
+	s.modTimes.touch(entityName, id)
+	s.search.Update(entityName, id, value)
+}
+
+// Returns the entity with the given name
+func (s *RestSever) entity(name string) Entity {
+	i := slices.IndexFunc(s.entities, func(e Entity) bool { return e.Name == name })
+	if i == -1 {
+		return Entity{Name: name}
+	}
+	return s.entities[i]
+}
+
+// Returns the relations to the entities referencing an entity,
+// an entity referencing it with several fields is only related through the first one
+func (s *RestSever) children(entity Entity) []Relation {
+	relations := make([]Relation, 0)
+	for _, child := range s.entities {
+		rel, err := findRelation(child.Name, true, s.entities, entity)
+		if err == nil {
+			relations = append(relations, rel)
+		}
+	}
+	return relations
+}
+
+// Generates CRUD routes for each entity, and nested routes for the entities referencing it
 func (s *RestSever) InitRouter() {
+	s.mux.With(Paginate).Get("/_search", Response(s.SearchHandler()))
 	for _, entity := range s.entities {
 		s.mux.Route("/"+entity.Name, func(r chi.Router) {
 			r.Post("/", Response(s.PostHandler(entity.Name)))
-			r.Get("/", Response(s.GetAllHandler(entity.Name)))
+			r.With(Paginate).Get("/", Response(s.GetAllHandler(entity.Name)))
+			r.Get("/_count", Response(s.CountHandler(entity.Name)))
+			r.Get("/_aggregate", Response(s.AggregateHandler(entity.Name)))
 			r.Route("/{id}", func(r chi.Router) {
 				r.Get("/", Response(s.GetHandler(entity.Name)))
 				r.Delete("/", Response(s.DeleteHandler(entity.Name)))
 				r.Put("/", Response(s.PutHandler(entity.Name)))
 				r.Patch("/", Response(s.PatchHandler(entity.Name)))
+
+				for _, rel := range s.children(entity) {
+					r.With(Paginate).Get("/"+rel.Name, Response(s.GetChildrenHandler(rel, entity.Name)))
+					r.Post("/"+rel.Name, Response(s.PostChildHandler(rel, entity.Name)))
+				}
 			})
 		})
 	}
@@ -89,14 +147,35 @@ func AddLogger() func(*RestSever) {
 * Middleware
 *************/
 
-// Middleware: Adds pagination to the server
-// TODO: implement pagination
+// Middleware: Adds pagination to list routes.
+// The handler reads the page with PaginationFrom and fills in the totals,
+// the X-Total-Count and Link headers are set when the response is written.
 func Paginate(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		next.ServeHTTP(w, r)
+		page, err := ParsePagination(r.URL.Query())
+		if err != nil {
+			writeProblem(w, r, &ResError{
+				Error:  err.Error(),
+				Status: http.StatusBadRequest,
+			})
+			return
+		}
+		if page == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		next.ServeHTTP(&paginationWriter{ResponseWriter: w, r: r, page: page}, withPagination(r, page))
 	})
 }
 
+// Middleware: Sets how request bodies are validated for the entities that don't set it
+func AddValidation(mode ValidationMode) func(*RestSever) {
+	return func(s *RestSever) {
+		s.validation = mode
+	}
+}
+
 // Middleware: Adds a static file server
 func AddStaticFiles(path string) func(*RestSever) {
 	if path == "" {
@@ -137,103 +216,421 @@ func AddHomePage(schemaPath string) func(*RestSever) {
 	}
 }
 
+// Middleware: Adds the admin dump endpoints.
+// GET returns a snapshot of the whole store, POST writes it to the dump file.
+func AddDumpRoute(dumpPath string) func(*RestSever) {
+	return func(s *RestSever) {
+		s.mux.Get("/_admin/dump", Response(func(r *http.Request) (any, *ResError) {
+			snapshot, err := Snapshot(s.db, s.entities)
+			if err != nil {
+				return nil, &ResError{
+					Error:  err.Error(),
+					Status: http.StatusInternalServerError,
+				}
+			}
+			return snapshot, nil
+		}))
+
+		s.mux.Post("/_admin/dump", Response(func(r *http.Request) (any, *ResError) {
+			if dumpPath == "" {
+				return nil, &ResError{
+					Error:  errors.New("no dump file, start the server with --out-dump").Error(),
+					Status: http.StatusBadRequest,
+				}
+			}
+			err := WriteDump(dumpPath, s.db, s.entities)
+			if err != nil {
+				return nil, &ResError{
+					Error:  err.Error(),
+					Status: http.StatusInternalServerError,
+				}
+			}
+			return map[string]string{"message": "ok", "path": dumpPath}, nil
+		}))
+	}
+}
+
 /*************
 * Handlers
 *************/
 
 func (s *RestSever) PostHandler(entityName string) handlerResponse {
 	return func(r *http.Request) (any, *ResError) {
-		body, err := io.ReadAll(r.Body)
+		params, resErr := readBody(r)
+		if resErr != nil {
+			return nil, resErr
+		}
+		return s.create(entityName, params)
+	}
+}
+
+// Lists the records of an entity referencing a parent record
+func (s *RestSever) GetChildrenHandler(rel Relation, parent string) handlerResponse {
+	return func(r *http.Request) (any, *ResError) {
+		id := chi.URLParam(r, "id")
+		if resErr := s.exists(parent, id); resErr != nil {
+			return nil, resErr
+		}
+		scope := []Filter{{Field: rel.Field.Name, Operator: EqOperator, Values: []string{id}}}
+		return s.list(r, rel.Entity, scope)
+	}
+}
+
+// Creates a record referencing a parent record, the reference is filled from the url
+func (s *RestSever) PostChildHandler(rel Relation, parent string) handlerResponse {
+	return func(r *http.Request) (any, *ResError) {
+		id := chi.URLParam(r, "id")
+		value, err := s.db.Get(parent, []byte(id))
+		if err != nil {
+			return nil, storeError(err, parent, id)
+		}
+		params, resErr := readBody(r)
+		if resErr != nil {
+			return nil, resErr
+		}
+
+		// The reference holds the parent's id as it's stored, a number for integer ids
+		var record struct {
+			ID any `json:"id"`
+		}
+		json.Unmarshal(value, &record)
+		ref := any(id)
+		if record.ID != nil {
+			ref = record.ID
+		}
+
+		if many, _ := rel.Field.Options["many"].(bool); many {
+			ids, _ := params[rel.Field.Name].([]any)
+			if !slices.Contains(refIDs(ids), id) {
+				ids = append(ids, ref)
+			}
+			params[rel.Field.Name] = ids
+		} else {
+			params[rel.Field.Name] = ref
+		}
+		return s.create(rel.Entity, params)
+	}
+}
+
+func (s *RestSever) GetAllHandler(entityName string) handlerResponse {
+	return func(r *http.Request) (any, *ResError) {
+		return s.list(r, entityName, nil)
+	}
+}
+
+// Counts the records matching the filters
+func (s *RestSever) CountHandler(entityName string) handlerResponse {
+	return func(r *http.Request) (any, *ResError) {
+		filters, err := ParseFilters(r.URL.Query())
 		if err != nil {
 			return nil, &ResError{
 				Error:  err.Error(),
 				Status: http.StatusBadRequest,
 			}
 		}
-		defer r.Body.Close()
+		count, err := CountRecords(s.db, entityName, filters)
+		if err != nil {
+			return nil, &ResError{
+				Error:  err.Error(),
+				Status: http.StatusInternalServerError,
+			}
+		}
+		return conditionalResponse(r, map[string]int{"count": count}, s.modTimes.entity(entityName)), nil
+	}
+}
 
-		var params map[string]interface{}
-		err = json.Unmarshal(body, &params)
+// Summarizes the records matching the filters, see Aggregation
+func (s *RestSever) AggregateHandler(entityName string) handlerResponse {
+	return func(r *http.Request) (any, *ResError) {
+		query := r.URL.Query()
+		aggregation, err := ParseAggregation(query, s.entity(entityName))
 		if err != nil {
 			return nil, &ResError{
-				Error:  errors.New("invalid json").Error(),
+				Error:  err.Error(),
 				Status: http.StatusBadRequest,
 			}
 		}
-
-		id := faker.UUIDDigit()
-		if params["id"] != nil {
-			id = params["id"].(string)
+		// The aggregation params aren't filters
+		for _, op := range aggregateOps {
+			query.Del(string(op))
+		}
+		query.Del("groupBy")
+		filters, err := ParseFilters(query)
+		if err != nil {
+			return nil, &ResError{
+				Error:  err.Error(),
+				Status: http.StatusBadRequest,
+			}
 		}
 
-		err = s.db.Set(entityName, []byte(id), []byte(body))
+		_, err = s.db.GetAll(entityName, aggregation.Validator(filters))
 		if err != nil {
 			return nil, &ResError{
 				Error:  err.Error(),
 				Status: http.StatusInternalServerError,
 			}
 		}
-		return []byte(SuccessMessage), nil
+		return conditionalResponse(r, aggregation.Result(), s.modTimes.entity(entityName)), nil
 	}
 }
 
-func (s *RestSever) GetAllHandler(entityName string) handlerResponse {
-	return func(r *http.Request) (any, *ResError) {
-		res, err := s.db.GetAll(entityName, nil)
+// Lists the records of an entity matching the query and the scope filters
+func (s *RestSever) list(r *http.Request, entityName string, scope []Filter) (any, *ResError) {
+	query := r.URL.Query()
+	filters, err := ParseFilters(query)
+	if err != nil {
+		return nil, &ResError{
+			Error:  err.Error(),
+			Status: http.StatusBadRequest,
+		}
+	}
+	filters = append(scope, filters...)
+	sortKeys, err := ParseSort(query, s.entity(entityName))
+	if err != nil {
+		return nil, &ResError{
+			Error:  err.Error(),
+			Status: http.StatusBadRequest,
+		}
+	}
+	projection, err := ParseProjection(query)
+	if err != nil {
+		return nil, &ResError{
+			Error:  err.Error(),
+			Status: http.StatusBadRequest,
+		}
+	}
+	relations, err := ParseRelations(query, s.entities, s.entity(entityName))
+	if err != nil {
+		return nil, &ResError{
+			Error:  err.Error(),
+			Status: http.StatusBadRequest,
+		}
+	}
+
+	validator := FilterValidator(filters)
+	// `?q=` only keeps the records found by the search, ranked by relevance unless the list is sorted
+	var rank map[string]int
+	if q := query.Get("q"); q != "" {
+		hits := s.search.Search([]string{entityName}, q)
+		rank = make(map[string]int, len(hits))
+		for i, hit := range hits {
+			rank[hit.ID] = i
+		}
+		validator.validate = append(validator.validate, func(b []byte) bool {
+			_, ok := rank[recordID(b)]
+			return ok
+		})
+	}
+
+	// Sorted and ranked lists are paginated once every matching record is read,
+	// unless the store sorts and paginates them itself
+	inMemory := sortKeys != nil || rank != nil
+	page := PaginationFrom(r)
+	querier, queried := s.db.(Querier)
+	queried = queried && rank == nil
+	if queried {
+		inMemory = false
+	}
+	if page != nil && !inMemory && !queried {
+		page.Apply(validator)
+	}
+
+	var res [][]byte
+	if queried {
+		res, err = querier.Query(entityName, filters, sortKeys, page)
+	} else {
+		res, err = s.db.GetAll(entityName, validator)
+	}
+	if err != nil {
+		return nil, &ResError{
+			Error:  err.Error(),
+			Status: http.StatusInternalServerError,
+		}
+	}
+
+	if page != nil && !inMemory && !queried {
+		// Every record matching the filters is counted, the cursor doesn't start the count
+		total, err := CountRecords(s.db, entityName, filters)
 		if err != nil {
 			return nil, &ResError{
 				Error:  err.Error(),
 				Status: http.StatusInternalServerError,
 			}
 		}
-		return res, nil
+		page.Done(res, total)
+	}
+	if !inMemory && projection == nil && relations == nil {
+		return conditionalResponse(r, res, s.modTimes.entity(entityName)), nil
+	}
+
+	records, err := decodeRecords(res)
+	if err != nil {
+		return nil, &ResError{
+			Error:  err.Error(),
+			Status: http.StatusInternalServerError,
+		}
+	}
+	if sortKeys != nil && !queried {
+		SortRecords(records, sortKeys)
+	} else if rank != nil {
+		sort.SliceStable(records, func(i, j int) bool {
+			return rank[FormatID(records[i]["id"])] < rank[FormatID(records[j]["id"])]
+		})
+	}
+	if inMemory && page != nil {
+		records = page.Slice(records)
+	}
+	err = ResolveRelations(s.db, records, relations)
+	if err != nil {
+		return nil, &ResError{
+			Error:  err.Error(),
+			Status: http.StatusInternalServerError,
+		}
+	}
+	if projection != nil {
+		for i, record := range records {
+			records[i] = projection.Apply(record)
+		}
+	}
+	return conditionalResponse(r, records, s.modTimes.entity(entityName)), nil
+}
+
+// Searches the records of every entity, or of the entities listed in `?entity=`, best matches first
+func (s *RestSever) SearchHandler() handlerResponse {
+	return func(r *http.Request) (any, *ResError) {
+		query := r.URL.Query()
+		q := query.Get("q")
+		if strings.TrimSpace(q) == "" {
+			return nil, &ResError{
+				Error:  "q is required",
+				Status: http.StatusBadRequest,
+			}
+		}
+
+		entities := make([]string, 0, len(s.entities))
+		for _, value := range query["entity"] {
+			for _, name := range strings.Split(value, ",") {
+				if !slices.ContainsFunc(s.entities, func(e Entity) bool { return e.Name == name }) {
+					return nil, &ResError{
+						Error:  fmt.Sprintf("unknown entity %q", name),
+						Status: http.StatusBadRequest,
+					}
+				}
+				entities = append(entities, name)
+			}
+		}
+		if len(entities) == 0 {
+			for _, e := range s.entities {
+				entities = append(entities, e.Name)
+			}
+		}
+
+		hits := s.search.Search(entities, q)
+		if page := PaginationFrom(r); page != nil {
+			start, end := page.window(len(hits), func(i int) string { return hits[i].ID })
+			hits = hits[start:end]
+		}
+
+		// Only the records of the page are read
+		for i := range hits {
+			value, err := s.db.Get(hits[i].Entity, []byte(hits[i].ID))
+			if err != nil {
+				return nil, storeError(err, hits[i].Entity, hits[i].ID)
+			}
+			hits[i].Record = value
+			hits[i].Highlights = s.search.Highlight(hits[i].Entity, value, q)
+		}
+		return hits, nil
 	}
 }
 
 func (s *RestSever) GetHandler(entityName string) handlerResponse {
 	return func(r *http.Request) (any, *ResError) {
-		id := r.URL.Query().Get("id")
+		id := chi.URLParam(r, "id")
 		if id == "" {
 			return nil, &ResError{
 				Error:  errors.New("id is required").Error(),
 				Status: http.StatusBadRequest,
 			}
 		}
+		query := r.URL.Query()
+		projection, err := ParseProjection(query)
+		if err != nil {
+			return nil, &ResError{
+				Error:  err.Error(),
+				Status: http.StatusBadRequest,
+			}
+		}
+		relations, err := ParseRelations(query, s.entities, s.entity(entityName))
+		if err != nil {
+			return nil, &ResError{
+				Error:  err.Error(),
+				Status: http.StatusBadRequest,
+			}
+		}
+
 		res, err := s.db.Get(entityName, []byte(id))
+		if err != nil {
+			return nil, storeError(err, entityName, id)
+		}
+		modified := s.modTimes.record(entityName, id)
+		if projection == nil && relations == nil {
+			return conditionalResponse(r, res, modified), nil
+		}
+
+		var record map[string]any
+		err = json.Unmarshal(res, &record)
 		if err != nil {
 			return nil, &ResError{
 				Error:  err.Error(),
 				Status: http.StatusInternalServerError,
 			}
 		}
-		return res, nil
+		err = ResolveRelations(s.db, []map[string]any{record}, relations)
+		if err != nil {
+			return nil, &ResError{
+				Error:  err.Error(),
+				Status: http.StatusInternalServerError,
+			}
+		}
+		if projection != nil {
+			return conditionalResponse(r, projection.Apply(record), modified), nil
+		}
+		return conditionalResponse(r, record, modified), nil
 	}
 }
 
+// Deletes a record, replies with 204 or with the deleted record if the request has `Prefer: return=representation`
 func (s *RestSever) DeleteHandler(entityName string) handlerResponse {
 	return func(r *http.Request) (any, *ResError) {
-		id := r.URL.Query().Get("id")
+		id := chi.URLParam(r, "id")
 		if id == "" {
 			return nil, &ResError{
 				Error:  errors.New("id is required").Error(),
 				Status: http.StatusBadRequest,
 			}
 		}
-		err := s.db.Delete(entityName, []byte(id))
+		// The record is only deleted if it still matches If-Match
+		res, err := s.db.Delete(entityName, []byte(id), func(value []byte) error {
+			return checkIfMatch(r, value)
+		})
 		if err != nil {
-			return nil, &ResError{
-				Error:  err.Error(),
-				Status: http.StatusInternalServerError,
-			}
+			return nil, storeError(err, entityName, id)
 		}
+		s.recordChanged(entityName, id, nil)
 
-		return []byte(SuccessMessage), nil
+		// RFC 7240, the deleted record is only sent back when asked for
+		if strings.Contains(r.Header.Get("Prefer"), "return=representation") {
+			return res, nil
+		}
+		return &ResResult{Status: http.StatusNoContent}, nil
 	}
 }
 
+// Replaces a record and returns it, the record must exist
 func (s *RestSever) PutHandler(entityName string) handlerResponse {
 	return func(r *http.Request) (any, *ResError) {
-		id := r.URL.Query().Get("id")
+		id := chi.URLParam(r, "id")
 		if id == "" {
 			return nil, &ResError{
 				Error:  errors.New("id is required").Error(),
@@ -241,36 +638,68 @@ func (s *RestSever) PutHandler(entityName string) handlerResponse {
 			}
 		}
 
-		body, err := io.ReadAll(r.Body)
-		if err != nil {
-			return nil, &ResError{
-				Error:  err.Error(),
-				Status: http.StatusBadRequest,
-			}
+		params, resErr := readBody(r)
+		if resErr != nil {
+			return nil, resErr
+		}
+		if resErr := validationError(ValidateBody(s.entity(entityName), s.validation, params)); resErr != nil {
+			return nil, resErr
 		}
-		defer r.Body.Close()
 
-		err = s.db.Set(entityName, []byte(id), body)
-		if err != nil {
-			return nil, &ResError{
-				Error:  err.Error(),
-				Status: http.StatusInternalServerError,
+		// Replacing through Patch keeps the existence check and the write in one transaction
+		res, err := s.db.Patch(entityName, []byte(id), func(value []byte) ([]byte, error) {
+			if err := checkIfMatch(r, value); err != nil {
+				return nil, err
+			}
+			var prev map[string]any
+			json.Unmarshal(value, &prev)
+			params["id"] = id
+			if prev["id"] != nil {
+				params["id"] = prev["id"]
 			}
+			if violations := naturalKeyViolations(s.entity(entityName), params); len(violations) != 0 {
+				return nil, violationsError(violations)
+			}
+			return json.Marshal(params)
+		})
+		var violations violationsError
+		if errors.As(err, &violations) {
+			return nil, validationError(violations)
 		}
-
-		return []byte(SuccessMessage), nil
+		if err != nil {
+			return nil, storeError(err, entityName, id)
+		}
+		s.recordChanged(entityName, id, res)
+		return &ResResult{Status: http.StatusOK, Header: http.Header{"Etag": {ETag(res)}}, Data: res}, nil
 	}
 }
 
+// Patches a record with a JSON Patch (application/json-patch+json)
+// or a JSON Merge Patch (application/merge-patch+json or plain json) and returns it
 func (s *RestSever) PatchHandler(entityName string) handlerResponse {
 	return func(r *http.Request) (any, *ResError) {
-		id := r.URL.Query().Get("id")
+		id := chi.URLParam(r, "id")
 		if id == "" {
 			return nil, &ResError{
 				Error:  errors.New("id is required").Error(),
 				Status: http.StatusBadRequest,
 			}
 		}
+
+		var apply func(doc []byte, patch []byte) ([]byte, error)
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		switch mediaType {
+		case JSONPatchType:
+			apply = JSONPatch
+		case MergePatchType, "application/json", "":
+			apply = MergePatch
+		default:
+			return nil, &ResError{
+				Error:  fmt.Sprintf("unsupported content type %q, use %s or %s", mediaType, MergePatchType, JSONPatchType),
+				Status: http.StatusUnsupportedMediaType,
+			}
+		}
+
 		body, err := io.ReadAll(r.Body)
 		if err != nil {
 			return nil, &ResError{
@@ -280,14 +709,53 @@ func (s *RestSever) PatchHandler(entityName string) handlerResponse {
 		}
 		defer r.Body.Close()
 
-		err = s.db.Patch(entityName, []byte(id), body)
-		if err != nil {
+		res, err := s.db.Patch(entityName, []byte(id), func(value []byte) ([]byte, error) {
+			if err := checkIfMatch(r, value); err != nil {
+				return nil, err
+			}
+			doc, err := apply(value, body)
+			if err != nil {
+				return nil, err
+			}
+
+			var prev, record map[string]any
+			json.Unmarshal(value, &prev)
+			if err := json.Unmarshal(doc, &record); err != nil || record == nil {
+				return nil, fmt.Errorf("%w: the patched record isn't an object", ErrInvalidPatch)
+			}
+			// The id is the key of the record, it can't be patched
+			record["id"] = id
+			if prev["id"] != nil {
+				record["id"] = prev["id"]
+			}
+
+			violations := ValidateBody(s.entity(entityName), s.validation, record)
+			violations = append(violations, naturalKeyViolations(s.entity(entityName), record)...)
+			if len(violations) != 0 {
+				return nil, violationsError(violations)
+			}
+			return json.Marshal(record)
+		})
+
+		var violations violationsError
+		switch {
+		case errors.As(err, &violations):
+			return nil, validationError(violations)
+		case errors.Is(err, ErrTestFailed):
 			return nil, &ResError{
 				Error:  err.Error(),
-				Status: http.StatusInternalServerError,
+				Status: http.StatusConflict,
+			}
+		case errors.Is(err, ErrInvalidPatch):
+			return nil, &ResError{
+				Error:  err.Error(),
+				Status: http.StatusBadRequest,
 			}
+		case err != nil:
+			return nil, storeError(err, entityName, id)
 		}
-		return []byte(SuccessMessage), nil
+		s.recordChanged(entityName, id, res)
+		return &ResResult{Status: http.StatusOK, Header: http.Header{"Etag": {ETag(res)}}, Data: res}, nil
 	}
 }
 
@@ -295,40 +763,259 @@ func (s *RestSever) PatchHandler(entityName string) handlerResponse {
 * Utils
 *************/
 
+// Error response, sent as a RFC 7807 problem details document.
+// Error is the detail of the problem, the title defaults to the status text.
 type ResError struct {
-	Error  string `json:"error"`
-	Status int    `json:"status"`
+	Type       string      `json:"type,omitempty"`
+	Title      string      `json:"title"`
+	Status     int         `json:"status"`
+	Error      string      `json:"detail,omitempty"`
+	Instance   string      `json:"instance,omitempty"`
+	Violations []Violation `json:"violations,omitempty"`
 }
 
-const SuccessMessage = "{\"message\": \"ok\"}"
+// Successful response with a status other than 200 or extra headers
+type ResResult struct {
+	Status int
+	Header http.Header
+	Data   any // nil for an empty body
+}
 
 type handlerResponse func(*http.Request) (any, *ResError)
 
-// Helper function to return a json response
+// Helper function to return a json response.
+// Stored records ([]byte and [][]byte) are sent as they are, anything else is encoded.
 func Response(fn func(*http.Request) (any, *ResError)) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		data, err := fn(r)
 		if err != nil {
-			render.Status(r, err.Status)
-			render.JSON(w, r, map[string]string{"error": err.Error})
-		}
-
-		if reflect.TypeOf(data).Kind() == reflect.Slice {
-			var res []map[string]any
-			for _, v := range data.([][]byte) {
-				var params map[string]any
-				err := json.Unmarshal(v, &params)
-				if err != nil {
-					render.Status(r, http.StatusInternalServerError)
-					render.JSON(w, r, map[string]string{"error": "Failed to Parse Data"})
-					return
-				}
-				res = append(res, params)
+			writeProblem(w, r, err)
+			return
+		}
+
+		if res, ok := data.(*ResResult); ok {
+			for key, values := range res.Header {
+				w.Header()[key] = values
+			}
+			if res.Data == nil {
+				w.WriteHeader(res.Status)
+				return
+			}
+			render.Status(r, res.Status)
+			data = res.Data
+		}
+
+		switch v := data.(type) {
+		case [][]byte:
+			res := make([]json.RawMessage, 0, len(v))
+			for _, record := range v {
+				res = append(res, record)
 			}
 			render.JSON(w, r, res)
-			return
+		case []byte:
+			render.JSON(w, r, json.RawMessage(v))
+		default:
+			render.JSON(w, r, data)
+		}
+	}
+}
+
+// Writes an error as a problem details document
+func writeProblem(w http.ResponseWriter, r *http.Request, err *ResError) {
+	if err.Title == "" {
+		err.Title = http.StatusText(err.Status)
+	}
+	if err.Instance == "" {
+		err.Instance = r.URL.Path
+	}
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(err.Status)
+	json.NewEncoder(w).Encode(err)
+}
+
+// Replies 405 with the methods the path accepts in the Allow header
+func (s *RestSever) methodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	matched := make(map[string]bool)
+	chi.Walk(s.mux, func(method string, route string, _ http.Handler, _ ...func(http.Handler) http.Handler) error {
+		if matchRoute(route, r.URL.Path) {
+			matched[method] = true
+		}
+		return nil
+	})
+	allowed := make([]string, 0, len(matched))
+	for _, method := range []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete} {
+		if matched[method] {
+			allowed = append(allowed, method)
+		}
+	}
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	writeProblem(w, r, &ResError{
+		Error:  fmt.Sprintf("%s isn't allowed on %s", r.Method, r.URL.Path),
+		Status: http.StatusMethodNotAllowed,
+	})
+}
+
+// Matches a path against a route pattern such as `/users/{id}/posts`
+func matchRoute(route string, path string) bool {
+	routeParts := strings.Split(strings.Trim(route, "/"), "/")
+	pathParts := strings.Split(strings.Trim(path, "/"), "/")
+	for i, part := range routeParts {
+		if part == "*" {
+			return true
+		}
+		if i >= len(pathParts) {
+			return false
+		}
+		isParam := strings.HasPrefix(part, "{") && strings.HasSuffix(part, "}")
+		if !isParam && part != pathParts[i] || isParam && pathParts[i] == "" {
+			return false
+		}
+	}
+	return len(routeParts) == len(pathParts)
+}
+
+// Reads a json object from the request body
+func readBody(r *http.Request) (map[string]any, *ResError) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, &ResError{
+			Error:  err.Error(),
+			Status: http.StatusBadRequest,
+		}
+	}
+	defer r.Body.Close()
+
+	var params map[string]any
+	err = json.Unmarshal(body, &params)
+	if err != nil || params == nil {
+		return nil, &ResError{
+			Error:  errors.New("invalid json").Error(),
+			Status: http.StatusBadRequest,
+		}
+	}
+	return params, nil
+}
+
+// Stores a new record and replies with 201 and its location.
+// The id is generated unless the record has one, in which case it must not be taken.
+func (s *RestSever) create(entityName string, params map[string]any) (any, *ResError) {
+	if resErr := validationError(ValidateBody(s.entity(entityName), s.validation, params)); resErr != nil {
+		return nil, resErr
+	}
+
+	entity := s.entity(entityName)
+	if key := entity.NaturalKey(); key != "" {
+		if params[key] == nil {
+			return nil, validationError([]Violation{{Entity: entityName, Path: key, Reason: "missing natural key"}})
+		}
+		params["id"] = params[key]
+	}
+
+	var id string
+	switch v := params["id"].(type) {
+	case nil:
+		if entity.IDStrategy == AutoIncrementStrategy {
+			n, err := s.db.NextID(entityName)
+			if err != nil {
+				return nil, storeError(err, entityName, "")
+			}
+			params["id"] = n
+			id = strconv.FormatInt(n, 10)
+		} else {
+			id = RandomID(entity.IDStrategy)
+			params["id"] = id
+		}
+	case string, float64:
+		id = FormatID(v)
+		// Numbers must be integers, they would be written with a fraction or an exponent otherwise
+		_, isInt := intID(id)
+		if _, isNumber := v.(float64); id == "" || isNumber && !isInt {
+			return nil, &ResError{
+				Error:  fmt.Sprintf("invalid id %v, ids are non-empty strings or integers", v),
+				Status: http.StatusBadRequest,
+			}
 		}
+	default:
+		return nil, &ResError{
+			Error:  fmt.Sprintf("invalid id %v, ids are non-empty strings or integers", v),
+			Status: http.StatusBadRequest,
+		}
+	}
 
-		render.JSON(w, r, data)
+	body, err := json.Marshal(params)
+	if err != nil {
+		return nil, &ResError{
+			Error:  err.Error(),
+			Status: http.StatusBadRequest,
+		}
+	}
+	// Fails if a record with the same id is created meanwhile
+	err = s.db.Create(entityName, []byte(id), body)
+	if err != nil {
+		return nil, storeError(err, entityName, id)
+	}
+	s.recordChanged(entityName, id, body)
+	return &ResResult{
+		Status: http.StatusCreated,
+		Header: http.Header{
+			"Location": {"/" + entityName + "/" + url.PathEscape(id)},
+			"Etag":     {ETag(body)},
+		},
+		Data: body,
+	}, nil
+}
+
+// Checks that a record exists
+func (s *RestSever) exists(entityName string, id string) *ResError {
+	_, err := s.db.Get(entityName, []byte(id))
+	if err != nil {
+		return storeError(err, entityName, id)
+	}
+	return nil
+}
+
+// Maps a store error to a 404 for missing records, a 409 for taken unique values, a 412 for failed preconditions and to a 500 otherwise
+func storeError(err error, entityName string, id string) *ResError {
+	if errors.Is(err, ErrNotFound) {
+		return &ResError{
+			Error:  fmt.Sprintf("%s %s not found", entityName, id),
+			Status: http.StatusNotFound,
+		}
+	}
+	if errors.Is(err, ErrExists) {
+		return &ResError{
+			Error:  fmt.Sprintf("%s %s already exists", entityName, id),
+			Status: http.StatusConflict,
+		}
+	}
+	if errors.Is(err, ErrConflict) {
+		return &ResError{
+			Error:  err.Error(),
+			Status: http.StatusConflict,
+		}
+	}
+	if errors.Is(err, ErrPreconditionFailed) {
+		return &ResError{
+			Error:  err.Error(),
+			Status: http.StatusPreconditionFailed,
+		}
+	}
+	return &ResError{
+		Error:  err.Error(),
+		Status: http.StatusInternalServerError,
+	}
+}
+
+// Decodes stored records
+func decodeRecords(data [][]byte) ([]map[string]any, error) {
+	records := make([]map[string]any, 0, len(data))
+	for _, v := range data {
+		var record map[string]any
+		err := json.Unmarshal(v, &record)
+		if err != nil {
+			return nil, errors.New("failed to parse data")
+		}
+		records = append(records, record)
 	}
+	return records, nil
 }
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Returns the router of a server over a store holding the given records, indexed like the server does
+func testServer(t *testing.T, db Store, entities []Entity, records map[string][][]byte, options ...func(*RestSever)) http.Handler {
+	t.Helper()
+	if err := db.SetIndexes(entities); err != nil {
+		t.Fatal(err)
+	}
+	for entity, values := range records {
+		for _, value := range values {
+			mustSet(t, db, entity, recordID(value), value)
+		}
+	}
+	s := NewRestServer(db, entities, options...)
+	s.InitRouter()
+	return s.mux
+}
+
+// Serves a request, body is sent as json when it isn't empty
+func serve(h http.Handler, method string, path string, body string) *httptest.ResponseRecorder {
+	return serveRequest(h, newRequest(method, path, body))
+}
+
+func newRequest(method string, path string, body string) *http.Request {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	if body != "" {
+		r.Header.Set("Content-Type", "application/json")
+	}
+	return r
+}
+
+func serveRequest(h http.Handler, r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+// Decodes a list response and returns the ids of its records
+func responseIDs(t *testing.T, w *httptest.ResponseRecorder) []string {
+	t.Helper()
+	var records []map[string]any
+	if err := json.Unmarshal(w.Body.Bytes(), &records); err != nil {
+		t.Fatalf("%d %s: %v", w.Code, w.Body, err)
+	}
+	ids := make([]string, 0, len(records))
+	for _, r := range records {
+		ids = append(ids, FormatID(r["id"]))
+	}
+	return ids
+}
+
+func decode(t *testing.T, b []byte) map[string]any {
+	t.Helper()
+	var m map[string]any
+	if err := json.Unmarshal(b, &m); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func encode(t *testing.T, v any) []byte {
+	t.Helper()
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"html"
+	"log"
+	"math"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// Field types whose text is searchable
+var searchableTypes = []FieldType{StringType, NameType, FullnameType, ParagraphType, AddressType}
+
+// BM25 parameters, the usual defaults
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+// Words around the first match in a snippet, shorter texts are kept whole
+const snippetWords = 12
+
+// Query terms also match the words they start with, with a lower weight
+const prefixWeight = 0.5
+
+type docRef struct {
+	entity string
+	id     string
+}
+
+// In-memory inverted index of the searchable fields of every record.
+// It isn't persisted next to the records so every store can be searched the same way,
+// it's built from the records when the server starts and kept current by the REST handlers.
+type searchIndex struct {
+	mu       sync.RWMutex
+	fields   map[string][]string // searchable fields by entity, nil means every string field
+	postings map[string]map[docRef]int
+	terms    []string // terms of the postings in order, the words starting with a term follow it
+	docs     map[docRef]searchDoc
+	length   int // number of terms of every record
+}
+
+type searchDoc struct {
+	terms  map[string]int // term frequencies
+	length int
+}
+
+// A record matching a search
+type SearchHit struct {
+	Entity     string            `json:"entity"`
+	ID         string            `json:"id"`
+	Score      float64           `json:"score"`
+	Highlights map[string]string `json:"highlights"`
+	Record     json.RawMessage   `json:"record"`
+}
+
+func newSearchIndex(entities []Entity) *searchIndex {
+	idx := &searchIndex{
+		fields:   make(map[string][]string, len(entities)),
+		postings: make(map[string]map[docRef]int),
+		docs:     make(map[docRef]searchDoc),
+	}
+	for _, e := range entities {
+		// Entities taken from an ingested file have no schema, all their strings are searched
+		if len(e.Schema) == 0 {
+			idx.fields[e.Name] = nil
+			continue
+		}
+		fields := make([]string, 0)
+		for _, f := range e.Schema {
+			if slices.Contains(searchableTypes, f.Kind) {
+				fields = append(fields, f.Name)
+			}
+		}
+		if len(fields) != 0 {
+			idx.fields[e.Name] = fields
+		}
+	}
+	return idx
+}
+
+// Indexes every record of the searchable entities
+func (idx *searchIndex) Build(db Store) error {
+	for entity := range idx.fields {
+		records, err := db.GetAll(entity, nil)
+		if err != nil {
+			return err
+		}
+		for _, value := range records {
+			idx.Update(entity, recordID(value), value)
+		}
+	}
+	return nil
+}
+
+// Indexes a record again, a nil value removes it from the index
+func (idx *searchIndex) Update(entity string, id string, value []byte) {
+	if _, ok := idx.fields[entity]; !ok {
+		return
+	}
+	var terms map[string]int
+	if value != nil {
+		var record map[string]any
+		if err := json.Unmarshal(value, &record); err != nil {
+			log.Println("Couldn't index", entity, id, err)
+			return
+		}
+		terms = make(map[string]int)
+		for _, text := range idx.texts(entity, record) {
+			for _, token := range tokenize(text) {
+				terms[token.term]++
+			}
+		}
+	}
+
+	ref := docRef{entity, id}
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	for term := range idx.docs[ref].terms {
+		delete(idx.postings[term], ref)
+		if len(idx.postings[term]) == 0 {
+			delete(idx.postings, term)
+			i, _ := slices.BinarySearch(idx.terms, term)
+			idx.terms = slices.Delete(idx.terms, i, i+1)
+		}
+	}
+	idx.length -= idx.docs[ref].length
+	delete(idx.docs, ref)
+	if len(terms) == 0 {
+		return
+	}
+	doc := searchDoc{terms: terms}
+	for term, tf := range terms {
+		if idx.postings[term] == nil {
+			idx.postings[term] = make(map[docRef]int)
+			i, _ := slices.BinarySearch(idx.terms, term)
+			idx.terms = slices.Insert(idx.terms, i, term)
+		}
+		idx.postings[term][ref] = tf
+		doc.length += tf
+	}
+	idx.length += doc.length
+	idx.docs[ref] = doc
+}
+
+// Returns the searchable texts of a record by field name, addresses are joined into a single line
+func (idx *searchIndex) texts(entity string, record map[string]any) map[string]string {
+	fields := idx.fields[entity]
+	if fields == nil {
+		fields = make([]string, 0, len(record))
+		for name := range record {
+			if name != "id" {
+				fields = append(fields, name)
+			}
+		}
+	}
+	texts := make(map[string]string, len(fields))
+	for _, name := range fields {
+		switch v := record[name].(type) {
+		case string:
+			texts[name] = v
+		case map[string]any:
+			keys := make([]string, 0, len(v))
+			for key := range v {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			parts := make([]string, 0, len(keys))
+			for _, key := range keys {
+				if s, ok := v[key].(string); ok && s != "" {
+					parts = append(parts, s)
+				}
+			}
+			texts[name] = strings.Join(parts, ", ")
+		}
+	}
+	return texts
+}
+
+// Returns the records of the entities matching every term of the query, best matches first.
+// Scores are BM25 over every indexed record.
+func (idx *searchIndex) Search(entities []string, query string) []SearchHit {
+	terms := make([]string, 0)
+	for _, token := range tokenize(query) {
+		if !slices.Contains(terms, token.term) {
+			terms = append(terms, token.term)
+		}
+	}
+	if len(terms) == 0 {
+		return []SearchHit{}
+	}
+
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	n := float64(len(idx.docs))
+	avgLength := float64(idx.length) / max(n, 1)
+
+	var scores map[docRef]float64
+	for _, term := range terms {
+		termScores := make(map[docRef]float64)
+		i, _ := slices.BinarySearch(idx.terms, term)
+		for _, word := range idx.terms[i:] {
+			if !strings.HasPrefix(word, term) {
+				break
+			}
+			weight := 1.0
+			if word != term {
+				weight = prefixWeight
+			}
+			postings := idx.postings[word]
+			idf := math.Log(1 + (n-float64(len(postings))+0.5)/(float64(len(postings))+0.5))
+			for ref, tf := range postings {
+				if !slices.Contains(entities, ref.entity) {
+					continue
+				}
+				length := idx.docs[ref].length
+				norm := float64(tf) * (bm25K1 + 1) / (float64(tf) + bm25K1*(1-bm25B+bm25B*float64(length)/avgLength))
+				termScores[ref] = max(termScores[ref], weight*idf*norm)
+			}
+		}
+
+		// Records must match every term
+		if scores == nil {
+			scores = termScores
+			continue
+		}
+		for ref, score := range scores {
+			if s, ok := termScores[ref]; ok {
+				scores[ref] = score + s
+			} else {
+				delete(scores, ref)
+			}
+		}
+	}
+
+	hits := make([]SearchHit, 0, len(scores))
+	for ref, score := range scores {
+		hits = append(hits, SearchHit{Entity: ref.entity, ID: ref.id, Score: math.Round(score*1000) / 1000})
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].Score != hits[j].Score {
+			return hits[i].Score > hits[j].Score
+		}
+		if hits[i].Entity != hits[j].Entity {
+			return hits[i].Entity < hits[j].Entity
+		}
+		return bytes.Compare(EncodeKey(hits[i].ID), EncodeKey(hits[j].ID)) < 0
+	})
+	return hits
+}
+
+// Returns the snippets of the searchable fields of a record matching the query,
+// matched words are wrapped in <mark> and the rest of the text is HTML escaped
+func (idx *searchIndex) Highlight(entity string, value []byte, query string) map[string]string {
+	highlights := make(map[string]string)
+	var record map[string]any
+	if err := json.Unmarshal(value, &record); err != nil {
+		return highlights
+	}
+	terms := tokenize(query)
+	for name, text := range idx.texts(entity, record) {
+		if snippet, ok := snippet(text, terms); ok {
+			highlights[name] = snippet
+		}
+	}
+	return highlights
+}
+
+func snippet(text string, terms []token) (string, bool) {
+	tokens := tokenize(text)
+	first := slices.IndexFunc(tokens, func(t token) bool { return matches(t, terms) })
+	if first == -1 {
+		return "", false
+	}
+
+	from, to := 0, len(tokens)
+	if len(tokens) > snippetWords {
+		from = max(0, first-snippetWords/3)
+		to = min(len(tokens), from+snippetWords)
+	}
+	start, end := 0, len(text)
+	if from > 0 {
+		start = tokens[from].start
+	}
+	if to < len(tokens) {
+		end = tokens[to-1].end
+	}
+
+	var sb strings.Builder
+	if start > 0 {
+		sb.WriteString("…")
+	}
+	pos := start
+	for _, t := range tokens[from:to] {
+		if !matches(t, terms) {
+			continue
+		}
+		sb.WriteString(html.EscapeString(text[pos:t.start]))
+		sb.WriteString("<mark>" + html.EscapeString(text[t.start:t.end]) + "</mark>")
+		pos = t.end
+	}
+	sb.WriteString(html.EscapeString(text[pos:end]))
+	if end < len(text) {
+		sb.WriteString("…")
+	}
+	return sb.String(), true
+}
+
+// A word of a text, with its position
+type token struct {
+	term       string // the word in lower case
+	start, end int
+}
+
+// Splits a text into words, anything but letters and digits separates them
+func tokenize(text string) []token {
+	tokens := make([]token, 0)
+	start := -1
+	for i, r := range text {
+		isWord := unicode.IsLetter(r) || unicode.IsDigit(r)
+		if isWord && start == -1 {
+			start = i
+		}
+		if !isWord && start != -1 {
+			tokens = append(tokens, token{strings.ToLower(text[start:i]), start, i})
+			start = -1
+		}
+	}
+	if start != -1 {
+		tokens = append(tokens, token{strings.ToLower(text[start:]), start, len(text)})
+	}
+	return tokens
+}
+
+func matches(t token, terms []token) bool {
+	return slices.ContainsFunc(terms, func(q token) bool { return strings.HasPrefix(t.term, q.term) })
+}
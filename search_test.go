@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"net/url"
+	"reflect"
+	"slices"
+	"testing"
+)
+
+var articles = Entity{
+	Name: "articles",
+	Schema: []Field{
+		{Name: "title", Kind: StringType},
+		{Name: "body", Kind: ParagraphType},
+		{Name: "views", Kind: NumberType},
+	},
+}
+
+func TestTokenize(t *testing.T) {
+	for _, test := range []struct {
+		text string
+		want []token
+	}{
+		{"", []token{}},
+		{" ,. ", []token{}},
+		{"Hello, World!", []token{{"hello", 0, 5}, {"world", 7, 12}}},
+		{"jo.smith@mail.com", []token{{"jo", 0, 2}, {"smith", 3, 8}, {"mail", 9, 13}, {"com", 14, 17}}},
+		{"Rue 42b", []token{{"rue", 0, 3}, {"42b", 4, 7}}},
+		{"ÉCOLE-Normale", []token{{"école", 0, 6}, {"normale", 7, 14}}},
+	} {
+		if got := tokenize(test.text); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("tokenize(%q) = %v, want %v", test.text, got, test.want)
+		}
+	}
+}
+
+func TestSearchRanking(t *testing.T) {
+	idx := newSearchIndex([]Entity{articles, {Name: "notes"}})
+	for id, title := range map[string]string{
+		"1": "go concurrency patterns",
+		"2": "go go go",
+		"3": "gopher concurrency patterns",
+		"4": "gopher rules",
+		"5": "rust ownership rules",
+	} {
+		idx.Update("articles", id, record(id, "title", title, "views", 1))
+	}
+	// Entities without a schema search every string field
+	idx.Update("notes", "1", record(1, "text", "buy milk", "shop", "Milky Way"))
+
+	for _, test := range []struct {
+		entities []string
+		query    string
+		want     []string
+	}{
+		// As many records hold "go" and "gopher": more occurrences first, then exact words
+		// before words starting with the term, then shorter records
+		{[]string{"articles"}, "go", []string{"2", "1", "4", "3"}},
+		{[]string{"articles"}, "GO!", []string{"2", "1", "4", "3"}},
+		// Every term must match
+		{[]string{"articles"}, "go patterns", []string{"1", "3"}},
+		{[]string{"articles"}, "concurrency gopher", []string{"3"}},
+		{[]string{"articles"}, "rust go", []string{}},
+		{[]string{"articles"}, "own", []string{"5"}},
+		{[]string{"articles"}, "1", []string{}},
+		{[]string{"articles"}, " ", []string{}},
+		{[]string{"articles"}, "milk", []string{}},
+		{[]string{"notes"}, "way", []string{"1"}},
+		{[]string{"articles", "notes"}, "rules", []string{"4", "5"}},
+	} {
+		hits := idx.Search(test.entities, test.query)
+		got := make([]string, 0, len(hits))
+		for _, hit := range hits {
+			got = append(got, hit.ID)
+		}
+		if !slices.Equal(got, test.want) {
+			t.Errorf("Search(%v, %q) = %v, want %v", test.entities, test.query, got, test.want)
+		}
+	}
+}
+
+// Records written through the API are searched right away, and deleted ones aren't found anymore
+func TestSearchIndexUpdates(t *testing.T) {
+	h := testServer(t, NewMemDB(), []Entity{articles}, map[string][][]byte{
+		"articles": {record("1", "title", "Go concurrency"), record("2", "title", "Rust ownership")},
+	})
+	search := func(q string) []string {
+		t.Helper()
+		w := serve(h, "GET", "/_search?q="+url.QueryEscape(q), "")
+		var hits []SearchHit
+		if err := json.Unmarshal(w.Body.Bytes(), &hits); err != nil {
+			t.Fatalf("%s: %s", err, w.Body)
+		}
+		got := make([]string, 0, len(hits))
+		for _, hit := range hits {
+			got = append(got, hit.ID)
+		}
+		return got
+	}
+	check := func(step string, q string, want ...string) {
+		t.Helper()
+		if got := search(q); !slices.Equal(got, want) {
+			t.Errorf("%s: search %q got %v, want %v", step, q, got, want)
+		}
+	}
+
+	check("start", "go", "1")
+	if w := serve(h, "POST", "/articles", `{"id":"3","title":"Go generics"}`); w.Code != 201 {
+		t.Fatalf("POST: %d %s", w.Code, w.Body)
+	}
+	check("POST", "generics", "3")
+	check("POST", "go", "1", "3")
+
+	if w := serve(h, "PATCH", "/articles/1", `{"title":"Zig comptime"}`); w.Code != 200 {
+		t.Fatalf("PATCH: %d %s", w.Code, w.Body)
+	}
+	check("PATCH", "go", "3")
+	check("PATCH", "zig", "1")
+	check("PATCH", "concurrency")
+
+	if w := serve(h, "PUT", "/articles/2", `{"id":"2","title":"Rust lifetimes"}`); w.Code != 200 {
+		t.Fatalf("PUT: %d %s", w.Code, w.Body)
+	}
+	check("PUT", "ownership")
+	check("PUT", "lifetimes", "2")
+
+	if w := serve(h, "DELETE", "/articles/3", ""); w.Code >= 300 {
+		t.Fatalf("DELETE: %d %s", w.Code, w.Body)
+	}
+	check("DELETE", "go")
+	check("DELETE", "gen")
+
+	// `?q=` on a list only returns the matching records
+	w := serve(h, "GET", "/articles?q=zig", "")
+	var records []map[string]any
+	if err := json.Unmarshal(w.Body.Bytes(), &records); err != nil || len(records) != 1 || records[0]["id"] != "1" {
+		t.Errorf("list search: got %s", w.Body)
+	}
+}
+
+// The terms stay in order as records are indexed and removed, the prefix lookups depend on it
+func TestSearchTermsOrder(t *testing.T) {
+	idx := newSearchIndex([]Entity{articles})
+	idx.Update("articles", "1", record(1, "title", "beta alpha"))
+	idx.Update("articles", "2", record(2, "title", "gamma alpha alphabet"))
+	idx.Update("articles", "1", record(1, "title", "delta"))
+	idx.Update("articles", "3", nil)
+	want := []string{"alpha", "alphabet", "delta", "gamma"}
+	if !slices.Equal(idx.terms, want) {
+		t.Errorf("terms %v, want %v", idx.terms, want)
+	}
+	idx.Update("articles", "2", nil)
+	idx.Update("articles", "1", nil)
+	if len(idx.terms) != 0 || len(idx.postings) != 0 || len(idx.docs) != 0 || idx.length != 0 {
+		t.Errorf("the index isn't empty once every record is removed: %v %v %v %d", idx.terms, idx.postings, idx.docs, idx.length)
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A sort criterion taken from `?_sort=field1,-field2`, a leading `-` sorts in descending order.
+// Values are compared according to the type of the field in the schema:
+// numbers numerically, dates chronologically and everything else by its json value.
+type SortKey struct {
+	Field string
+	Desc  bool
+	field *Field // nil when the field isn't in the schema
+}
+
+// Parses the sort criteria of a query string
+func ParseSort(query url.Values, entity Entity) ([]SortKey, error) {
+	if !query.Has("_sort") {
+		return nil, nil
+	}
+
+	keys := make([]SortKey, 0)
+	for _, param := range query["_sort"] {
+		for _, name := range strings.Split(param, ",") {
+			key := SortKey{}
+			key.Field, key.Desc = strings.CutPrefix(strings.TrimSpace(name), "-")
+			if key.Field == "" {
+				return nil, errors.New("_sort: empty field name")
+			}
+			if f, ok := schemaField(entity.Schema, strings.Split(key.Field, ".")); ok {
+				key.field = &f
+			}
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+// Sorts decoded records, records missing a field come last whatever the order.
+// The sort is stable so records with equal keys keep their store order.
+func SortRecords(records []map[string]any, keys []SortKey) {
+	slices.SortStableFunc(records, func(a, b map[string]any) int {
+		for _, key := range keys {
+			if c := key.compare(a, b); c != 0 {
+				return c
+			}
+		}
+		return 0
+	})
+}
+
+func (k SortKey) compare(a, b map[string]any) int {
+	path := strings.Split(k.Field, ".")
+	va, vb := sortValue(lookup(a, path)), sortValue(lookup(b, path))
+	switch {
+	case va == nil && vb == nil:
+		return 0
+	case va == nil:
+		return 1
+	case vb == nil:
+		return -1
+	}
+
+	c := compareValues(k.normalize(va), k.normalize(vb))
+	if k.Desc {
+		return -c
+	}
+	return c
+}
+
+// Returns the first value of a field, or nil if it's missing
+func sortValue(values []any) any {
+	if len(values) == 0 {
+		return nil
+	}
+	return values[0]
+}
+
+// Converts a value to the type it's compared as
+func (k SortKey) normalize(v any) any {
+	if k.field == nil {
+		return v
+	}
+	switch k.field.Kind {
+	case NumberType:
+		if s, ok := v.(string); ok {
+			if n, err := strconv.ParseFloat(s, 64); err == nil {
+				return n
+			}
+		}
+	case DateType:
+		s, ok := v.(string)
+		if !ok {
+			break
+		}
+		layout := dateLayout(*k.field)
+		if layout == "" {
+			layout = time.RFC3339
+		}
+		if t, err := time.Parse(layout, s); err == nil {
+			return float64(t.UnixNano())
+		}
+		if t, err := parseDate(s); err == nil {
+			return float64(t.UnixNano())
+		}
+	}
+	return v
+}
+
+// Orders two json values, values of different types are ordered by type
+func compareValues(a, b any) int {
+	ra, rb := typeRank(a), typeRank(b)
+	if ra != rb {
+		return ra - rb
+	}
+
+	switch a := a.(type) {
+	case float64:
+		b := b.(float64)
+		switch {
+		case a < b:
+			return -1
+		case a > b:
+			return 1
+		}
+		return 0
+	case bool:
+		b := b.(bool)
+		switch {
+		case a == b:
+			return 0
+		case !a:
+			return -1
+		}
+		return 1
+	case string:
+		return strings.Compare(a, b.(string))
+	}
+	return 0
+}
+
+func typeRank(v any) int {
+	switch v.(type) {
+	case bool:
+		return 0
+	case float64:
+		return 1
+	case string:
+		return 2
+	}
+	return 3
+}
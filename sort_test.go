@@ -0,0 +1,74 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+var products = Entity{
+	Name: "products",
+	Schema: []Field{
+		{Name: "name", Kind: StringType},
+		{Name: "price", Kind: NumberType},
+		{Name: "created", Kind: DateType, Options: map[string]any{"format": "02/01/2006"}},
+		{Name: "details", Kind: ObjectType, Schema: []Field{{Name: "weight", Kind: NumberType}}},
+	},
+}
+
+var productRecords = [][]byte{
+	record(1, "name", "b", "price", 10, "created", "05/03/2021", "misc", true, "details", map[string]any{"weight": 3}),
+	record(2, "name", "a", "price", 9.5, "created", "01/12/2020", "misc", "x", "details", map[string]any{"weight": 12}),
+	record(3, "name", "c", "price", 100, "created", "05/03/2021", "misc", 3),
+	// A number written as a string is still sorted as a number
+	record(4, "name", "a", "price", "20", "created", "20/01/2021", "misc", false, "details", map[string]any{"weight": 1}),
+	record(5, "name", "b"),
+}
+
+func TestSortHandler(t *testing.T) {
+	forEachStore(t, func(t *testing.T, db Store) {
+		h := testServer(t, db, []Entity{products}, map[string][][]byte{"products": productRecords})
+		for _, test := range []struct {
+			query string
+			want  []string
+		}{
+			// Numerically, not as text, and records missing the field come last whatever the order
+			{"_sort=price", []string{"2", "1", "4", "3", "5"}},
+			{"_sort=-price", []string{"3", "4", "1", "2", "5"}},
+			// Equal keys are ordered by the next ones, then by id
+			{"_sort=name,-price", []string{"4", "2", "1", "5", "3"}},
+			{"_sort=name&_sort=-price", []string{"4", "2", "1", "5", "3"}},
+			{"_sort=-name,price", []string{"3", "1", "5", "2", "4"}},
+			// Dates chronologically whatever their format
+			{"_sort=created", []string{"2", "4", "1", "3", "5"}},
+			{"_sort=-created", []string{"1", "3", "4", "2", "5"}},
+			{"_sort=details.weight", []string{"4", "1", "2", "3", "5"}},
+			// Fields outside of the schema with mixed types: booleans, then numbers, then strings
+			{"_sort=misc", []string{"4", "1", "3", "2", "5"}},
+			{"_sort=-misc", []string{"2", "3", "1", "4", "5"}},
+			// Filtered, then sorted, then paginated
+			{"_sort=-price&name_ne=c", []string{"4", "1", "2", "5"}},
+			{"_sort=price&_page=2&_limit=2", []string{"4", "3"}},
+			{"_sort=price&_start=3", []string{"3", "5"}},
+		} {
+			w := serve(h, "GET", "/products?"+test.query, "")
+			if w.Code != 200 {
+				t.Fatalf("%s: got %d %s", test.query, w.Code, w.Body)
+			}
+			if got := responseIDs(t, w); !slices.Equal(got, test.want) {
+				t.Errorf("%s: got %v, want %v", test.query, got, test.want)
+			}
+		}
+
+		// A cursor page follows the sorted order
+		w := serve(h, "GET", "/products?_sort=price&_cursor="+encodeCursor("1")+"&_limit=2", "")
+		if got := responseIDs(t, w); !slices.Equal(got, []string{"4", "3"}) || w.Header().Get("X-Total-Count") != "5" {
+			t.Errorf("cursor page: got %v of %s, want [4 3] of 5", got, w.Header().Get("X-Total-Count"))
+		}
+
+		for _, query := range []string{"_sort=", "_sort=name,,price", "_sort=-"} {
+			if w := serve(h, "GET", "/products?"+query, ""); w.Code != 400 {
+				t.Errorf("%s: got %d, want 400", query, w.Code)
+			}
+		}
+	})
+}
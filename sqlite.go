@@ -0,0 +1,656 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// Store keeping every entity in a table of a SQLite file.
+// A record is the json document of its `_doc` column, keyed by its encoded id in `_key`,
+// and the top-level fields of the schema are generated columns typed from the field types,
+// so the data reads like regular tables in a SQL client.
+type SQLiteDB struct {
+	db *sql.DB
+	mu sync.Mutex // serializes the writes, SQLite has a single writer
+
+	schemaMu sync.RWMutex
+	entities map[string]Entity // entities by name, for the columns and the queries
+	tables   map[string]bool   // tables created so far
+}
+
+// Holds the stored schema and the autoincrement counters
+const sqliteMeta = "_serveur"
+
+// Columns of the fields by type, fields that aren't listed hold json (objects, arrays and addresses)
+var sqliteTypes = map[FieldType]string{
+	NumberType:    "NUMERIC",
+	BooleanType:   "BOOLEAN",
+	DateType:      "TEXT",
+	StringType:    "TEXT",
+	NameType:      "TEXT",
+	UsernameType:  "TEXT",
+	FullnameType:  "TEXT",
+	EmailType:     "TEXT",
+	UrlType:       "TEXT",
+	IpType:        "TEXT",
+	UuidType:      "TEXT",
+	IdType:        "TEXT",
+	PhoneType:     "TEXT",
+	ParagraphType: "TEXT",
+	RefType:       "", // ids are strings or integers
+}
+
+func NewSQLiteDB(isInMemory bool, path string) (*SQLiteDB, error) {
+	dsn := "file:" + path + "?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)"
+	if isInMemory {
+		dsn = ":memory:"
+	}
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+	// Every connection to :memory: opens a database of its own
+	if isInMemory {
+		db.SetMaxOpenConns(1)
+	}
+	s := &SQLiteDB{db: db, entities: make(map[string]Entity), tables: make(map[string]bool)}
+	if err := s.open(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Creates the meta table and reads the tables and the schema of the file
+func (s *SQLiteDB) open() error {
+	_, err := s.db.Exec(`CREATE TABLE IF NOT EXISTS ` + sqlName(sqliteMeta) + ` ("key" TEXT PRIMARY KEY, "value" BLOB)`)
+	if err != nil {
+		return err
+	}
+	tables, err := s.tableNames()
+	if err != nil {
+		return err
+	}
+	for _, name := range tables {
+		s.tables[name] = true
+	}
+	schema, err := s.GetSchema()
+	if err != nil {
+		return err
+	}
+	for _, e := range schema {
+		s.entities[e.Name] = e
+	}
+	return nil
+}
+
+func (s *SQLiteDB) tableNames() ([]string, error) {
+	rows, err := s.db.Query(`SELECT name FROM sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%' AND name != ?`, sqliteMeta)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	names := make([]string, 0)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+func (s *SQLiteDB) Close() error {
+	return s.db.Close()
+}
+
+// Drops every table
+func (s *SQLiteDB) Clear() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tables, err := s.tableNames()
+	if err != nil {
+		return err
+	}
+	for _, name := range tables {
+		if _, err := s.db.Exec(`DROP TABLE ` + sqlName(name)); err != nil {
+			return err
+		}
+	}
+	if _, err := s.db.Exec(`DELETE FROM ` + sqlName(sqliteMeta)); err != nil {
+		return err
+	}
+
+	s.schemaMu.Lock()
+	defer s.schemaMu.Unlock()
+	s.entities = make(map[string]Entity)
+	s.tables = make(map[string]bool)
+	return nil
+}
+
+func (s *SQLiteDB) entity(name string) Entity {
+	s.schemaMu.RLock()
+	defer s.schemaMu.RUnlock()
+	if e, ok := s.entities[name]; ok {
+		return e
+	}
+	return Entity{Name: name}
+}
+
+func (s *SQLiteDB) hasTable(name string) bool {
+	s.schemaMu.RLock()
+	defer s.schemaMu.RUnlock()
+	return s.tables[name]
+}
+
+// Creates the table of an entity, or changes its columns to the ones of the schema
+func (s *SQLiteDB) ensureTable(e Entity) error {
+	idType := "TEXT"
+	if e.IDStrategy == AutoIncrementStrategy {
+		idType = "INTEGER"
+	}
+	if key := e.NaturalKey(); key != "" {
+		if f, ok := schemaField(e.Schema, []string{key}); ok {
+			idType = sqliteTypes[f.Kind]
+		}
+	}
+	names := []string{"id"}
+	types := map[string]string{"id": idType}
+	for _, f := range e.Schema {
+		if _, ok := types[f.Name]; ok || f.Name == "_key" || f.Name == "_doc" {
+			continue
+		}
+		kind, ok := sqliteTypes[f.Kind]
+		if many, _ := f.Options["many"].(bool); !ok || many {
+			kind = "TEXT"
+		}
+		names = append(names, f.Name)
+		types[f.Name] = kind
+	}
+
+	if !s.hasTable(e.Name) {
+		columns := make([]string, 0, len(names))
+		for _, name := range names {
+			columns = append(columns, sqlColumn(name, types[name]))
+		}
+		_, err := s.db.Exec(`CREATE TABLE IF NOT EXISTS ` + sqlName(e.Name) + ` ("_key" BLOB PRIMARY KEY, "_doc" TEXT NOT NULL, ` +
+			strings.Join(columns, ", ") + `) WITHOUT ROWID`)
+		if err != nil {
+			return err
+		}
+	} else {
+		// Generated columns hold no data, the ones of removed or retyped fields are dropped
+		existing, err := s.columns(e.Name)
+		if err != nil {
+			return err
+		}
+		for name, kind := range existing {
+			if wanted, ok := types[name]; !ok || wanted != kind {
+				if _, err := s.db.Exec(`ALTER TABLE ` + sqlName(e.Name) + ` DROP COLUMN ` + sqlName(name)); err != nil {
+					return err
+				}
+			}
+		}
+		for _, name := range names {
+			if kind, ok := existing[name]; !ok || kind != types[name] {
+				if _, err := s.db.Exec(`ALTER TABLE ` + sqlName(e.Name) + ` ADD COLUMN ` + sqlColumn(name, types[name])); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	s.schemaMu.Lock()
+	defer s.schemaMu.Unlock()
+	s.tables[e.Name] = true
+	return nil
+}
+
+// Returns a column generated from a top-level field of the documents
+func sqlColumn(name string, kind string) string {
+	return fmt.Sprintf(`%s %s GENERATED ALWAYS AS (%s) VIRTUAL`, sqlName(name), kind, sqlValue([]string{name}))
+}
+
+// Returns the types of the generated columns of a table by name
+func (s *SQLiteDB) columns(table string) (map[string]string, error) {
+	rows, err := s.db.Query(`SELECT name, type FROM pragma_table_xinfo(?) WHERE hidden != 0`, table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	columns := make(map[string]string)
+	for rows.Next() {
+		var name, kind string
+		if err := rows.Scan(&name, &kind); err != nil {
+			return nil, err
+		}
+		columns[name] = kind
+	}
+	return columns, rows.Err()
+}
+
+func (s *SQLiteDB) GetAll(entityname string, valid *Validtor) ([][]byte, error) {
+	result := make([][]byte, 0)
+	if !s.hasTable(entityname) {
+		return result, nil
+	}
+	// The filters that can be written in SQL are checked by SQLite, the validator checks them again
+	var filters []Filter
+	if valid != nil {
+		filters = valid.filters
+	}
+	where, args := sqlWhere(filters, s.entity(entityname))
+	where, args = sqlAfter(where, args, valid)
+	rows, err := s.db.Query(`SELECT "_doc" FROM `+sqlName(entityname)+` WHERE `+where+` ORDER BY "_key"`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for !valid.done(result) && rows.Next() {
+		var value []byte
+		if err := rows.Scan(&value); err != nil {
+			return nil, err
+		}
+		if valid.keeps(value) {
+			result = append(result, value)
+		}
+	}
+	return result, rows.Err()
+}
+
+func (s *SQLiteDB) Count(entityname string, valid *Validtor) (int, error) {
+	if valid.validates() {
+		return countKept(s, entityname, valid)
+	}
+	if !s.hasTable(entityname) {
+		return 0, nil
+	}
+	where, args := sqlAfter("1", nil, valid)
+	n := 0
+	err := s.db.QueryRow(`SELECT count(*) FROM `+sqlName(entityname)+` WHERE `+where, args...).Scan(&n)
+	return n, err
+}
+
+// Adds the start of the records read with a validator to SQL conditions
+func sqlAfter(where string, args []any, valid *Validtor) (string, []any) {
+	if valid == nil || valid.after == nil {
+		return where, args
+	}
+	return where + ` AND "_key" > ?`, append(args, valid.after)
+}
+
+func (s *SQLiteDB) Get(entityname string, key []byte) ([]byte, error) {
+	if !s.hasTable(entityname) {
+		return nil, ErrNotFound
+	}
+	var value []byte
+	err := s.db.QueryRow(`SELECT "_doc" FROM `+sqlName(entityname)+` WHERE "_key" = ?`, EncodeKey(string(key))).Scan(&value)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	return value, err
+}
+
+// Writes a record, fails with ErrConflict if a unique value is taken
+func (s *SQLiteDB) Set(entityname string, key []byte, value []byte) error {
+	if !s.hasTable(entityname) {
+		if err := s.ensureTable(s.entity(entityname)); err != nil {
+			return err
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err := s.db.Exec(`INSERT INTO `+sqlName(entityname)+` ("_key", "_doc") VALUES (?, ?)
+		ON CONFLICT ("_key") DO UPDATE SET "_doc" = excluded."_doc"`, EncodeKey(string(key)), value)
+	return sqliteError(err)
+}
+
+// Writes a new record, fails with ErrExists if a record has the key
+func (s *SQLiteDB) Create(entityname string, key []byte, value []byte) error {
+	if !s.hasTable(entityname) {
+		if err := s.ensureTable(s.entity(entityname)); err != nil {
+			return err
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err := s.db.Exec(`INSERT INTO `+sqlName(entityname)+` ("_key", "_doc") VALUES (?, ?)`, EncodeKey(string(key)), value)
+	return sqliteError(err)
+}
+
+// Deletes a record and returns it, the check runs on the record in the same transaction
+func (s *SQLiteDB) Delete(entityname string, key []byte, check func(value []byte) error) ([]byte, error) {
+	if !s.hasTable(entityname) {
+		return nil, ErrNotFound
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var value []byte
+	err = tx.QueryRow(`DELETE FROM `+sqlName(entityname)+` WHERE "_key" = ? RETURNING "_doc"`, EncodeKey(string(key))).Scan(&value)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	// The deletion is rolled back if the check fails
+	if check != nil {
+		if err := check(value); err != nil {
+			return nil, err
+		}
+	}
+	return value, tx.Commit()
+}
+
+// Replaces a record by the result of the patch function and returns it.
+// The record is read, patched and written in the same transaction.
+func (s *SQLiteDB) Patch(entityname string, key []byte, patch func(value []byte) ([]byte, error)) ([]byte, error) {
+	if !s.hasTable(entityname) {
+		return nil, ErrNotFound
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var value []byte
+	err = tx.QueryRow(`SELECT "_doc" FROM `+sqlName(entityname)+` WHERE "_key" = ?`, EncodeKey(string(key))).Scan(&value)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	result, err := patch(value)
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.Exec(`UPDATE `+sqlName(entityname)+` SET "_doc" = ? WHERE "_key" = ?`, result, EncodeKey(string(key)))
+	if err != nil {
+		return nil, sqliteError(err)
+	}
+	return result, tx.Commit()
+}
+
+// Reads the records of every given entity in a single transaction,
+// so the result is a consistent snapshot of the database
+func (s *SQLiteDB) Dump(entitynames []string) (map[string][][]byte, error) {
+	tx, err := s.db.BeginTx(context.Background(), &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	result := make(map[string][][]byte, len(entitynames))
+	for _, entityname := range entitynames {
+		records := make([][]byte, 0)
+		if s.hasTable(entityname) {
+			rows, err := tx.Query(`SELECT "_doc" FROM ` + sqlName(entityname) + ` ORDER BY "_key"`)
+			if err != nil {
+				return nil, err
+			}
+			for rows.Next() {
+				var value []byte
+				if err := rows.Scan(&value); err != nil {
+					rows.Close()
+					return nil, err
+				}
+				records = append(records, value)
+			}
+			rows.Close()
+			if err := rows.Err(); err != nil {
+				return nil, err
+			}
+		}
+		result[entityname] = records
+	}
+	return result, nil
+}
+
+// Applies the writes in a single SQL transaction
+func (s *SQLiteDB) Batch(writes []Write) error {
+	for _, w := range writes {
+		if w.Value != nil && !s.hasTable(w.Entity) {
+			if err := s.ensureTable(s.entity(w.Entity)); err != nil {
+				return err
+			}
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	written := make(map[string]int64)
+	for _, w := range writes {
+		switch {
+		case w.Value != nil:
+			_, err = tx.Exec(`INSERT INTO `+sqlName(w.Entity)+` ("_key", "_doc") VALUES (?, ?)
+				ON CONFLICT ("_key") DO UPDATE SET "_doc" = excluded."_doc"`, EncodeKey(string(w.Key)), w.Value)
+		case s.hasTable(w.Entity):
+			_, err = tx.Exec(`DELETE FROM `+sqlName(w.Entity)+` WHERE "_key" = ?`, EncodeKey(string(w.Key)))
+		}
+		if err != nil {
+			return fmt.Errorf("%s %s: %w", w.Entity, w.Key, sqliteError(err))
+		}
+		if n, ok := intID(string(w.Key)); ok && w.Value != nil {
+			written[w.Entity] = max(written[w.Entity], n)
+		}
+	}
+
+	// Entities without a counter start after their greatest id anyway
+	for entityname, n := range written {
+		_, err := tx.Exec(`UPDATE `+sqlName(sqliteMeta)+` SET "value" = MAX("value", ?) WHERE "key" = ?`, n, privateSequence+entityname)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Returns the next id of an autoincrement entity.
+// The counter is kept in the meta table, it starts after the greatest integer id of the entity.
+func (s *SQLiteDB) NextID(entityname string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	last, err := s.lastID(tx, entityname)
+	if err != nil {
+		return 0, err
+	}
+	next := last + 1
+	_, err = tx.Exec(`INSERT INTO `+sqlName(sqliteMeta)+` ("key", "value") VALUES (?, ?)
+		ON CONFLICT ("key") DO UPDATE SET "value" = excluded."value"`, privateSequence+entityname, next)
+	if err != nil {
+		return 0, err
+	}
+	return next, tx.Commit()
+}
+
+func (s *SQLiteDB) LastID(entityname string) (int64, error) {
+	tx, err := s.db.BeginTx(context.Background(), &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	return s.lastID(tx, entityname)
+}
+
+// Returns the counter of an entity, or its greatest integer id if it has no counter yet
+func (s *SQLiteDB) lastID(tx *sql.Tx, entityname string) (int64, error) {
+	var last int64
+	err := tx.QueryRow(`SELECT "value" FROM `+sqlName(sqliteMeta)+` WHERE "key" = ?`, privateSequence+entityname).Scan(&last)
+	if errors.Is(err, sql.ErrNoRows) && s.hasTable(entityname) {
+		var key []byte
+		err = tx.QueryRow(`SELECT "_key" FROM `+sqlName(entityname)+` WHERE "_key" <= ? ORDER BY "_key" DESC LIMIT 1`, maxIntKey).Scan(&key)
+		if err == nil {
+			n, _ := intID(DecodeKey(key))
+			last = max(n, 0)
+		}
+	}
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return 0, err
+	}
+	return last, nil
+}
+
+// Creates the indexes of the indexed fields, and drops the ones of the fields that aren't indexed anymore.
+// Fails with ErrConflict if the records have duplicate unique values.
+func (s *SQLiteDB) SetIndexes(entities []Entity) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	indexes := indexedFields(entities)
+	for _, e := range entities {
+		if len(indexes[e.Name]) == 0 && !s.hasTable(e.Name) {
+			continue
+		}
+		s.schemaMu.Lock()
+		if _, ok := s.entities[e.Name]; !ok {
+			s.entities[e.Name] = e
+		}
+		s.schemaMu.Unlock()
+		if err := s.ensureTable(e); err != nil {
+			return err
+		}
+
+		wanted := make(map[string]string)
+		for _, f := range indexes[e.Name] {
+			index := e.Name + "." + f.Name
+			unique := ""
+			if isUnique(f) {
+				index += ".unique"
+				unique = "UNIQUE "
+			}
+			wanted[index] = `CREATE ` + unique + `INDEX ` + sqlName(index) + ` ON ` + sqlName(e.Name) + ` (` + sqlValue([]string{f.Name}) + `)`
+		}
+
+		rows, err := s.db.Query(`SELECT name FROM sqlite_master WHERE type = 'index' AND tbl_name = ? AND sql IS NOT NULL`, e.Name)
+		if err != nil {
+			return err
+		}
+		existing := make([]string, 0)
+		for rows.Next() {
+			var name string
+			if err := rows.Scan(&name); err != nil {
+				rows.Close()
+				return err
+			}
+			existing = append(existing, name)
+		}
+		rows.Close()
+
+		for _, name := range existing {
+			if _, ok := wanted[name]; !ok {
+				if _, err := s.db.Exec(`DROP INDEX ` + sqlName(name)); err != nil {
+					return err
+				}
+			}
+		}
+		for _, f := range indexes[e.Name] {
+			index := e.Name + "." + f.Name
+			if isUnique(f) {
+				index += ".unique"
+			}
+			if slices.Contains(existing, index) {
+				continue
+			}
+			if _, err := s.db.Exec(wanted[index]); err != nil {
+				if isConstraintError(err) {
+					return fmt.Errorf("%w: %s.%s has duplicates", ErrConflict, e.Name, f.Name)
+				}
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *SQLiteDB) GetSchema() ([]Entity, error) {
+	var value []byte
+	err := s.db.QueryRow(`SELECT "value" FROM `+sqlName(sqliteMeta)+` WHERE "key" = ?`, privateSchema).Scan(&value)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var result []Entity
+	if err := json.Unmarshal(value, &result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Stores the schema and creates the tables of its entities
+func (s *SQLiteDB) StoreSchema(schema []Entity) error {
+	value, err := json.Marshal(schema)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.db.Exec(`INSERT INTO `+sqlName(sqliteMeta)+` ("key", "value") VALUES (?, ?)
+		ON CONFLICT ("key") DO UPDATE SET "value" = excluded."value"`, privateSchema, value)
+	if err != nil {
+		return err
+	}
+	for _, e := range schema {
+		s.schemaMu.Lock()
+		s.entities[e.Name] = e
+		s.schemaMu.Unlock()
+		if err := s.ensureTable(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reports unique constraint violations as ErrConflict, with the name of the field,
+// and primary key violations as ErrExists
+func sqliteError(err error) error {
+	var e *sqlite.Error
+	if errors.As(err, &e) && e.Code() == sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY {
+		return ErrExists
+	}
+	if !isConstraintError(err) {
+		return err
+	}
+	// SQLite names the index: "UNIQUE constraint failed: index 'users.email.unique'"
+	_, index, _ := strings.Cut(err.Error(), "'")
+	index, _, _ = strings.Cut(index, "'")
+	field := strings.TrimSuffix(index, ".unique")
+	field = field[strings.LastIndex(field, ".")+1:]
+	return fmt.Errorf("%w: %s is already taken", ErrConflict, field)
+}
+
+func isConstraintError(err error) bool {
+	var e *sqlite.Error
+	return errors.As(err, &e) && e.Code() == sqlite3.SQLITE_CONSTRAINT_UNIQUE
+}
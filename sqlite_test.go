@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// Query must return what the list route computes in memory from GetAll
+func TestSQLiteQuery(t *testing.T) {
+	db, err := NewSQLiteDB(false, filepath.Join(t.TempDir(), "db.sqlite"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	entity := Entity{Name: "users", Schema: []Field{
+		{Name: "age", Kind: NumberType, Options: map[string]any{"indexed": true}},
+		{Name: "status", Kind: StringType},
+		{Name: "joined", Kind: DateType, Options: map[string]any{"format": "02/01/2006"}},
+	}}
+	if err := db.StoreSchema([]Entity{entity}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetIndexes([]Entity{entity}); err != nil {
+		t.Fatal(err)
+	}
+	statuses := []any{"active", "draft", nil, true, []any{"active", "draft"}}
+	for i := 1; i <= 30; i++ {
+		fields := []any{"status", statuses[i%len(statuses)], "joined", fmt.Sprintf("%02d/%02d/2020", i%28+1, i%12+1)}
+		if i%7 != 0 {
+			fields = append(fields, "age", i*37%50)
+		}
+		if i%11 == 0 {
+			// Values that don't follow the schema are still compared like the other stores do
+			fields = append(fields, "age", fmt.Sprint(i))
+		}
+		mustSet(t, db, "users", fmt.Sprint(i), record(i, fields...))
+	}
+
+	for _, query := range []string{
+		"",
+		"status=active",
+		"status=null",
+		"status=true",
+		"status_ne=draft&age_gte=10",
+		"age_gte=10&age_lte=30",
+		"age_lte=20",
+		"age_gte=2",
+		"age_in=0,1,22,33",
+		"age=null",
+		"status_like=^ac",
+		"_sort=age",
+		"_sort=-age,status",
+		"_sort=joined",
+		"_sort=-status&_page=2&_limit=4",
+		"_sort=age&age_gte=5&_start=3&_end=8",
+		"_page=3&_limit=5",
+		"_cursor=" + encodeCursor("12") + "&_limit=5",
+		"_sort=joined&_cursor=" + encodeCursor("12") + "&_limit=5",
+		"_sort=joined&_cursor=" + encodeCursor("99") + "&_limit=5",
+	} {
+		t.Run(query, func(t *testing.T) {
+			values, _ := url.ParseQuery(query)
+			filters, err := ParseFilters(values)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sortKeys, err := ParseSort(values, entity)
+			if err != nil {
+				t.Fatal(err)
+			}
+			page, err := ParsePagination(values)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			all, err := db.GetAll("users", FilterValidator(filters))
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, err := decodeRecords(all)
+			if err != nil {
+				t.Fatal(err)
+			}
+			SortRecords(want, sortKeys)
+			var wantPage *Pagination
+			if page != nil {
+				p := *page
+				wantPage = &p
+				want = wantPage.Slice(want)
+			}
+
+			records, err := db.Query("users", filters, sortKeys, page)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make([]string, 0, len(records))
+			for _, r := range records {
+				got = append(got, recordID(r))
+			}
+			wantIDs := make([]string, 0, len(want))
+			for _, r := range want {
+				wantIDs = append(wantIDs, FormatID(r["id"]))
+			}
+			if !slices.Equal(got, wantIDs) {
+				t.Fatalf("got %v, want %v", got, wantIDs)
+			}
+			if page != nil && (page.Total != wantPage.Total || page.Last != wantPage.Last) {
+				b, _ := json.Marshal([]any{page, wantPage})
+				t.Fatalf("pagination: got %s", b)
+			}
+		})
+	}
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"modernc.org/sqlite"
+)
+
+// Stores that can filter, sort and paginate the records themselves.
+// Query returns the records of the page and fills its totals, or every matching record when page is nil.
+type Querier interface {
+	Query(entityname string, filters []Filter, sortKeys []SortKey, page *Pagination) ([][]byte, error)
+}
+
+// The SQLite queries check the filters and compute the sort values of the records with these functions,
+// so the results are the same as the other stores whatever the records hold
+func init() {
+	sqlite.MustRegisterDeterministicScalarFunction("serveur_match", 2, sqlMatch)
+	sqlite.MustRegisterDeterministicScalarFunction("serveur_sort_rank", 4, sqlSortRank)
+	sqlite.MustRegisterDeterministicScalarFunction("serveur_sort_value", 4, sqlSortValue)
+}
+
+// Lists the records matching the filters in the order of the sort keys.
+// Filters are checked by SQLite, the ones on top-level fields of the schema are written as SQL conditions
+// on the indexed expressions. The page is cut out with LIMIT and OFFSET, a cursor page starts after its record.
+func (s *SQLiteDB) Query(entityname string, filters []Filter, sortKeys []SortKey, page *Pagination) ([][]byte, error) {
+	result := make([][]byte, 0)
+	if !s.hasTable(entityname) {
+		if page != nil {
+			page.Done(result, 0)
+		}
+		return result, nil
+	}
+
+	where, args := sqlWhere(filters, s.entity(entityname))
+	if len(filters) > 0 {
+		where += ` AND serveur_match(?, "_doc")`
+		args = append(args, encodeFilters(filters))
+	}
+	table := sqlName(entityname)
+
+	total := 0
+	if page != nil {
+		if err := s.db.QueryRow(`SELECT count(*) FROM `+table+` WHERE `+where, args...).Scan(&total); err != nil {
+			return nil, err
+		}
+	}
+
+	order := make([]string, 0, 3*len(sortKeys)+1)
+	for _, key := range sortKeys {
+		kind, format := "", ""
+		if key.field != nil {
+			kind, format = string(key.field.Kind), dateLayout(*key.field)
+		}
+		rank := fmt.Sprintf(`serveur_sort_rank(%s, %s, %s, "_doc")`, sqlString(key.Field), sqlString(kind), sqlString(format))
+		value := fmt.Sprintf(`serveur_sort_value(%s, %s, %s, "_doc")`, sqlString(key.Field), sqlString(kind), sqlString(format))
+		desc := ""
+		if key.Desc {
+			desc = " DESC"
+		}
+		// Records missing the field come last whatever the order
+		order = append(order, rank+" IS NULL", rank+desc, value+desc)
+	}
+	order = append(order, `"_key"`)
+
+	query := `SELECT "_doc" FROM ` + table + ` WHERE ` + where + ` ORDER BY ` + strings.Join(order, ", ")
+	if page != nil && page.After != "" {
+		if len(sortKeys) == 0 {
+			query = `SELECT "_doc" FROM ` + table + ` WHERE ` + where + ` AND "_key" > ? ORDER BY "_key"`
+			args = append(args, EncodeKey(page.After))
+		} else {
+			// The page starts after the position of the cursor record in the sorted list, it's empty if that record is gone
+			query = `WITH sorted AS (SELECT "_key", "_doc", row_number() OVER (ORDER BY ` + strings.Join(order, ", ") + `) AS n FROM ` +
+				table + ` WHERE ` + where + `) SELECT "_doc" FROM sorted WHERE n > (SELECT n FROM sorted WHERE "_key" = ?) ORDER BY n`
+			args = append(args, EncodeKey(page.After))
+		}
+	}
+	if page != nil {
+		query += ` LIMIT ? OFFSET ?`
+		args = append(args, page.Limit, page.Offset)
+	}
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var value []byte
+		if err := rows.Scan(&value); err != nil {
+			return nil, err
+		}
+		result = append(result, value)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if page != nil {
+		page.Done(result, total)
+	}
+	return result, nil
+}
+
+// Returns the SQL conditions keeping the records that can match the filters, and their arguments.
+// Equality and range filters on top-level fields of the schema are compared to the value of the field
+// like the Badger indexes compare them, so the records found are a superset of the matching ones.
+// Arrays are kept too, any of their values can match.
+func sqlWhere(filters []Filter, entity Entity) (string, []any) {
+	conditions := make([]string, 0)
+	args := make([]any, 0)
+	ranged := make(map[string]bool)
+	for _, f := range filters {
+		field, ok := schemaField(entity.Schema, []string{f.Field})
+		if !ok || strings.Contains(f.Field, `"`) || strings.Contains(f.Field, ".") {
+			continue
+		}
+		if many, _ := field.Options["many"].(bool); many || field.Kind == ObjectType || field.Kind == ArrayType || field.Kind == AddressType {
+			continue
+		}
+		value := sqlValue([]string{f.Field})
+
+		switch f.Operator {
+		case EqOperator, InOperator:
+			values := make([]string, 0)
+			null := false
+			for _, q := range f.Values {
+				for _, v := range queryValues(q) {
+					switch v := v.(type) {
+					case nil:
+						null = true
+					case bool:
+						// json_extract reads booleans as 0 and 1
+						values = append(values, "?")
+						args = append(args, map[bool]int{false: 0, true: 1}[v])
+					default:
+						values = append(values, "?")
+						args = append(args, v)
+					}
+				}
+			}
+			condition := value + ` IN (` + strings.Join(values, ", ") + `)`
+			if null {
+				condition += ` OR ` + value + ` IS NULL`
+			}
+			conditions = append(conditions, `(`+condition+` OR `+sqlArray(value)+`)`)
+
+		case GteOperator, LteOperator:
+			// Range filters on the same field are combined into a range per type
+			if ranged[f.Field] {
+				continue
+			}
+			ranged[f.Field] = true
+			numbers := make([]string, 0, 2)
+			strs := make([]string, 0, 2)
+			numberArgs := make([]any, 0, 2)
+			stringArgs := make([]any, 0, 2)
+			for _, bound := range filters {
+				if bound.Field != f.Field || bound.Operator != GteOperator && bound.Operator != LteOperator {
+					continue
+				}
+				op := " >= ?"
+				if bound.Operator == LteOperator {
+					op = " <= ?"
+				}
+				if n, err := strconv.ParseFloat(bound.Values[0], 64); err == nil && numbers != nil {
+					numbers = append(numbers, value+op)
+					numberArgs = append(numberArgs, n)
+				} else {
+					// Numbers only compare to numeric query values
+					numbers = nil
+				}
+				strs = append(strs, value+op)
+				stringArgs = append(stringArgs, bound.Values[0])
+			}
+			condition := `(` + strings.Join(strs, " AND ") + `)`
+			if numbers != nil {
+				condition = `(` + strings.Join(numbers, " AND ") + `) OR ` + condition
+				args = append(args, numberArgs...)
+			}
+			args = append(args, stringArgs...)
+			conditions = append(conditions, `(`+condition+` OR `+sqlArray(value)+`)`)
+		}
+	}
+	if len(conditions) == 0 {
+		return "1", args
+	}
+	return strings.Join(conditions, " AND "), args
+}
+
+// Returns a condition keeping the values that are json arrays,
+// json_extract returns them as text and the range can be read from an index
+func sqlArray(value string) string {
+	return `(` + value + ` >= '[' AND ` + value + ` < '\')`
+}
+
+// Returns the value of a field of the documents, as read by the columns and the indexes
+func sqlValue(path []string) string {
+	return `json_extract("_doc", ` + sqlString(jsonPath(path)) + `)`
+}
+
+// Returns the SQLite json path of a field, every key is quoted so names can hold dots
+func jsonPath(path []string) string {
+	var b strings.Builder
+	b.WriteString("$")
+	for _, key := range path {
+		b.WriteString(`."` + key + `"`)
+	}
+	return b.String()
+}
+
+// Quotes a table, column or index name
+func sqlName(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// Quotes a string literal
+func sqlString(s string) string {
+	return `'` + strings.ReplaceAll(s, `'`, `''`) + `'`
+}
+
+// Filters are handed to serveur_match as a query string, they're parsed once per query string
+var sqlFilters = struct {
+	sync.Mutex
+	parsed map[string][]Filter
+}{parsed: make(map[string][]Filter)}
+
+func encodeFilters(filters []Filter) string {
+	query := url.Values{}
+	for _, f := range filters {
+		key := f.Field
+		if f.Operator != EqOperator {
+			key += "_" + f.Operator
+		}
+		if f.Operator == InOperator {
+			query.Add(key, strings.Join(f.Values, ","))
+			continue
+		}
+		for _, v := range f.Values {
+			query.Add(key, v)
+		}
+	}
+	return query.Encode()
+}
+
+func decodeFilters(s string) ([]Filter, error) {
+	sqlFilters.Lock()
+	defer sqlFilters.Unlock()
+	if filters, ok := sqlFilters.parsed[s]; ok {
+		return filters, nil
+	}
+	query, err := url.ParseQuery(s)
+	if err != nil {
+		return nil, err
+	}
+	filters, err := ParseFilters(query)
+	if err != nil {
+		return nil, err
+	}
+	if len(sqlFilters.parsed) >= 1000 {
+		clear(sqlFilters.parsed)
+	}
+	sqlFilters.parsed[s] = filters
+	return filters, nil
+}
+
+// serveur_match(filters, doc) returns 1 if the document matches the filters, see Filter.Match
+func sqlMatch(_ *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+	filters, err := decodeFilters(sqlText(args[0]))
+	if err != nil {
+		return nil, err
+	}
+	var record map[string]any
+	if err := json.Unmarshal([]byte(sqlText(args[1])), &record); err != nil {
+		return int64(0), nil
+	}
+	if MatchFilters(filters, record) {
+		return int64(1), nil
+	}
+	return int64(0), nil
+}
+
+// serveur_sort_rank(field, kind, format, doc) returns the type rank of the value SortRecords compares,
+// or NULL if the document doesn't have the field
+func sqlSortRank(_ *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+	v, ok := sqlSortKey(args)
+	if !ok {
+		return nil, nil
+	}
+	return int64(typeRank(v)), nil
+}
+
+// serveur_sort_value(field, kind, format, doc) returns the value SortRecords compares, values of the same rank are ordered by SQLite
+func sqlSortValue(_ *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+	v, ok := sqlSortKey(args)
+	if !ok {
+		return nil, nil
+	}
+	switch v := v.(type) {
+	case bool:
+		if v {
+			return int64(1), nil
+		}
+		return int64(0), nil
+	case float64, string:
+		return v, nil
+	}
+	// Lists and objects are equal
+	return int64(0), nil
+}
+
+func sqlSortKey(args []driver.Value) (any, bool) {
+	key := SortKey{Field: sqlText(args[0])}
+	if kind := sqlText(args[1]); kind != "" {
+		key.field = &Field{Kind: FieldType(kind)}
+		if format := sqlText(args[2]); format != "" {
+			key.field.Options = map[string]any{"format": format}
+		}
+	}
+	var record map[string]any
+	if err := json.Unmarshal([]byte(sqlText(args[3])), &record); err != nil {
+		return nil, false
+	}
+	v := sortValue(lookup(record, strings.Split(key.Field, ".")))
+	if v == nil {
+		return nil, false
+	}
+	return key.normalize(v), true
+}
+
+func sqlText(v driver.Value) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	}
+	return ""
+}
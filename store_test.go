@@ -0,0 +1,564 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	badger "github.com/dgraph-io/badger/v4"
+)
+
+// Backends run by the conformance suite, each call returns an empty store
+var testStores = map[StoreKind]func(t *testing.T) Store{
+	BadgerStore: func(t *testing.T) Store {
+		db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &DB{db: db}
+	},
+	MemoryStore: func(t *testing.T) Store {
+		return NewMemDB()
+	},
+	JSONFileStore: func(t *testing.T) Store {
+		db, err := NewJSONFileDB(filepath.Join(t.TempDir(), "db.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return db
+	},
+	SQLiteStore: func(t *testing.T) Store {
+		db, err := NewSQLiteDB(false, filepath.Join(t.TempDir(), "db.sqlite"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return db
+	},
+}
+
+// Runs a test against every backend
+func forEachStore(t *testing.T, test func(t *testing.T, db Store)) {
+	for kind, open := range testStores {
+		t.Run(string(kind), func(t *testing.T) {
+			db := open(t)
+			t.Cleanup(func() { db.Close() })
+			test(t, db)
+		})
+	}
+}
+
+var testEntities = []Entity{{
+	Name:  "users",
+	Count: 2,
+	Schema: []Field{
+		{Name: "email", Kind: EmailType, Options: map[string]any{"unique": true}},
+		{Name: "age", Kind: NumberType, Options: map[string]any{"indexed": true}},
+	},
+}}
+
+func record(id any, fields ...any) []byte {
+	r := map[string]any{"id": id}
+	for i := 0; i+1 < len(fields); i += 2 {
+		r[fields[i].(string)] = fields[i+1]
+	}
+	b, _ := json.Marshal(r)
+	return b
+}
+
+func mustSet(t *testing.T, db Store, entityname string, id string, value []byte) {
+	t.Helper()
+	if err := db.Set(entityname, []byte(id), value); err != nil {
+		t.Fatalf("Set %s %s: %v", entityname, id, err)
+	}
+}
+
+func ids(t *testing.T, records [][]byte) []string {
+	t.Helper()
+	result := make([]string, 0, len(records))
+	for _, r := range records {
+		result = append(result, recordID(r))
+	}
+	return result
+}
+
+func TestStoreCRUD(t *testing.T) {
+	forEachStore(t, func(t *testing.T, db Store) {
+		if _, err := db.Get("users", []byte("1")); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("Get of a missing record: got %v, want ErrNotFound", err)
+		}
+
+		mustSet(t, db, "users", "1", record(1, "name", "ada"))
+		got, err := db.Get("users", []byte("1"))
+		if err != nil || string(got) != string(record(1, "name", "ada")) {
+			t.Fatalf("Get: got %s %v", got, err)
+		}
+		if _, err := db.Get("posts", []byte("1")); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("records are kept per entity: got %v, want ErrNotFound", err)
+		}
+
+		mustSet(t, db, "users", "1", record(1, "name", "grace"))
+		got, _ = db.Get("users", []byte("1"))
+		if string(got) != string(record(1, "name", "grace")) {
+			t.Fatalf("Set doesn't replace the record: got %s", got)
+		}
+
+		refused := errors.New("refused")
+		_, err = db.Delete("users", []byte("1"), func(value []byte) error {
+			if string(value) != string(record(1, "name", "grace")) {
+				t.Errorf("Delete check: got %s", value)
+			}
+			return refused
+		})
+		if !errors.Is(err, refused) {
+			t.Fatalf("Delete: got %v, want the error of the check", err)
+		}
+		if _, err := db.Get("users", []byte("1")); err != nil {
+			t.Fatalf("a refused delete removed the record: %v", err)
+		}
+
+		deleted, err := db.Delete("users", []byte("1"), nil)
+		if err != nil || string(deleted) != string(record(1, "name", "grace")) {
+			t.Fatalf("Delete: got %s %v", deleted, err)
+		}
+		if _, err := db.Get("users", []byte("1")); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("Get of a deleted record: got %v, want ErrNotFound", err)
+		}
+		if _, err := db.Delete("users", []byte("1"), nil); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("Delete of a missing record: got %v, want ErrNotFound", err)
+		}
+	})
+}
+
+func TestStoreCreate(t *testing.T) {
+	forEachStore(t, func(t *testing.T, db Store) {
+		if err := db.Create("users", []byte("1"), record(1, "name", "ada")); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Create("users", []byte("1"), record(1, "name", "grace")); !errors.Is(err, ErrExists) {
+			t.Fatalf("Create of an existing record: got %v, want ErrExists", err)
+		}
+		if got, _ := db.Get("users", []byte("1")); string(got) != string(record(1, "name", "ada")) {
+			t.Fatalf("Create replaced the record: got %s", got)
+		}
+
+		// Only one of concurrent creates with the same id wins
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		created := 0
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				err := db.Create("users", []byte("2"), record(2, "n", i))
+				mu.Lock()
+				defer mu.Unlock()
+				switch {
+				case err == nil:
+					created++
+				case !errors.Is(err, ErrExists):
+					t.Errorf("Create: got %v, want ErrExists", err)
+				}
+			}(i)
+		}
+		wg.Wait()
+		if created != 1 {
+			t.Fatalf("%d concurrent creates succeeded, want 1", created)
+		}
+	})
+}
+
+func TestStoreOrder(t *testing.T) {
+	forEachStore(t, func(t *testing.T, db Store) {
+		for _, id := range []any{10, "b", 2, -1, "a", 100} {
+			mustSet(t, db, "users", FormatID(id), record(id))
+		}
+
+		records, err := db.GetAll("users", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []string{"-1", "2", "10", "100", "a", "b"}
+		if got := ids(t, records); !slices.Equal(got, want) {
+			t.Fatalf("GetAll: got %v, want %v", got, want)
+		}
+
+		dump, err := db.Dump([]string{"users", "posts"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := ids(t, dump["users"]); !slices.Equal(got, want) {
+			t.Fatalf("Dump: got %v, want %v", got, want)
+		}
+		if dump["posts"] == nil || len(dump["posts"]) != 0 {
+			t.Fatalf("Dump of an empty entity: got %v, want an empty list", dump["posts"])
+		}
+	})
+}
+
+func TestStoreValidator(t *testing.T) {
+	forEachStore(t, func(t *testing.T, db Store) {
+		for i := 1; i <= 10; i++ {
+			mustSet(t, db, "users", fmt.Sprint(i), record(i, "age", i*10))
+		}
+
+		filters, err := ParseFilters(map[string][]string{"age_gte": {"30"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen := 0
+		v := FilterValidator(filters)
+		v.validate = append(v.validate, func([]byte) bool { seen++; return true })
+		v.terminate = append(v.terminate, func(result [][]byte) bool { return len(result) >= 3 })
+
+		records, err := db.GetAll("users", v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := ids(t, records), []string{"3", "4", "5"}; !slices.Equal(got, want) {
+			t.Fatalf("GetAll: got %v, want %v", got, want)
+		}
+		if seen != 3 {
+			t.Fatalf("validations run after a failed one or after the end: %d records seen", seen)
+		}
+
+		// The records start after the key of the validator, the ones before aren't read.
+		// Filters on the indexed age read the index once the indexes are set.
+		for _, indexed := range []bool{false, true} {
+			if indexed {
+				if err := db.SetIndexes(testEntities); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, test := range []struct {
+				filters []Filter
+				after   string
+				want    []string
+				reads   int // records read at most
+			}{
+				{nil, "7", []string{"8", "9", "10"}, 3},
+				{nil, "-5", []string{"1", "2", "3"}, 3},
+				{nil, "10", []string{}, 0},
+				{filters, "1", []string{"3", "4", "5"}, 4},
+				{filters, "4", []string{"5", "6", "7"}, 3},
+			} {
+				seen := 0
+				v := FilterValidator(test.filters)
+				v.after = EncodeKey(test.after)
+				v.validate = append([]func([]byte) bool{func([]byte) bool { seen++; return true }}, v.validate...)
+				v.terminate = append(v.terminate, func(result [][]byte) bool { return len(result) >= 3 })
+				records, err := db.GetAll("users", v)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := ids(t, records); !slices.Equal(got, test.want) {
+					t.Errorf("GetAll after %s (indexed %v): got %v, want %v", test.after, indexed, got, test.want)
+				}
+				if seen > test.reads {
+					t.Errorf("GetAll after %s (indexed %v): %d records read", test.after, indexed, seen)
+				}
+			}
+		}
+	})
+}
+
+func TestStoreCount(t *testing.T) {
+	forEachStore(t, func(t *testing.T, db Store) {
+		if n, err := db.Count("users", nil); err != nil || n != 0 {
+			t.Fatalf("Count of an empty entity: got %d, %v", n, err)
+		}
+		for i := 1; i <= 10; i++ {
+			mustSet(t, db, "users", fmt.Sprint(i), record(i, "age", i*10))
+		}
+		filters, err := ParseFilters(map[string][]string{"age_gte": {"30"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		after := func(v *Validtor, id string) *Validtor {
+			v.after = EncodeKey(id)
+			return v
+		}
+
+		for _, test := range []struct {
+			name  string
+			valid *Validtor
+			want  int
+		}{
+			{"every record", nil, 10},
+			{"no filter", FilterValidator(nil), 10},
+			{"after a key", after(&Validtor{}, "7"), 3},
+			{"after a missing key", after(&Validtor{}, "-5"), 10},
+			{"filtered", FilterValidator(filters), 8},
+			{"filtered after a key", after(FilterValidator(filters), "7"), 3},
+		} {
+			if n, err := db.Count("users", test.valid); err != nil || n != test.want {
+				t.Errorf("Count %s: got %d, %v, want %d", test.name, n, err, test.want)
+			}
+		}
+		if n, err := db.Count("posts", nil); err != nil || n != 0 {
+			t.Errorf("Count of a missing entity: got %d, %v", n, err)
+		}
+	})
+}
+
+func TestStorePatch(t *testing.T) {
+	forEachStore(t, func(t *testing.T, db Store) {
+		mustSet(t, db, "users", "1", record(1, "name", "ada"))
+
+		failure := errors.New("invalid patch")
+		_, err := db.Patch("users", []byte("1"), func([]byte) ([]byte, error) { return nil, failure })
+		if !errors.Is(err, failure) {
+			t.Fatalf("Patch: got %v, want the error of the patch", err)
+		}
+		got, _ := db.Get("users", []byte("1"))
+		if string(got) != string(record(1, "name", "ada")) {
+			t.Fatalf("a failed patch changed the record: %s", got)
+		}
+
+		patched, err := db.Patch("users", []byte("1"), func(value []byte) ([]byte, error) {
+			if string(value) != string(record(1, "name", "ada")) {
+				t.Errorf("Patch: got %s", value)
+			}
+			return record(1, "name", "grace"), nil
+		})
+		if err != nil || string(patched) != string(record(1, "name", "grace")) {
+			t.Fatalf("Patch: got %s %v", patched, err)
+		}
+		got, _ = db.Get("users", []byte("1"))
+		if string(got) != string(patched) {
+			t.Fatalf("Patch wasn't written: got %s", got)
+		}
+
+		_, err = db.Patch("users", []byte("2"), func(value []byte) ([]byte, error) { return value, nil })
+		if !errors.Is(err, ErrNotFound) {
+			t.Fatalf("Patch of a missing record: got %v, want ErrNotFound", err)
+		}
+	})
+}
+
+func TestStoreUnique(t *testing.T) {
+	forEachStore(t, func(t *testing.T, db Store) {
+		if err := db.SetIndexes(testEntities); err != nil {
+			t.Fatal(err)
+		}
+		mustSet(t, db, "users", "1", record(1, "email", "ada@example.com", "age", 36))
+		mustSet(t, db, "users", "2", record(2, "email", "grace@example.com", "age", 36))
+		// Writing a record again keeps its own value
+		mustSet(t, db, "users", "1", record(1, "email", "ada@example.com", "age", 37))
+
+		err := db.Set("users", []byte("3"), record(3, "email", "ada@example.com"))
+		if !errors.Is(err, ErrConflict) {
+			t.Fatalf("Set of a taken value: got %v, want ErrConflict", err)
+		}
+		if want := "email is already taken"; !strings.HasSuffix(err.Error(), want) {
+			t.Fatalf("Set of a taken value: got %q, want it to end with %q", err, want)
+		}
+		_, err = db.Patch("users", []byte("2"), func([]byte) ([]byte, error) {
+			return record(2, "email", "ada@example.com"), nil
+		})
+		if !errors.Is(err, ErrConflict) {
+			t.Fatalf("Patch to a taken value: got %v, want ErrConflict", err)
+		}
+		got, _ := db.Get("users", []byte("2"))
+		if string(got) != string(record(2, "email", "grace@example.com", "age", 36)) {
+			t.Fatalf("a conflicting patch changed the record: %s", got)
+		}
+
+		// Values are freed by deletes and by changes
+		if _, err := db.Delete("users", []byte("1"), nil); err != nil {
+			t.Fatal(err)
+		}
+		mustSet(t, db, "users", "3", record(3, "email", "ada@example.com"))
+		mustSet(t, db, "users", "2", record(2, "email", "hopper@example.com"))
+		mustSet(t, db, "users", "4", record(4, "email", "grace@example.com"))
+		// Null values aren't duplicates
+		mustSet(t, db, "users", "5", record(5, "email", nil))
+		mustSet(t, db, "users", "6", record(6, "email", nil))
+
+		filters, _ := ParseFilters(map[string][]string{"age": {"36"}})
+		mustSet(t, db, "users", "7", record(7, "email", "lovelace@example.com", "age", 36))
+		records, err := db.GetAll("users", FilterValidator(filters))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := ids(t, records), []string{"7"}; !slices.Equal(got, want) {
+			t.Fatalf("GetAll on an indexed field: got %v, want %v", got, want)
+		}
+
+		// Only one of concurrent writes of the same value wins
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		written := 0
+		for i := 10; i < 30; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				err := db.Set("users", []byte(fmt.Sprint(i)), record(i, "email", "turing@example.com"))
+				mu.Lock()
+				defer mu.Unlock()
+				switch {
+				case err == nil:
+					written++
+				case !errors.Is(err, ErrConflict):
+					t.Errorf("Set: got %v, want ErrConflict", err)
+				}
+			}(i)
+		}
+		wg.Wait()
+		if written != 1 {
+			t.Fatalf("%d concurrent writes of a unique value succeeded, want 1", written)
+		}
+	})
+}
+
+func TestStoreSetIndexesDuplicates(t *testing.T) {
+	forEachStore(t, func(t *testing.T, db Store) {
+		mustSet(t, db, "users", "1", record(1, "email", "ada@example.com"))
+		mustSet(t, db, "users", "2", record(2, "email", "ada@example.com"))
+		if err := db.SetIndexes(testEntities); !errors.Is(err, ErrConflict) {
+			t.Fatalf("SetIndexes with duplicates: got %v, want ErrConflict", err)
+		}
+	})
+}
+
+func TestStoreNextID(t *testing.T) {
+	forEachStore(t, func(t *testing.T, db Store) {
+		mustSet(t, db, "users", "41", record(41))
+		mustSet(t, db, "users", "b", record("b"))
+		mustSet(t, db, "posts", "7", record(7))
+
+		next, err := db.NextID("users")
+		if err != nil || next != 42 {
+			t.Fatalf("NextID: got %d %v, want 42", next, err)
+		}
+		// Deleting the greatest id doesn't reuse it
+		if _, err := db.Delete("users", []byte("41"), nil); err != nil {
+			t.Fatal(err)
+		}
+		if next, _ := db.NextID("users"); next != 43 {
+			t.Fatalf("NextID after a delete: got %d, want 43", next)
+		}
+		if next, _ := db.NextID("comments"); next != 1 {
+			t.Fatalf("NextID of an empty entity: got %d, want 1", next)
+		}
+
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		seen := make(map[int64]bool)
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				n, err := db.NextID("posts")
+				mu.Lock()
+				defer mu.Unlock()
+				if err != nil || seen[n] {
+					t.Errorf("NextID: got %d %v, ids must be unique", n, err)
+				}
+				seen[n] = true
+			}()
+		}
+		wg.Wait()
+		for n := int64(8); n < 28; n++ {
+			if !seen[n] {
+				t.Fatalf("NextID skipped %d", n)
+			}
+		}
+	})
+}
+
+func TestStoreBatch(t *testing.T) {
+	forEachStore(t, func(t *testing.T, db Store) {
+		if err := db.SetIndexes(testEntities); err != nil {
+			t.Fatal(err)
+		}
+		mustSet(t, db, "users", "1", record(1, "email", "ada@example.com"))
+		mustSet(t, db, "users", "2", record(2, "email", "grace@example.com"))
+		if _, err := db.NextID("users"); err != nil {
+			t.Fatal(err)
+		}
+
+		err := db.Batch([]Write{
+			{Entity: "users", Key: []byte("1")},
+			{Entity: "users", Key: []byte("99")},
+			{Entity: "users", Key: []byte("2"), Value: record(2, "email", "ada@example.com")},
+			{Entity: "users", Key: []byte("10"), Value: record(10, "email", "hopper@example.com")},
+			{Entity: "posts", Key: []byte("a"), Value: record("a")},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		records, _ := db.GetAll("users", nil)
+		if got, want := ids(t, records), []string{"2", "10"}; !slices.Equal(got, want) {
+			t.Fatalf("users after Batch: got %v, want %v", got, want)
+		}
+		if posts, _ := db.GetAll("posts", nil); len(posts) != 1 {
+			t.Fatalf("posts after Batch: got %d records, want 1", len(posts))
+		}
+		// The counter is raised past the written ids
+		if last, err := db.LastID("users"); err != nil || last != 10 {
+			t.Fatalf("LastID after Batch: got %d %v, want 10", last, err)
+		}
+
+		// Nothing is written when a write fails
+		before, _ := db.Dump([]string{"users", "posts"})
+		err = db.Batch([]Write{
+			{Entity: "users", Key: []byte("2")},
+			{Entity: "posts", Key: []byte("b"), Value: record("b")},
+			{Entity: "users", Key: []byte("20"), Value: record(20, "email", "lovelace@example.com")},
+			{Entity: "users", Key: []byte("21"), Value: record(21, "email", "hopper@example.com")},
+		})
+		if !errors.Is(err, ErrConflict) {
+			t.Fatalf("Batch with a taken value: got %v, want ErrConflict", err)
+		}
+		after, _ := db.Dump([]string{"users", "posts"})
+		if fmt.Sprint(before) != fmt.Sprint(after) {
+			t.Fatalf("a failed Batch changed the records:\n%s\n%s", before, after)
+		}
+		if last, _ := db.LastID("users"); last != 10 {
+			t.Fatalf("LastID after a failed Batch: got %d, want 10", last)
+		}
+		// The values of the records that weren't deleted are still taken
+		if err := db.Set("users", []byte("30"), record(30, "email", "ada@example.com")); !errors.Is(err, ErrConflict) {
+			t.Fatalf("Set of a value kept by a failed Batch: got %v, want ErrConflict", err)
+		}
+		mustSet(t, db, "users", "30", record(30, "email", "lovelace@example.com"))
+	})
+}
+
+func TestStoreSchemaAndClear(t *testing.T) {
+	forEachStore(t, func(t *testing.T, db Store) {
+		schema, err := db.GetSchema()
+		if err != nil || schema != nil {
+			t.Fatalf("GetSchema of an empty store: got %v %v, want nil", schema, err)
+		}
+		if err := db.StoreSchema(testEntities); err != nil {
+			t.Fatal(err)
+		}
+		schema, err = db.GetSchema()
+		if err != nil || !ValidateSchema(testEntities, schema) {
+			t.Fatalf("GetSchema: got %v %v, want %v", schema, err, testEntities)
+		}
+
+		mustSet(t, db, "users", "1", record(1))
+		if _, err := db.NextID("users"); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Clear(); err != nil {
+			t.Fatal(err)
+		}
+		if records, _ := db.GetAll("users", nil); len(records) != 0 {
+			t.Fatalf("Clear kept %d records", len(records))
+		}
+		if schema, _ := db.GetSchema(); schema != nil {
+			t.Fatalf("Clear kept the schema: %v", schema)
+		}
+		if next, _ := db.NextID("users"); next != 1 {
+			t.Fatalf("Clear kept the id counter: got %d, want 1", next)
+		}
+	})
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// How long the running requests are waited for when the store is paused, and before a warning is logged for the requests of a replaced router
+const drainTimeout = 30 * time.Second
+
+// Handler of the http server that forwards the requests to the current router.
+// The router is replaced with Swap when the schema changes, the server keeps listening meanwhile.
+// A request is served by the router that was current when it arrived, or when it was let through after a pause.
+type SwappableHandler struct {
+	current atomic.Pointer[servedHandler]
+
+	mu     sync.Mutex
+	resume *sync.Cond // signaled when paused, reads or writes change
+	paused bool       // new requests wait, see Pause
+	reads  int        // requests with a safe method being served
+	writes int        // requests with an unsafe method being served
+}
+
+// A router and the requests it's serving
+type servedHandler struct {
+	handler http.Handler
+
+	mu      sync.Mutex
+	active  int  // requests being served
+	retired bool // replaced, it doesn't take new requests
+	drained chan struct{}
+}
+
+func NewSwappableHandler(handler http.Handler) *SwappableHandler {
+	h := &SwappableHandler{}
+	h.resume = sync.NewCond(&h.mu)
+	h.current.Store(newServedHandler(handler))
+	return h
+}
+
+func newServedHandler(handler http.Handler) *servedHandler {
+	return &servedHandler{handler: handler, drained: make(chan struct{})}
+}
+
+func (h *SwappableHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	write := r.Method != http.MethodGet && r.Method != http.MethodHead && r.Method != http.MethodOptions
+	h.mu.Lock()
+	for h.paused {
+		h.resume.Wait()
+	}
+	if write {
+		h.writes++
+	} else {
+		h.reads++
+	}
+	defer h.done(write)
+	h.mu.Unlock()
+
+	for {
+		// The router can be retired between the load and the acquire, the request goes to the new one then
+		current := h.current.Load()
+		if current.acquire() {
+			defer current.release()
+			current.handler.ServeHTTP(w, r)
+			return
+		}
+	}
+}
+
+func (h *SwappableHandler) done(write bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if write {
+		h.writes--
+	} else {
+		h.reads--
+	}
+	h.resume.Broadcast()
+}
+
+// Holds the new requests until resume is called and waits for the requests being served,
+// so the store can be changed without requests writing it or reading it halfway.
+// Reads can be slow (static files) and don't change the store, the ones still running after the timeout
+// are left running and can read the store halfway. Writes are always waited for.
+func (h *SwappableHandler) Pause(timeout time.Duration) (resume func()) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for h.paused {
+		h.resume.Wait()
+	}
+	h.paused = true
+
+	expired := false
+	timer := time.AfterFunc(timeout, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		expired = true
+		h.resume.Broadcast()
+	})
+	defer timer.Stop()
+	for h.writes > 0 || h.reads > 0 && !expired {
+		h.resume.Wait()
+	}
+	if h.reads > 0 {
+		log.Printf("%d read(s) still running after %s, pausing anyway", h.reads, timeout)
+	}
+
+	return func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		h.paused = false
+		h.resume.Broadcast()
+	}
+}
+
+// Replaces the router, the requests that arrive from now on are served by the new one.
+// Returns a channel closed once the requests of the previous router are done.
+func (h *SwappableHandler) Swap(handler http.Handler) <-chan struct{} {
+	previous := h.current.Swap(newServedHandler(handler))
+	return previous.retire()
+}
+
+func (s *servedHandler) acquire() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.retired {
+		return false
+	}
+	s.active++
+	return true
+}
+
+func (s *servedHandler) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.active--
+	if s.retired && s.active == 0 {
+		close(s.drained)
+	}
+}
+
+func (s *servedHandler) retire() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.retired = true
+	if s.active == 0 {
+		close(s.drained)
+	}
+	return s.drained
+}
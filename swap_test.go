@@ -0,0 +1,167 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSwappableHandler(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	slow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		io.WriteString(w, "old")
+	})
+	handler := NewSwappableHandler(slow)
+
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+	get := func() string {
+		res, err := http.Get(srv.URL)
+		if err != nil {
+			t.Error(err)
+			return ""
+		}
+		defer res.Body.Close()
+		b, _ := io.ReadAll(res.Body)
+		return string(b)
+	}
+
+	inflight := make(chan string)
+	go func() { inflight <- get() }()
+	<-started
+
+	drained := handler.Swap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "new")
+	}))
+	if got := get(); got != "new" {
+		t.Errorf("after the swap: got %q, want new", got)
+	}
+	select {
+	case <-drained:
+		t.Fatal("drained while a request is running")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	if got := <-inflight; got != "old" {
+		t.Errorf("in-flight request: got %q, want old", got)
+	}
+	select {
+	case <-drained:
+	case <-time.After(time.Second):
+		t.Fatal("not drained once the request is done")
+	}
+
+	// Nothing to wait for when the router is idle
+	select {
+	case <-handler.Swap(http.NotFoundHandler()):
+	default:
+		t.Error("an idle router isn't drained right away")
+	}
+}
+
+func TestSwappableHandlerPause(t *testing.T) {
+	release := map[string]chan struct{}{"GET": make(chan struct{}), "POST": make(chan struct{})}
+	started := make(chan string, 3)
+	handler := NewSwappableHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- r.Method
+		if r.URL.Path == "/slow" {
+			<-release[r.Method]
+		}
+		io.WriteString(w, "old")
+	}))
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+	do := func(method string, path string) <-chan string {
+		body := make(chan string, 1)
+		go func() {
+			req, _ := http.NewRequest(method, srv.URL+path, nil)
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Error(err)
+				body <- ""
+				return
+			}
+			defer res.Body.Close()
+			b, _ := io.ReadAll(res.Body)
+			body <- string(b)
+		}()
+		return body
+	}
+	pause := func(timeout time.Duration) <-chan func() {
+		paused := make(chan func(), 1)
+		go func() { paused <- handler.Pause(timeout) }()
+		return paused
+	}
+
+	// Running reads and writes hold the pause
+	slowRead := do("GET", "/slow")
+	<-started
+	slowWrite := do("POST", "/slow")
+	<-started
+	paused := pause(time.Minute)
+	close(release["POST"])
+	<-slowWrite
+	select {
+	case <-paused:
+		t.Fatal("paused while a read is running")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release["GET"])
+	<-slowRead
+	resume := <-paused
+
+	// New requests wait for the end of the pause, and are served by the router swapped in meanwhile
+	read := do("GET", "/")
+	select {
+	case <-read:
+		t.Fatal("served while paused")
+	case <-time.After(50 * time.Millisecond):
+	}
+	handler.Swap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "new")
+	}))
+	resume()
+	select {
+	case got := <-read:
+		if got != "new" {
+			t.Errorf("held request: got %q, want new", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("not served once resumed")
+	}
+
+	// Reads are waited for until the timeout, writes aren't
+	unblock := make(chan struct{})
+	handler.Swap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- r.Method
+		<-unblock
+	}))
+	stuck := do("GET", "/")
+	<-started
+	select {
+	case resume := <-pause(50 * time.Millisecond):
+		resume()
+	case <-time.After(time.Second):
+		t.Fatal("a running read held the pause after the timeout")
+	}
+	close(unblock)
+	<-stuck
+
+	unblock = make(chan struct{})
+	stuck = do("POST", "/")
+	<-started
+	paused = pause(10 * time.Millisecond)
+	select {
+	case <-paused:
+		t.Fatal("paused while a write is running")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(unblock)
+	<-stuck
+	(<-paused)()
+}
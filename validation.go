@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// How request bodies are checked against the schema of their entity
+type ValidationMode string
+
+const (
+	StrictValidation  ValidationMode = "strict"  // every field must be present and unknown fields are rejected
+	LenientValidation ValidationMode = "lenient" // only the fields present and the `required` ones are checked
+	NoValidation      ValidationMode = "off"
+)
+
+var validationModes = []ValidationMode{StrictValidation, LenientValidation, NoValidation}
+
+// Returns the problems of a request body, or of a record once patched
+func ValidateBody(entity Entity, mode ValidationMode, body map[string]any) []Violation {
+	if entity.Validation != "" {
+		mode = entity.Validation
+	}
+	// Entities taken from an ingested file have no schema to check against
+	if mode == NoValidation || len(entity.Schema) == 0 {
+		return nil
+	}
+
+	policy := CheckPolicy{}
+	if mode == LenientValidation {
+		policy.AllowMissing = true
+		policy.AllowUnknown = true
+	}
+	violations := CheckRecordWith(entity.Schema, body, policy)
+	for i := range violations {
+		violations[i].Entity = entity.Name
+	}
+	return violations
+}
+
+// Error returned from inside a transaction when a patched record doesn't match the schema
+type violationsError []Violation
+
+func (v violationsError) Error() string {
+	return fmt.Sprintf("found %d problem(s)", len(v))
+}
+
+// Returns a 422 error listing the problems of a request body, or nil if there are none
+func validationError(violations []Violation) *ResError {
+	if len(violations) == 0 {
+		return nil
+	}
+	return &ResError{
+		Error:      "invalid request body",
+		Status:     http.StatusUnprocessableEntity,
+		Violations: violations,
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+var members = Entity{
+	Name: "members",
+	Schema: []Field{
+		{Name: "name", Kind: StringType, Options: map[string]any{"required": true}},
+		{Name: "age", Kind: NumberType},
+		{Name: "email", Kind: EmailType, Options: map[string]any{"unique": true}},
+	},
+}
+
+func TestValidateBody(t *testing.T) {
+	complete := map[string]any{"name": "ada", "age": 36.0, "email": "ada@example.com"}
+	for _, test := range []struct {
+		mode ValidationMode
+		body map[string]any
+		want []string
+	}{
+		{StrictValidation, complete, []string{}},
+		{StrictValidation, map[string]any{"name": "ada"}, []string{"members[].age: missing field", "members[].email: missing field"}},
+		{StrictValidation, map[string]any{"name": "ada", "age": 36.0, "email": "ada@example.com", "admin": true}, []string{"members[].admin: unexpected field"}},
+		{LenientValidation, map[string]any{"name": "ada", "admin": true}, []string{}},
+		{LenientValidation, map[string]any{"age": 36.0}, []string{"members[].name: missing field"}},
+		{LenientValidation, map[string]any{"name": "ada", "age": "36"}, []string{`members[].age: expected number, got "36"`}},
+		{NoValidation, map[string]any{"age": "36", "admin": true}, []string{}},
+	} {
+		t.Run(fmt.Sprint(test.mode, test.body), func(t *testing.T) {
+			got := make([]string, 0)
+			for _, v := range ValidateBody(members, test.mode, test.body) {
+				got = append(got, v.String())
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+
+	// The mode of the entity wins over the server's
+	strict := members
+	strict.Validation = StrictValidation
+	if len(ValidateBody(strict, NoValidation, map[string]any{"name": "ada"})) == 0 {
+		t.Error("the strict mode of the entity wasn't applied")
+	}
+	// Entities without a schema accept anything
+	if v := ValidateBody(Entity{Name: "logs"}, StrictValidation, map[string]any{"any": 1.0}); len(v) != 0 {
+		t.Errorf("entity without a schema: got %v", v)
+	}
+}
+
+// Every write checks its body according to the validation mode, invalid bodies get a 422 listing the problems
+func TestValidationModes(t *testing.T) {
+	for _, test := range []struct {
+		method, path, body string
+		want               map[ValidationMode]int
+	}{
+		{"POST", "/members", `{"name": "grace", "age": 45, "email": "grace@example.com"}`,
+			map[ValidationMode]int{StrictValidation: 201, LenientValidation: 201, NoValidation: 201}},
+		{"POST", "/members", `{"name": "grace"}`,
+			map[ValidationMode]int{StrictValidation: 422, LenientValidation: 201, NoValidation: 201}},
+		{"POST", "/members", `{"name": "grace", "age": 45, "email": "grace@example.com", "admin": true}`,
+			map[ValidationMode]int{StrictValidation: 422, LenientValidation: 201, NoValidation: 201}},
+		{"POST", "/members", `{"age": 45}`,
+			map[ValidationMode]int{StrictValidation: 422, LenientValidation: 422, NoValidation: 201}},
+		{"POST", "/members", `{"name": "grace", "email": "not an email"}`,
+			map[ValidationMode]int{StrictValidation: 422, LenientValidation: 422, NoValidation: 201}},
+		{"PUT", "/members/1", `{"name": "ada"}`,
+			map[ValidationMode]int{StrictValidation: 422, LenientValidation: 200, NoValidation: 200}},
+		{"PUT", "/members/1", `{"name": 1, "age": 36, "email": "ada@example.com"}`,
+			map[ValidationMode]int{StrictValidation: 422, LenientValidation: 422, NoValidation: 200}},
+		// The patched record is checked, the fields it already has count
+		{"PATCH", "/members/1", `{"age": 37}`,
+			map[ValidationMode]int{StrictValidation: 200, LenientValidation: 200, NoValidation: 200}},
+		{"PATCH", "/members/1", `{"age": "37"}`,
+			map[ValidationMode]int{StrictValidation: 422, LenientValidation: 422, NoValidation: 200}},
+		{"PATCH", "/members/1", `{"name": null}`,
+			map[ValidationMode]int{StrictValidation: 422, LenientValidation: 422, NoValidation: 200}},
+		{"PATCH", "/members/1", `{"nickname": "countess"}`,
+			map[ValidationMode]int{StrictValidation: 422, LenientValidation: 200, NoValidation: 200}},
+	} {
+		for _, mode := range validationModes {
+			t.Run(fmt.Sprint(mode, " ", test.method, " ", test.body), func(t *testing.T) {
+				h := testServer(t, NewMemDB(), []Entity{members}, map[string][][]byte{
+					"members": {record(1, "name", "ada", "age", 36, "email", "ada@example.com")},
+				}, AddValidation(mode))
+				w := serve(h, test.method, test.path, test.body)
+				if w.Code != test.want[mode] {
+					t.Fatalf("got %d %s, want %d", w.Code, w.Body, test.want[mode])
+				}
+				if w.Code != http.StatusUnprocessableEntity {
+					return
+				}
+				var problem ResError
+				if err := json.Unmarshal(w.Body.Bytes(), &problem); err != nil || len(problem.Violations) == 0 {
+					t.Errorf("422 without the violations: %s", w.Body)
+				}
+			})
+		}
+	}
+}
+
+// Errors are problem details (RFC 9457) with the status of the error
+func TestProblemStatuses(t *testing.T) {
+	h := testServer(t, NewMemDB(), []Entity{members}, map[string][][]byte{
+		"members": {
+			record(1, "name", "ada", "age", 36, "email", "ada@example.com"),
+			record(2, "name", "grace", "age", 45, "email", "grace@example.com"),
+		},
+	})
+	for _, test := range []struct {
+		name, method, path, body string
+		header                   map[string]string
+		status                   int
+		detail                   string
+	}{
+		{"invalid json", "POST", "/members", `{"name":`, nil, 400, "invalid json"},
+		{"invalid id", "POST", "/members", `{"id": 1.5, "name": "x"}`, nil, 400, "invalid id 1.5, ids are non-empty strings or integers"},
+		{"invalid filter", "GET", "/members?_limit=x", "", nil, 400, "_limit: expected a positive integer"},
+		{"invalid patch", "PATCH", "/members/1", `[{"op": "remove", "path": "/nickname"}]`, map[string]string{"Content-Type": JSONPatchType}, 400, ""},
+		{"missing record", "GET", "/members/3", "", nil, 404, "members 3 not found"},
+		{"missing record to replace", "PUT", "/members/3", `{"name": "x"}`, nil, 404, "members 3 not found"},
+		{"missing record to patch", "PATCH", "/members/3", `{"name": "x"}`, nil, 404, "members 3 not found"},
+		{"missing record to delete", "DELETE", "/members/3", "", nil, 404, "members 3 not found"},
+		{"unknown route", "GET", "/teams", "", nil, 404, "no route matches /teams"},
+		{"taken id", "POST", "/members", `{"id": 1, "name": "x"}`, nil, 409, "members 1 already exists"},
+		{"taken unique value", "PATCH", "/members/2", `{"email": "ada@example.com"}`, nil, 409, ""},
+		{"failed JSON Patch test", "PATCH", "/members/1", `[{"op": "test", "path": "/name", "value": "grace"}]`, map[string]string{"Content-Type": JSONPatchType}, 409, ""},
+		{"stale If-Match on PUT", "PUT", "/members/1", `{"name": "x"}`, map[string]string{"If-Match": `"old"`}, 412, ""},
+		{"stale If-Match on DELETE", "DELETE", "/members/1", "", map[string]string{"If-Match": `"old"`}, 412, ""},
+		{"invalid body", "POST", "/members", `{"name": 1}`, nil, 422, "invalid request body"},
+		{"method not allowed", "DELETE", "/members", "", nil, 405, "DELETE isn't allowed on /members"},
+		{"unsupported patch type", "PATCH", "/members/1", `{}`, map[string]string{"Content-Type": "text/plain"}, 415, ""},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			r := newRequest(test.method, test.path, test.body)
+			for key, value := range test.header {
+				r.Header.Set(key, value)
+			}
+			w := serveRequest(h, r)
+			if w.Code != test.status {
+				t.Fatalf("got %d %s, want %d", w.Code, w.Body, test.status)
+			}
+			if ct := w.Header().Get("Content-Type"); ct != "application/problem+json" {
+				t.Errorf("Content-Type %s, want application/problem+json", ct)
+			}
+			var problem ResError
+			if err := json.Unmarshal(w.Body.Bytes(), &problem); err != nil {
+				t.Fatal(err)
+			}
+			if problem.Status != test.status || problem.Title != http.StatusText(test.status) || problem.Instance != r.URL.Path {
+				t.Errorf("got problem %+v", problem)
+			}
+			if test.detail != "" && problem.Error != test.detail {
+				t.Errorf("got detail %q, want %q", problem.Error, test.detail)
+			}
+		})
+	}
+
+	// Refused writes leave the records as they were
+	w := serve(h, "GET", "/members", "")
+	var records []map[string]any
+	json.Unmarshal(w.Body.Bytes(), &records)
+	if len(records) != 2 || records[0]["name"] != "ada" || records[1]["email"] != "grace@example.com" {
+		t.Errorf("refused writes changed the records: %s", w.Body)
+	}
+}